@@ -8,16 +8,38 @@
 #include <linux/tcp.h>
 #include <arpa/inet.h>
 
-#define FORMAT_IP(ip) \
-	(ip) & 0xff, ((ip) >> 8) & 0xff, ((ip) >> 16) & 0xff, ((ip) >> 24) & 0xff
+#ifndef AF_INET
+#define AF_INET 2
+#endif
+
+#ifndef EBADMSG
+#define EBADMSG 74
+#endif
+
+#ifndef ENOENT
+#define ENOENT 2
+#endif
+
+#ifndef EINVAL
+#define EINVAL 22
+#endif
+
+#define SERVER_POP_MAX_TRIES 8
 
-#define POOLER_PORT 6432
-#define BACKEND_PORT 5432
-#define TX_MODE
 #define SUPPORT_PREPARED_STATEMENT
 #define POSTGRES_MAX_IDENTIFIER_LENGTH 64
-#define POSTGRES_MAX_MESSAGES 1024
-#define POSTGRES_MAX_MESSAGE_SIZE 32768
+// the batches are framed once this much is buffered, strparser aborts the
+// sockets buffering more than their receive buffer. A batch overshoots it by
+// up to a segment, twice it fits in the default receive buffer.
+#define POSTGRES_MAX_BATCH_SIZE 65536
+// the longest keyword of the statements that may change session state
+#define SESSION_KEYWORD_MAX_LENGTH 8
+// the simple queries are scanned for these keywords by chunks of this size
+#define SESSION_SCAN_CHUNK 32
+// the simple queries of a batch are scanned up to this size, longer ones are
+// passed to user-space
+#define SESSION_SCAN_MAX_LENGTH 65536
+#define LOCAL_QUERY_MAX_LENGTH 32
 // #define ENABLE_DEBUG
 
 #define unlikely(x) __builtin_expect(!!(x), 0)
@@ -27,273 +49,1103 @@ typedef __u32 u32;
 typedef __u16 u16;
 typedef __u8 u8;
 
-#define FNV32_PRIME 16777619
-#define FNV32_OFFSET 2166136261U
+// The settings of the pool, rewritten by user space at load time.
+volatile const u32 pooler_port = 6432;
+volatile const u32 backend_port = 5432;
+volatile const u8 tx_mode = 1;
 
 struct pgmsghdr {
 	u8 code;
 	u32 len;
 } __attribute__((__packed__));
 
-struct socket_4_tuple {
-	u32 local_ip4;		// network byte order
+// socket_6_tuple identifies a socket. IPv4 addresses are mapped to IPv6
+// (::ffff:a.b.c.d), the way dual-stack sockets see IPv4 peers.
+struct socket_6_tuple {
+	u32 local_ip6[4];	// network byte order
 	u32 local_port;		// host byte order
-	u32 remote_ip4;		// network byte order
+	u32 remote_ip6[4];	// network byte order
 	u32 remote_port;	// network byte order
 };
 
 struct client_state {
 	// valid indicates whether the server is valid.
 	u8 valid;
+	// pinned indicates whether the client changed session state, and keeps the
+	// server until it disconnects.
+	u8 pinned;
+	// pending is the number of messages of the client passed to user-space
+	// and not forwarded by it yet. The next messages are passed as well while
+	// any is pending, so that they reach the server in order.
+	u32 pending;
+	// params identifies the parameters of the client, it is bound the servers
+	// with the same parameters only.
+	u32 params;
 	// server is the current server the client is connected to.
-	struct socket_4_tuple server;
+	struct socket_6_tuple server;
+	// last_active_ns is the time the client last sent data.
+	u64 last_active_ns;
+};
+
+// server_queue is the queue an unbound server is in.
+enum server_queue {
+	// SERVER_QUEUE_NONE is for the bound servers and the ones user-space holds
+	SERVER_QUEUE_NONE,
+	SERVER_QUEUE_POOL,
+	SERVER_QUEUE_ORPHANED,
 };
 
 struct server_state {
-	// valid indicates whether the client is valid.
-	u8 valid;
+	// valid indicates whether the client is valid. It is cleared by compare and
+	// swap, so that the server is released once by either the kernel or
+	// user-space.
+	u32 valid;
 	// client is the client the server is connected to.
-	struct socket_4_tuple client;
-	// prepared maps the hash prepared statement into the prepared statement name.
-	u8 prepared[256][POSTGRES_MAX_IDENTIFIER_LENGTH];
+	struct socket_6_tuple client;
+	// last_active_ns is the time the server last sent data to a client.
+	u64 last_active_ns;
+	// queue is the server_queue the server is in, as the queues cannot be read
+	// without popping them.
+	u8 queue;
+	// idle indicates whether the last message the server sent is a
+	// ReadyForQuery outside of a transaction.
+	u8 idle;
+	// params identifies the parameters user-space applied to the server.
+	u32 params;
+};
+
+// prepared_key identifies a statement prepared on a server.
+struct prepared_key {
+	struct socket_6_tuple server;
+	// name is the name of the prepared statement, padded with zeros.
+	u8 name[POSTGRES_MAX_IDENTIFIER_LENGTH];
+};
+
+// stat indexes the counters of the stats map. User-space mirrors it.
+enum stat {
+	STAT_CLIENT_REDIRECTS,
+	STAT_CLIENT_REDIRECT_BYTES,
+	STAT_SERVER_REDIRECTS,
+	STAT_SERVER_REDIRECT_BYTES,
+	STAT_TRANSACTIONS,
+	STAT_SERVER_POPS,
+	STAT_SERVER_PUSHES,
+	// the reasons messages are passed to user-space
+	STAT_PASS_NO_CLIENT_STATE,
+	STAT_PASS_NO_SERVER,
+	STAT_PASS_PENDING,
+	STAT_PASS_LARGE_MESSAGE,
+	STAT_PASS_UNPREPARED_STATEMENT,
+	STAT_PASS_SESSION_STATEMENT,
+	STAT_PASS_LOCAL_QUERY,
+	STAT_PASS_TERMINATE,
+	STAT_PASS_UNBOUND_SERVER,
+	STAT_PASS_NON_TARGETED,
+	STAT_PASS_PARAMETERS,
+	STAT_MAX,
+};
+
+// event_type is the type of the events traced to user-space. User-space
+// mirrors it.
+enum event_type {
+	EVENT_BIND = 1,
+	EVENT_UNBIND,
+	EVENT_PASS,
+	EVENT_PREPARED_MISS,
+};
+
+// event is an event of the verdict program, traced to user-space.
+struct event {
+	u64 timestamp_ns;
+	u32 type;
+	// reason is the stat of the reason a message is passed to user-space.
+	u32 reason;
+	// socket is the client, or the socket the passed message comes from.
+	struct socket_6_tuple socket;
+	// peer is the server of the client, if any.
+	struct socket_6_tuple peer;
+};
+
+// state_op is an update of the state of a client requested by user-space.
+enum state_op {
+	STATE_OP_PIN = 1,
+	STATE_OP_BIND,
+	STATE_OP_FORWARDED,
+	STATE_OP_UNBIND,
+	STATE_OP_QUEUE,
+	STATE_OP_DEQUEUE,
+};
+
+// state_update is the context of syscall_prog_update_state, filled by
+// user-space.
+struct state_update {
+	u32 op;
+	struct socket_6_tuple client;
+	// server is the server to bind the client to, or to queue or dequeue.
+	struct socket_6_tuple server;
+	// forwarded is the number of pending messages user-space forwarded.
+	u32 forwarded;
+	// params identifies the parameters of the server to bind or to queue.
+	u32 params;
+};
+
+// unused_event keeps the event type in BTF for bpf2go.
+const struct event* unused_event __attribute__((unused));
+
+// orphaned_server is a server unbound from a closed client.
+struct orphaned_server {
+	struct socket_6_tuple server;
+	// running indicates whether the server had not answered the client yet.
+	u8 running;
+	// pinned indicates whether the client left session state on the server.
+	u8 pinned;
+};
+
+// partial is a message continuing over the next batches. Its bytes follow the
+// verdict of the batches they are framed along with.
+struct partial {
+	// remaining is the number of bytes of the message left to frame.
+	u32 remaining;
+};
+
+struct local_query {
+	// query is the query string, padded with zeros.
+	u8 query[LOCAL_QUERY_MAX_LENGTH];
 };
 
 struct {
 	__uint(type, BPF_MAP_TYPE_SOCKHASH);
 	__uint(max_entries, 2000);
-	__type(key, struct socket_4_tuple);
+	__type(key, struct socket_6_tuple);
 	__type(value, u32); // socket FD
 } sockhash SEC(".maps");
 
 struct {
 	__uint(type, BPF_MAP_TYPE_QUEUE);
 	__uint(max_entries, 1000);
-	__type(value, struct socket_4_tuple);
+	__type(value, struct socket_6_tuple);
 } servers SEC(".maps");
 
+// waiters holds the number of clients waiting in user-space for a server.
+// They take the servers put back to the pool first.
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, u32);
+	__type(value, u32);
+} waiters SEC(".maps");
+
+// orphaned_servers holds the servers unbound from a closed client, for
+// user-space to reset them and put them back to the pool.
+struct {
+	__uint(type, BPF_MAP_TYPE_QUEUE);
+	__uint(max_entries, 1000);
+	__type(value, struct orphaned_server);
+} orphaned_servers SEC(".maps");
+
 struct {
 	__uint(type, BPF_MAP_TYPE_HASH);
 	__uint(max_entries, 1000);
-	__type(key, struct socket_4_tuple);
+	__type(key, struct socket_6_tuple);
 	__type(value, struct client_state);
 } client_states SEC(".maps");
 
 struct {
 	__uint(type, BPF_MAP_TYPE_HASH);
 	__uint(max_entries, 1000);
-	__type(key, struct socket_4_tuple);
+	__type(key, struct socket_6_tuple);
 	__type(value, struct server_state);
 } server_states SEC(".maps");
 
-u8 is_unprepared_statement(struct __sk_buff* skb, struct server_state* ss) {
-	void* data = (void*)(long)skb->data;
-	void* data_end = (void*)(long)skb->data_end;
+// partials holds the messages continuing over the next batches, by socket.
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 2000);
+	__type(key, struct socket_6_tuple);
+	__type(value, struct partial);
+} partials SEC(".maps");
 
-	if (!ss) {
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 64);
+	__type(key, struct local_query);
+	__type(value, u8);
+} local_queries SEC(".maps");
+
+// stats holds the counters of the verdict program, per CPU so that they are
+// updated without atomics.
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, STAT_MAX);
+	__type(key, u32);
+	__type(value, u64);
+} stats SEC(".maps");
+
+// kpgpool_events streams the events of the verdict program to the tracers, the
+// events are dropped while the buffer is full.
+struct {
+	__uint(type, BPF_MAP_TYPE_RINGBUF);
+	__uint(max_entries, 256 * 1024);
+} kpgpool_events SEC(".maps");
+
+// prepared holds the statements prepared on each server by user-space. The
+// least recently used ones are evicted, their Binds go to user-space again.
+struct {
+	__uint(type, BPF_MAP_TYPE_LRU_HASH);
+	__uint(max_entries, 16384);
+	__type(key, struct prepared_key);
+	__type(value, u8);
+} prepared SEC(".maps");
+
+// batch is the walk of the messages of an skb. The stream parser frames the
+// stream in batches of whole messages, but for the messages of the servers
+// larger than POSTGRES_MAX_BATCH_SIZE, which continue over the next batches.
+struct batch {
+	struct __sk_buff* skb;
+	// server is the server the named Binds are looked up for, if any.
+	struct socket_6_tuple* server;
+	// off is the offset of the next message, past the skb once the last one
+	// continues in the next batches.
+	u64 off;
+	u32 len;
+	// messages is the number of messages starting in the skb.
+	u32 messages;
+	// transactions is the number of ReadyForQuery outside of a transaction.
+	u32 transactions;
+	// first is the header of the first message starting in the skb.
+	struct pgmsghdr first;
+	// scan indicates whether the messages are scanned for the flags below, or
+	// only framed.
+	u8 scan;
+	u8 bad;
+	u8 parse;
+	// named_bind indicates whether a Bind of a named statement was seen, and
+	// unprepared whether the server does not have it.
+	u8 named_bind;
+	u8 unprepared;
+	// query indicates whether a simple query was seen, the batch is scanned
+	// for session state once walked.
+	u8 query;
+	// idle indicates whether the last message is a ReadyForQuery outside of a
+	// transaction.
+	u8 idle;
+};
+
+// load_body loads up to size bytes of the message at off, skip bytes past its
+// header, and returns the number of bytes loaded. The bytes past the message
+// or past the skb are not loaded.
+static __always_inline u32 load_body(struct batch* b, u32 off, u32 len, u32 skip, void* buf, u32 size) {
+	u32 n = len - sizeof(u32);
+	if (n <= skip) {
 		return 0;
 	}
+	n -= skip;
 
-	u32 offset = 0;
-	for (int messages = 0; messages < POSTGRES_MAX_MESSAGES; ++messages) {
-		if (unlikely(offset > POSTGRES_MAX_MESSAGE_SIZE)) {
-			return 0;
+	u32 avail = b->len - off;
+	if (avail <= sizeof(struct pgmsghdr) + skip) {
+		return 0;
+	}
+	avail -= sizeof(struct pgmsghdr) + skip;
+
+	if (n > avail) {
+		n = avail;
+	}
+	if (n > size) {
+		n = size;
+	}
+	if (bpf_skb_load_bytes(b->skb, off + sizeof(struct pgmsghdr) + skip, buf, n) < 0) {
+		return 0;
+	}
+	return n;
+}
+
+// scan_bind scans a Bind for its statement name, and looks it up for the
+// server once known. Only the unnamed portal is used, the Binds of a named
+// portal are taken as unprepared.
+static __always_inline void scan_bind(struct batch* b, u32 off, u32 len) {
+	struct {
+		u8 portal;
+		u8 name[POSTGRES_MAX_IDENTIFIER_LENGTH];
+	} __attribute__((__packed__)) bn = {};
+
+	u32 n = load_body(b, off, len, 0, &bn, sizeof(bn));
+	// the unnamed statement is parsed in the same batch
+	if (n > 1 && bn.portal == '\0' && bn.name[0] == '\0') {
+		return;
+	}
+
+	b->named_bind = 1;
+	if (!b->server) {
+		return;
+	}
+
+	struct prepared_key pk = {};
+	pk.server = *b->server;
+	u8 terminated = 0;
+	for (int i = 0; i < POSTGRES_MAX_IDENTIFIER_LENGTH; ++i) {
+		if (terminated) {
+			break;
 		}
-		if (unlikely(offset >= skb->len)) {
-			return 0;
+		if (bn.name[i] == '\0') {
+			terminated = 1;
 		}
+		pk.name[i] = bn.name[i];
+	}
 
-		struct pgmsghdr* pgh = data + offset;
-		if (unlikely((void*)(pgh + 1) > data_end)) {
-			return 0;
-		}
+	// the name is too long to be registered, or continues in the next batch
+	if (n == 0 || bn.portal != '\0' || !terminated || !bpf_map_lookup_elem(&prepared, &pk)) {
+		b->unprepared = 1;
+	}
+}
 
-		// Parse must go to user-space.
-		if (pgh->code == 'P') {
-			return 1;
+// KEYWORD packs the lower-case keyword kw of up to 8 bytes, the first byte
+// lowest, to be compared with the window of the query as its low n bytes.
+#define KEYWORD(kw) keyword(kw, sizeof(kw) - 1)
+
+static __always_inline u64 keyword(const char* kw, u32 n) {
+	u64 w = 0;
+	for (int i = 0; i < SESSION_KEYWORD_MAX_LENGTH; ++i) {
+		if (i < n) {
+			w |= (u64)(u8)kw[i] << (i * 8);
 		}
+	}
+	return w;
+}
 
-		// Bind must go to user-space if the server is not prepared.
-		if (pgh->code == 'B') {
-			u8* ns = data + offset + 6;
-			u8* ne = ns;
-			u32 hash = FNV32_OFFSET;
-			for (int i = 0; i < POSTGRES_MAX_IDENTIFIER_LENGTH; ++i) {
-				if (unlikely((void*)(ne) + 1 > data_end)) {
-					return 0;
-				}
-				if (*ne == '\0') {
-					break;
-				}
-				hash ^= (u32)(*ne);
-				hash *= FNV32_PRIME;
-				++ne;
-			}
-			hash &= 0xFF;
+#define KEYWORD_MASK(kw) \
+	((sizeof(kw) - 1) * 8 == 64 ? ~0ULL : (1ULL << ((sizeof(kw) - 1) * 8)) - 1)
 
-			ne = ns;
-			for (int i = 0; i < POSTGRES_MAX_IDENTIFIER_LENGTH; ++i) {
-				if (unlikely((void*)(ne) + 1 > data_end)) {
-					return 0;
-				}
-				if (*ne == '\0') {
-					break;
-				}
-				if (*ne != ss->prepared[hash][i]) {
-					return 1;
-				}
-				++ne;
-			}
+// HAS_KEYWORD returns whether the window w of the query, its last 8 bytes
+// with the case bit set, starts with the keyword kw. Setting the case bit
+// lower-cases the letters and leaves no other byte a lower-case letter, so
+// the keywords are compared case-insensitively.
+#define HAS_KEYWORD(w, kw) (int)(((w) & KEYWORD_MASK(kw)) == KEYWORD(kw))
 
-			return 0;
+// session_scan is the scan of the simple queries for the keywords of the
+// statements that may change session state.
+struct session_scan {
+	struct __sk_buff* skb;
+	// off is the offset of the queries, end the offset past them.
+	u32 off;
+	u32 end;
+	// w is the window of the last 8 bytes with the case bit set, the oldest
+	// lowest, sliding over chunk, and prev the byte before it.
+	u64 w;
+	u8 prev;
+	u8 chunk[SESSION_SCAN_CHUNK];
+	u8 found;
+};
+
+// is_identifier returns whether the byte with the case bit set may be part of
+// an identifier.
+static __always_inline int is_identifier(u8 c) {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == ('_' | 0x20);
+}
+
+// scan_session_byte slides the window over the byte at index, loading the
+// bytes by chunks. The scan goes on past the end over zeros, until the window
+// holds the last byte at its start. The body is kept short of branches, the
+// verifier explores every path of a bpf_loop callback again and again.
+static long scan_session_byte(u32 index, void* ctx) {
+	struct session_scan* s = ctx;
+	u32 i = index % SESSION_SCAN_CHUNK;
+	if (i == 0) {
+		__builtin_memset(s->chunk, 0, sizeof(s->chunk));
+		u32 off = s->off + index;
+		if (off < s->end) {
+			u32 n = s->end - off;
+			if (n > sizeof(s->chunk)) {
+				n = sizeof(s->chunk);
+			}
+			// the verifier knows n is not zero this way
+			n = ((n - 1) & (sizeof(s->chunk) - 1)) + 1;
+			// what cannot be read is taken as a match, user-space checks it
+			if (bpf_skb_load_bytes(s->skb, off, s->chunk, n) < 0) {
+				s->found = 1;
+			}
 		}
+	}
+
+	s->prev = s->w;
+	s->w = (s->w >> 8) | ((u64)(s->chunk[i] | 0x20) << 56);
+	// SET starts a word, the other keywords may be part of longer names
+	s->found |= (HAS_KEYWORD(s->w, "set") & !is_identifier(s->prev)) |
+		HAS_KEYWORD(s->w, "listen") |
+		HAS_KEYWORD(s->w, "prepare") |
+		HAS_KEYWORD(s->w, "temp") |
+		HAS_KEYWORD(s->w, "advisory");
+	return s->found & 1;
+}
 
-		offset += bpf_ntohl(pgh->len) + 1;
+// scan_session returns whether the bytes of the skb from off to end hold any
+// keyword of the statements that may change session state. The bytes past
+// the skb, or past SESSION_SCAN_MAX_LENGTH, are taken as a match. It is a
+// global function, which the verifier checks once rather than along every
+// path of the verdict program reaching it.
+__attribute__((noinline)) int scan_session(struct __sk_buff* skb, u32 off, u32 end) {
+	if (end <= off || end - off > SESSION_SCAN_MAX_LENGTH) {
+		return 1;
 	}
 
-	return 0;
+	struct session_scan s = {
+		.skb = skb,
+		.off = off,
+		.end = end,
+	};
+	bpf_loop(end - off + SESSION_KEYWORD_MAX_LENGTH - 1, scan_session_byte, &s, 0);
+	return s.found;
 }
 
-u8 is_ready_for_query_idle(struct __sk_buff* skb) {
-	void* data = (void*)(long)skb->data;
-	void* data_end = (void*)(long)skb->data_end;
+// is_session_statement returns whether the simple queries of the walked batch
+// may change session state, that is whether they hold any keyword of such
+// statements, anywhere and in any case: SET and set_config starting a word,
+// LISTEN, PREPARE, temporary tables and advisory locks. Leading comments,
+// other statements before them, or any white space would hide a keyword
+// matched at the start only. The other messages of the batch are scanned
+// along, and a query continuing in the next batches is taken as a match:
+// user-space does the exact check, skipping comments and literals, and pins
+// the client. The messages start at off.
+static __always_inline u8 is_session_statement(struct batch* b, u32 off) {
+	if (!b->query) {
+		return 0;
+	}
 
-	u32 offset = 0;
-	for (int messages = 0; messages < POSTGRES_MAX_MESSAGES; ++messages) {
-		if (unlikely(offset > POSTGRES_MAX_MESSAGE_SIZE)) {
-			return 0;
-		}
-		if (unlikely(offset >= skb->len)) {
-			return 0;
+	u32 end = b->len + 1;
+	if (b->off < end) {
+		end = b->off;
+	}
+	return scan_session(b->skb, off, end);
+}
+
+// walk_message walks over the next message of the batch, and scans it if
+// asked to. It stops past the skb, or on a header continuing in the next one.
+static long walk_message(u32 index, void* ctx) {
+	struct batch* b = ctx;
+	if (b->off >= b->len) {
+		return 1;
+	}
+
+	struct pgmsghdr hdr;
+	u32 off = b->off;
+	if (b->len - off < sizeof(hdr)) {
+		return 1;
+	}
+	if (bpf_skb_load_bytes(b->skb, off, &hdr, sizeof(hdr)) < 0) {
+		b->bad = 1;
+		return 1;
+	}
+
+	// the length includes itself but not the message type
+	u32 len = bpf_ntohl(hdr.len);
+	if (unlikely(len < sizeof(hdr.len))) {
+		b->bad = 1;
+		return 1;
+	}
+
+	if (b->messages == 0) {
+		b->first = hdr;
+	}
+	b->messages++;
+	b->off += (u64)len + 1;
+	b->idle = 0;
+
+	if (!b->scan) {
+		return 0;
+	}
+
+	switch (hdr.code) {
+	case 'P':
+		b->parse = 1;
+		break;
+	case 'B':
+		scan_bind(b, off, len);
+		break;
+	case 'Q':
+		b->query = 1;
+		break;
+	case 'Z': {
+		u8 status = 0;
+		load_body(b, off, len, 0, &status, sizeof(status));
+		if (status == 'I') {
+			b->idle = 1;
+			b->transactions++;
 		}
+		break;
+	}
+	}
+
+	return 0;
+}
+
+// walk walks over the messages of the batch from its offset.
+static __always_inline void walk(struct batch* b) {
+	if (b->off >= b->len) {
+		return;
+	}
+	// a message takes at least a header
+	bpf_loop(b->len / sizeof(struct pgmsghdr) + 1, walk_message, b, 0);
+}
+
+// is_local_query returns whether the batch is a single message user-space
+// answers without a server: a Sync, an empty query or one of local_queries.
+static __always_inline u8 is_local_query(struct batch* b) {
+	if (b->messages != 1 || b->off != b->len) {
+		return 0;
+	}
+
+	u32 len = bpf_ntohl(b->first.len);
+	if (b->first.code == 'S') {
+		return len == 4;
+	}
+	if (b->first.code != 'Q' || len > LOCAL_QUERY_MAX_LENGTH + 4) {
+		return 0;
+	}
+
+	struct local_query lq = {};
+	if (!load_body(b, 0, len, 0, lq.query, sizeof(lq.query))) {
+		return 0;
+	}
+
+	if (lq.query[0] == '\0') {
+		return 1;
+	}
+	return bpf_map_lookup_elem(&local_queries, &lq) != NULL;
+}
+
+static __always_inline void socket_key(struct __sk_buff* skb, struct socket_6_tuple* key) {
+	// The IPv4 addresses are read through volatile loads, or the compiler
+	// merges them with the IPv6 ones through a modified context pointer the
+	// verifier rejects.
+	if (skb->family == AF_INET) {
+		key->local_ip6[2] = bpf_htonl(0x0000ffff);
+		key->local_ip6[3] = *(volatile u32*)&skb->local_ip4;
+		key->remote_ip6[2] = bpf_htonl(0x0000ffff);
+		key->remote_ip6[3] = *(volatile u32*)&skb->remote_ip4;
+	} else {
+		key->local_ip6[0] = skb->local_ip6[0];
+		key->local_ip6[1] = skb->local_ip6[1];
+		key->local_ip6[2] = skb->local_ip6[2];
+		key->local_ip6[3] = skb->local_ip6[3];
+		key->remote_ip6[0] = skb->remote_ip6[0];
+		key->remote_ip6[1] = skb->remote_ip6[1];
+		key->remote_ip6[2] = skb->remote_ip6[2];
+		key->remote_ip6[3] = skb->remote_ip6[3];
+	}
+	key->local_port = skb->local_port;
+	key->remote_port = skb->remote_port;
+}
 
-		struct pgmsghdr* pgh = data + offset;
-		if (unlikely((void*)(pgh + 1) > data_end)) {
+// same_socket compares the tuples field by field, a memcmp of the whole tuple
+// is compiled to a call the BPF target does not provide.
+static __always_inline int same_socket(struct socket_6_tuple* a, struct socket_6_tuple* b) {
+	#pragma unroll
+	for (int i = 0; i < 4; i++) {
+		if (a->local_ip6[i] != b->local_ip6[i] || a->remote_ip6[i] != b->remote_ip6[i]) {
 			return 0;
 		}
+	}
+	return a->local_port == b->local_port && a->remote_port == b->remote_port;
+}
 
-		if (pgh->code == 'Z') {
-			u8* status = (u8*)(pgh + 1);
-			if (unlikely((void*)(status + 1) > data_end)) {
-				return 0;
-			}
-			if (*status == 'I') {
-				return 1;
-			}
-		}
+// emit traces the event of the socket, and of its peer if any.
+static __always_inline void emit(u32 type, u32 reason, struct socket_6_tuple* socket, struct socket_6_tuple* peer) {
+	struct event* e = bpf_ringbuf_reserve(&kpgpool_events, sizeof(*e), 0);
+	if (!e) {
+		return;
+	}
 
-		offset += bpf_ntohl(pgh->len) + 1;
+	e->timestamp_ns = bpf_ktime_get_ns();
+	e->type = type;
+	e->reason = reason;
+	e->socket = *socket;
+	if (peer) {
+		e->peer = *peer;
+	} else {
+		__builtin_memset(&e->peer, 0, sizeof(e->peer));
 	}
+	bpf_ringbuf_submit(e, 0);
+}
 
-	return 0;
+static __always_inline void stat_add(u32 stat, u64 n) {
+	u64* v = bpf_map_lookup_elem(&stats, &stat);
+	if (v) {
+		*v += n;
+	}
 }
 
-SEC("sk_skb/stream_verdict/prog/pool")
-int sk_skb_stream_verdict_prog_pool(struct __sk_buff* skb)
+// pass passes the messages of the socket to user-space for the reason.
+static __always_inline int pass(struct socket_6_tuple* socket, u32 reason, u32 messages) {
+	stat_add(reason, messages);
+	emit(reason == STAT_PASS_UNPREPARED_STATEMENT ? EVENT_PREPARED_MISS : EVENT_PASS, reason, socket, NULL);
+	return SK_PASS;
+}
+
+// pass_client passes the messages of the client to user-space, counting them
+// pending until user-space forwards them.
+static __always_inline int pass_client(struct socket_6_tuple* key, struct client_state* cs, u32 reason, u32 messages) {
+	__sync_fetch_and_add(&cs->pending, messages);
+	return pass(key, reason, messages);
+}
+
+// redirect redirects the messages to the target socket, counting them in the
+// stats of the messages and of the bytes.
+static __always_inline int redirect(struct __sk_buff* skb, struct socket_6_tuple* target, u32 stat_messages, u32 stat_bytes, u32 messages) {
+	int verdict = bpf_sk_redirect_hash(skb, &sockhash, target, 0);
+	if (verdict == SK_PASS) {
+		stat_add(stat_messages, messages);
+		stat_add(stat_bytes, skb->len);
+	}
+	return verdict;
+}
+
+// orphan_server unbinds the server of the leaving client, and leaves it to
+// user-space to reset, since the client may leave in the middle of a
+// transaction. User-space puts it back to the pool once reset.
+static __always_inline void orphan_server(struct socket_6_tuple* key, struct client_state* cs) {
+	if (!cs->valid) {
+		return;
+	}
+	cs->valid = 0;
+
+	struct server_state* ss = bpf_map_lookup_elem(&server_states, &cs->server);
+	if (!ss || !same_socket(&ss->client, key)) {
+		return;
+	}
+	// user-space may unbind the server meanwhile
+	if (!__sync_bool_compare_and_swap(&ss->valid, 1, 0)) {
+		return;
+	}
+
+	struct orphaned_server orphan = {
+		.server = cs->server,
+		.running = ss->last_active_ns < cs->last_active_ns,
+		.pinned = cs->pinned,
+	};
+	ss->queue = SERVER_QUEUE_ORPHANED;
+	bpf_map_push_elem(&orphaned_servers, &orphan, BPF_ANY);
+	emit(EVENT_UNBIND, 0, key, &cs->server);
+}
+
+// sk_skb_stream_parser_prog_pool frames the stream in batches of whole
+// messages, so that the verdict program sees the messages of a batch at once.
+//
+// The programs see the data strparser buffered from its start, whatever was
+// framed of it already, so the whole buffer is framed at once or not at all.
+// The batches of the clients end with their last message whole, strparser
+// waits for the rest of it, and aborts the client once the batch is larger
+// than its receive buffer, which user-space sizes. A message passed to
+// user-space in parts could be held by the kernel until the client sends
+// more. Once POSTGRES_MAX_BATCH_SIZE of a server is buffered, the batch is
+// framed with the last message incomplete instead, and the rest of the message
+// is recorded in partials and framed along with the next batches.
+SEC("sk_skb/stream_parser/prog/pool")
+int sk_skb_stream_parser_prog_pool(struct __sk_buff* skb)
 {
-#ifdef ENABLE_DEBUG
-	bpf_printk("[sk_skb_stream_verdict_prog_pool] %u.%u.%u.%u:%u->%u.%u.%u.%u:%u",
-		FORMAT_IP(skb->local_ip4), skb->local_port,
-		FORMAT_IP(skb->remote_ip4), bpf_ntohl(skb->remote_port));
-	bpf_printk("[sk_skb_stream_verdict_prog_pool] raw %u %u %u %u",
-		skb->local_ip4, skb->local_port,
-		skb->remote_ip4, skb->remote_port);
-#endif
+	struct socket_6_tuple key = {};
+	socket_key(skb, &key);
 
-	struct socket_4_tuple key = {
-		.local_ip4 = skb->local_ip4,
-		.local_port = skb->local_port,
-		.remote_ip4 = skb->remote_ip4,
-		.remote_port = skb->remote_port,
+	struct batch b = {
+		.skb = skb,
+		.len = skb->len,
 	};
+	struct partial* pt = bpf_map_lookup_elem(&partials, &key);
+	if (pt) {
+		b.off = pt->remaining;
+	}
+
+	walk(&b);
+	if (unlikely(b.bad)) {
+		return -EBADMSG;
+	}
+	if (b.off == b.len) {
+		return b.len;
+	}
+	// wait for the rest of the last message header
+	if (b.off < b.len) {
+		return 0;
+	}
+	// and for the rest of the last message
+	if (skb->local_port == pooler_port) {
+		return b.off;
+	}
+	if (b.len < POSTGRES_MAX_BATCH_SIZE) {
+		return 0;
+	}
+	return b.len;
+}
 
-	if (skb->local_port == POOLER_PORT) { // client packet
-		struct client_state* cs = bpf_map_lookup_elem(&client_states, &key);
+// verdict_batch gives the verdict of the messages of the batch. A message
+// continuing from the previous batch, rem bytes of it, follows along.
+static __always_inline int verdict_batch(struct __sk_buff* skb, struct socket_6_tuple* key, struct batch* b, u32 rem) {
+	if (skb->local_port == pooler_port) { // client packet
+		struct client_state* cs = bpf_map_lookup_elem(&client_states, key);
 		if (unlikely(!cs)) {
 			bpf_printk("[sk_skb_stream_verdict_prog_pool] no client state");
-			return SK_PASS;
+			return pass(key, STAT_PASS_NO_CLIENT_STATE, b->messages);
+		}
+		// the server must not end its session, it is orphaned for user-space
+		// to reset. The activity is recorded afterwards, so that a running query
+		// is told apart.
+		if (!rem && b->messages && b->first.code == 'X') {
+			orphan_server(key, cs);
+			return pass(key, STAT_PASS_TERMINATE, 1);
+		}
+
+		cs->last_active_ns = bpf_ktime_get_ns();
+
+		// the messages after ones passed to user-space are passed as well, until
+		// user-space forwarded them
+		if (cs->pending) {
+			return pass_client(key, cs, STAT_PASS_PENDING, b->messages);
+		}
+
+		// the rest of a message follows its start to the server, the messages
+		// after it along. Had the start gone to user-space, it would be pending.
+		if (rem) {
+			if (unlikely(!cs->valid)) {
+				return pass_client(key, cs, STAT_PASS_LARGE_MESSAGE, b->messages);
+			}
+			return redirect(skb, &cs->server, STAT_CLIENT_REDIRECTS, STAT_CLIENT_REDIRECT_BYTES, b->messages);
 		}
 
 		struct server_state* ss;
 
 		if (!cs->valid) {
-			struct socket_4_tuple server;
-			if (unlikely(bpf_map_pop_elem(&servers, &server) != 0)) {
-				bpf_printk("[sk_skb_stream_verdict_prog_pool] no server");
-				return SK_PASS;
+			// local queries are answered by user-space without a server
+			if (!rem && is_local_query(b)) {
+				return pass_client(key, cs, STAT_PASS_LOCAL_QUERY, 1);
 			}
 
-			cs->valid = 1;
-			cs->server = server;
+			// the clients waiting in user-space take the servers first
+			u32 zero = 0;
+			u32* w = bpf_map_lookup_elem(&waiters, &zero);
+			if (w && *w > 0) {
+				return pass_client(key, cs, STAT_PASS_NO_SERVER, b->messages);
+			}
+
+			// the servers closed while in the queue have no state anymore, and
+			// the ones with other parameters are put back for the clients with
+			// theirs. User-space applies the parameters of the client once none
+			// has them.
+			struct socket_6_tuple server;
+			u32 reason = STAT_PASS_NO_SERVER;
+			ss = NULL;
+			for (int tries = 0; tries < SERVER_POP_MAX_TRIES && !ss; ++tries) {
+				if (bpf_map_pop_elem(&servers, &server) != 0) {
+					// wait in user-space for a server to be put back
+					return pass_client(key, cs, reason, b->messages);
+				}
+				stat_add(STAT_SERVER_POPS, 1);
+				ss = bpf_map_lookup_elem(&server_states, &server);
+				if (ss && ss->params != cs->params) {
+					if (bpf_map_push_elem(&servers, &server, BPF_ANY) == 0) {
+						stat_add(STAT_SERVER_PUSHES, 1);
+					}
+					reason = STAT_PASS_PARAMETERS;
+					ss = NULL;
+				}
+			}
+			if (unlikely(!ss)) {
+				return pass_client(key, cs, reason, b->messages);
+			}
 
 	#ifdef ENABLE_DEBUG
-			bpf_printk("[sk_skb_stream_verdict_prog_pool] got server %u.%u.%u.%u:%u->%u.%u.%u.%u:%u",
-				FORMAT_IP(server.local_ip4), server.local_port,
-				FORMAT_IP(server.remote_ip4), bpf_ntohl(server.remote_port));
-			bpf_printk("[sk_skb_stream_verdict_prog_pool] got server (raw) %u %u %u %u",
-				server.local_ip4, server.local_port, server.remote_ip4, server.remote_port);
+			bpf_printk("[sk_skb_stream_verdict_prog_pool] got server, port %u->%u",
+				server.local_port, bpf_ntohl(server.remote_port));
 	#endif
 
-			ss = bpf_map_lookup_elem(&server_states, &server);
-			if (unlikely(!ss)) {
-				bpf_printk("[sk_skb_stream_verdict_prog_pool] no server state");
-				return SK_PASS;
-			}
+			cs->valid = 1;
+			cs->server = server;
 			ss->valid = 1;
-			ss->client = key;
-		} else {
-#ifdef SUPPORT_PREPARED_STATEMENT
-			ss = bpf_map_lookup_elem(&server_states, &cs->server);
-#endif
+			ss->client = *key;
+			ss->queue = SERVER_QUEUE_NONE;
+			emit(EVENT_BIND, 0, key, &server);
 		}
 
 #ifdef SUPPORT_PREPARED_STATEMENT
-		if (is_unprepared_statement(skb, ss)) {
-			return SK_PASS;
+		// Parse must go to user-space, and so must the Binds of the statements
+		// the server does not have.
+		if (b->parse) {
+			return pass_client(key, cs, STAT_PASS_UNPREPARED_STATEMENT, b->messages);
+		}
+		if (b->named_bind) {
+			struct batch binds = {
+				.skb = skb,
+				.server = &cs->server,
+				.off = rem,
+				.len = b->len,
+				.scan = 1,
+			};
+			walk(&binds);
+			if (binds.unprepared) {
+				return pass_client(key, cs, STAT_PASS_UNPREPARED_STATEMENT, b->messages);
+			}
 		}
 #endif // SUPPORT_PREPARED_STATEMENT
 
-		return bpf_sk_redirect_hash(skb, &sockhash, &cs->server, 0);
+		if (tx_mode && !cs->pinned && is_session_statement(b, rem)) {
+			return pass_client(key, cs, STAT_PASS_SESSION_STATEMENT, b->messages);
+		}
+
+		return redirect(skb, &cs->server, STAT_CLIENT_REDIRECTS, STAT_CLIENT_REDIRECT_BYTES, b->messages);
 	}
 
-	if (bpf_ntohl(skb->remote_port) == BACKEND_PORT) { // server packet
-		struct server_state* ss = bpf_map_lookup_elem(&server_states, &key);
+	if (bpf_ntohl(skb->remote_port) == backend_port) { // server packet
+		struct server_state* ss = bpf_map_lookup_elem(&server_states, key);
 		if (unlikely(!ss)) {
 			bpf_printk("[sk_skb_stream_verdict_prog_pool] no server state");
-			return SK_PASS;
+			return pass(key, STAT_PASS_UNBOUND_SERVER, b->messages);
 		}
 		if (unlikely(!ss->valid)) {
 			bpf_printk("[sk_skb_stream_verdict_prog_pool] no valid client binding to the server");
-			return SK_PASS;
+			return pass(key, STAT_PASS_UNBOUND_SERVER, b->messages);
 		}
+		ss->last_active_ns = bpf_ktime_get_ns();
+		ss->idle = b->idle;
 
-#ifdef TX_MODE
-		if (is_ready_for_query_idle(skb)) {
+		stat_add(STAT_TRANSACTIONS, b->transactions);
+
+		// the server is released once the batch ends with a ReadyForQuery outside
+		// of a transaction, the client may pipeline more
+		if (tx_mode && b->idle) {
 #ifdef ENABLE_DEBUG
 			bpf_printk("[sk_skb_stream_verdict_prog_pool] transaction status: idle");
 #endif
 
-			// remove the server->client binding
-			ss->valid = 0;
-
-			// remove the client->server binding
 			struct client_state* cs = bpf_map_lookup_elem(&client_states, &ss->client);
 			if (unlikely(!cs)) {
 				bpf_printk("[sk_skb_stream_verdict_prog_pool] no client state");
-			} else {
-				cs->valid = 0;
 			}
 
-			// put the server back to the pool
-			bpf_map_push_elem(&servers, &key, BPF_ANY);
+			// a pinned client keeps the server for the rest of the session, and a
+			// client with messages pending in user-space or in the middle of one
+			// until the next transaction, for them to reach the server. The server->client
+			// binding is removed unless user-space unbound it meanwhile.
+			if ((!cs || (!cs->pinned && !cs->pending && !bpf_map_lookup_elem(&partials, &ss->client))) &&
+				__sync_bool_compare_and_swap(&ss->valid, 1, 0)) {
+				// remove the client->server binding
+				if (cs) {
+					cs->valid = 0;
+				}
+
+				// put the server back to the pool
+				ss->queue = SERVER_QUEUE_POOL;
+				if (bpf_map_push_elem(&servers, key, BPF_ANY) == 0) {
+					stat_add(STAT_SERVER_PUSHES, 1);
+				}
+				emit(EVENT_UNBIND, 0, &ss->client, key);
+			}
 		}
-#endif // TX_MODE
 
-		return bpf_sk_redirect_hash(skb, &sockhash, &ss->client, 0);
+		return redirect(skb, &ss->client, STAT_SERVER_REDIRECTS, STAT_SERVER_REDIRECT_BYTES, b->messages);
 	}
 
 	bpf_printk("[sk_skb_stream_verdict_prog_pool] non-targetted packet");
 
-	return SK_PASS;
+	return pass(key, STAT_PASS_NON_TARGETED, b->messages);
+}
+
+SEC("sk_skb/stream_verdict/prog/pool")
+int sk_skb_stream_verdict_prog_pool(struct __sk_buff* skb)
+{
+#ifdef ENABLE_DEBUG
+	bpf_printk("[sk_skb_stream_verdict_prog_pool] family %u, port %u->%u",
+		skb->family, skb->local_port, bpf_ntohl(skb->remote_port));
+#endif
+
+	struct socket_6_tuple key = {};
+	socket_key(skb, &key);
+
+	struct batch b = {
+		.skb = skb,
+		.len = skb->len,
+		.scan = 1,
+	};
+	u32 rem = 0;
+	struct partial* pt = bpf_map_lookup_elem(&partials, &key);
+	if (pt) {
+		rem = pt->remaining;
+	}
+	b.off = rem;
+	walk(&b);
+
+	// record the rest of the last message for the next batches
+	if (b.off > b.len) {
+		struct partial next = {
+			.remaining = b.off - b.len,
+		};
+		bpf_map_update_elem(&partials, &key, &next, BPF_ANY);
+	} else if (pt) {
+		bpf_map_delete_elem(&partials, &key);
+	}
+
+	return verdict_batch(skb, &key, &b, rem);
+}
+
+static __always_inline void sock_ops_key(struct bpf_sock_ops* skops, struct socket_6_tuple* key) {
+	// volatile loads, as in socket_key
+	if (skops->family == AF_INET) {
+		key->local_ip6[2] = bpf_htonl(0x0000ffff);
+		key->local_ip6[3] = *(volatile u32*)&skops->local_ip4;
+		key->remote_ip6[2] = bpf_htonl(0x0000ffff);
+		key->remote_ip6[3] = *(volatile u32*)&skops->remote_ip4;
+	} else {
+		key->local_ip6[0] = skops->local_ip6[0];
+		key->local_ip6[1] = skops->local_ip6[1];
+		key->local_ip6[2] = skops->local_ip6[2];
+		key->local_ip6[3] = skops->local_ip6[3];
+		key->remote_ip6[0] = skops->remote_ip6[0];
+		key->remote_ip6[1] = skops->remote_ip6[1];
+		key->remote_ip6[2] = skops->remote_ip6[2];
+		key->remote_ip6[3] = skops->remote_ip6[3];
+	}
+	key->local_port = skops->local_port;
+	key->remote_port = skops->remote_port;
+}
+
+// client_closed removes the state of the closed client, and orphans the server
+// it is still bound to.
+static __always_inline void client_closed(struct socket_6_tuple* key) {
+	struct client_state* cs = bpf_map_lookup_elem(&client_states, key);
+	if (!cs) {
+		return;
+	}
+
+	orphan_server(key, cs);
+	bpf_map_delete_elem(&client_states, key);
+}
+
+// server_closed removes the state of the closed server. The client bound to it
+// is unbound, so that its next message binds another server rather than being
+// redirected to the closed socket. Its prepared statements are left to be
+// evicted.
+static __always_inline void server_closed(struct socket_6_tuple* key) {
+	struct server_state* ss = bpf_map_lookup_elem(&server_states, key);
+	if (!ss) {
+		return;
+	}
+
+	if (ss->valid) {
+		struct client_state* cs = bpf_map_lookup_elem(&client_states, &ss->client);
+		if (cs && cs->valid && same_socket(&cs->server, key)) {
+			cs->valid = 0;
+			emit(EVENT_UNBIND, 0, &ss->client, key);
+		}
+	}
+
+	bpf_map_delete_elem(&server_states, key);
+}
+
+// sockops_prog_pool removes the state of the clients and the servers, and the
+// message they were framing, once their connection is closed. The sockhash removes closed sockets by itself.
+SEC("sockops")
+int sockops_prog_pool(struct bpf_sock_ops* skops)
+{
+	u8 client = skops->local_port == pooler_port;
+	u8 server = bpf_ntohl(skops->remote_port) == backend_port;
+	if (!client && !server) {
+		return 1;
+	}
+
+	switch (skops->op) {
+	case BPF_SOCK_OPS_PASSIVE_ESTABLISHED_CB:
+	case BPF_SOCK_OPS_ACTIVE_ESTABLISHED_CB:
+		// get notified of the state changes of the connection
+		bpf_sock_ops_cb_flags_set(skops, skops->bpf_sock_ops_cb_flags | BPF_SOCK_OPS_STATE_CB_FLAG);
+		break;
+	case BPF_SOCK_OPS_STATE_CB: {
+		if (skops->args[1] != BPF_TCP_CLOSE) {
+			break;
+		}
+
+		struct socket_6_tuple key = {};
+		sock_ops_key(skops, &key);
+		bpf_map_delete_elem(&partials, &key);
+		if (client) {
+			client_closed(&key);
+		} else {
+			server_closed(&key);
+		}
+		break;
+	}
+	}
+
+	return 1;
+}
+
+// syscall_prog_update_state updates the state of a client on behalf of
+// user-space, which runs it through BPF_PROG_RUN. Only the fields that change
+// are written, user-space writing back whole entries would undo the updates of
+// the verdict program in the meantime. It returns 0, or a negative errno if a
+// state is missing. STATE_OP_UNBIND returns the local port of the server the
+// client was unbound from instead, 0 if it was not bound. STATE_OP_QUEUE and
+// STATE_OP_DEQUEUE update the server only.
+SEC("syscall")
+int syscall_prog_update_state(struct state_update* u)
+{
+	if (u->op == STATE_OP_QUEUE || u->op == STATE_OP_DEQUEUE) {
+		struct socket_6_tuple server = u->server;
+		struct server_state* ss = bpf_map_lookup_elem(&server_states, &server);
+		if (!ss) {
+			return -ENOENT;
+		}
+		if (u->op == STATE_OP_DEQUEUE) {
+			ss->queue = SERVER_QUEUE_NONE;
+			return 0;
+		}
+		// the verdict program may pop the server right away
+		ss->params = u->params;
+		ss->queue = SERVER_QUEUE_POOL;
+		return bpf_map_push_elem(&servers, &server, BPF_ANY);
+	}
+
+	struct socket_6_tuple key = u->client;
+	struct client_state* cs = bpf_map_lookup_elem(&client_states, &key);
+	if (!cs) {
+		return -ENOENT;
+	}
+
+	switch (u->op) {
+	case STATE_OP_PIN:
+		cs->pinned = 1;
+		return 0;
+	case STATE_OP_FORWARDED:
+		__sync_fetch_and_sub(&cs->pending, u->forwarded);
+		return 0;
+	case STATE_OP_BIND: {
+		// the server was taken out of the queue by user-space, the verdict
+		// program does not bind it meanwhile
+		struct socket_6_tuple server = u->server;
+		struct server_state* ss = bpf_map_lookup_elem(&server_states, &server);
+		if (!ss) {
+			return -ENOENT;
+		}
+		ss->client = key;
+		ss->params = u->params;
+		ss->valid = 1;
+		cs->server = server;
+		cs->valid = 1;
+		return 0;
+	}
+	case STATE_OP_UNBIND: {
+		if (!cs->valid) {
+			return 0;
+		}
+		struct socket_6_tuple server = cs->server;
+		struct server_state* ss = bpf_map_lookup_elem(&server_states, &server);
+		if (!ss || !same_socket(&ss->client, &key)) {
+			return 0;
+		}
+		// the verdict program may release the server meanwhile
+		if (!__sync_bool_compare_and_swap(&ss->valid, 1, 0)) {
+			return 0;
+		}
+		cs->valid = 0;
+		return server.local_port;
+	}
+	}
+
+	return -EINVAL;
 }
 
 char _license[] SEC("license") = "GPL";
@@ -6,13 +6,15 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/link"
+	"golang.org/x/sys/unix"
 )
 
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O3 -Wall -mcpu=v3" bpf ./bpf.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -type event -type state_update -cflags "-O3 -Wall -mcpu=v3" bpf ./bpf.c
 
 type Program uint8
 
@@ -23,30 +25,133 @@ const (
 
 type DetachFunc func()
 
-func LoadObjects() (*bpfObjects, error) {
+// Config holds the settings of the pool the BPF program is loaded for.
+type Config struct {
+	// PoolerPort is the port the clients connect to.
+	PoolerPort int
+	// BackendPort is the port of the servers.
+	BackendPort int
+	// TxMode releases the server of a client once its transaction completes,
+	// rather than once the client disconnects.
+	TxMode bool
+	// PinPath is the bpffs directory the maps and the programs are pinned to,
+	// so that they outlive the process. The maps pinned by a previous process
+	// are reused. Empty disables pinning.
+	PinPath string
+}
+
+// MaxMessageSize is the size of the largest message of a client the BPF
+// program frames whole. The receive buffer of the client, twice the size set,
+// bounds its batches, which the program walks within the bpf_loop limit.
+const MaxMessageSize = 16 << 20
+
+// PinRoot is the bpffs directory the instances of the pool are pinned under.
+const PinRoot = "/sys/fs/bpf/kpgpool"
+
+// sockopsLinkName is the name the link of the sockops program is pinned as.
+const sockopsLinkName = "sockops_link"
+
+// PinPath returns the directory the instance of the pool is pinned to.
+func PinPath(instance string) string {
+	return filepath.Join(PinRoot, instance)
+}
+
+func LoadObjects(cfg Config) (*bpfObjects, error) {
+	spec, err := loadBpf()
+	if err != nil {
+		return nil, fmt.Errorf("load spec: %w", err)
+	}
+
+	var txMode uint8
+	if cfg.TxMode {
+		txMode = 1
+	}
+	if err := spec.RewriteConstants(map[string]interface{}{
+		"pooler_port":  uint32(cfg.PoolerPort),
+		"backend_port": uint32(cfg.BackendPort),
+		"tx_mode":      txMode,
+	}); err != nil {
+		return nil, fmt.Errorf("rewrite constants: %w", err)
+	}
+
+	// Syscall programs must be sleepable, which their section does not tell.
+	spec.Programs["syscall_prog_update_state"].Flags |= unix.BPF_F_SLEEPABLE
+
+	var opts ebpf.CollectionOptions
+	if cfg.PinPath != "" {
+		if err := os.MkdirAll(cfg.PinPath, 0o700); err != nil {
+			return nil, fmt.Errorf("create pin path: %w", err)
+		}
+		for name, m := range spec.Maps {
+			// The constants are rewritten on every load.
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			m.Pinning = ebpf.PinByName
+		}
+		opts.Maps.PinPath = cfg.PinPath
+	}
+
 	var objs bpfObjects
-	if err := loadBpfObjects(&objs, nil); err != nil {
+	if err := spec.LoadAndAssign(&objs, &opts); err != nil {
+		if cfg.PinPath != "" {
+			return nil, fmt.Errorf("load with maps pinned to %s, remove them if their layout changed: %w", cfg.PinPath, err)
+		}
 		return nil, err
 	}
 
+	if cfg.PinPath != "" {
+		if err := pinPrograms(&objs, cfg.PinPath); err != nil {
+			objs.Close()
+			return nil, err
+		}
+	}
+
 	return &objs, nil
 }
 
-func AttachProgram(objs *bpfObjects, program Program) (DetachFunc, error) {
+// pinPrograms pins the programs to the pin path, replacing the ones pinned by
+// a previous process.
+func pinPrograms(objs *bpfObjects, pinPath string) error {
+	for name, p := range map[string]*ebpf.Program{
+		"sk_skb_stream_parser_prog_pool":  objs.SkSkbStreamParserProgPool,
+		"sk_skb_stream_verdict_prog_pool": objs.SkSkbStreamVerdictProgPool,
+		"sockops_prog_pool":               objs.SockopsProgPool,
+	} {
+		path := filepath.Join(pinPath, name)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("unpin program %s: %w", name, err)
+		}
+		if err := p.Pin(path); err != nil {
+			return fmt.Errorf("pin program %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// AttachProgram attaches the program. Once pinned to pinPath, unless empty,
+// the program stays attached when the process exits, and the DetachFunc only
+// releases the process resources.
+func AttachProgram(objs *bpfObjects, program Program, pinPath string) (DetachFunc, error) {
 	switch program {
 	case ProgramPool:
-		return attachPoolProgram(objs)
+		return attachPoolProgram(objs, pinPath)
 	}
 
 	return nil, fmt.Errorf("unknown program: %d", program)
 }
 
-func attachSockopsProgram(p *ebpf.Program) (DetachFunc, error) {
+func attachSockopsProgram(p *ebpf.Program, pinPath string) (DetachFunc, error) {
 	cgroupPath, err := findCgroupPath()
 	if err != nil {
 		return nil, fmt.Errorf("find cgroup path: %w", err)
 	}
 
+	if pinPath != "" {
+		return attachPinnedSockopsProgram(p, cgroupPath, filepath.Join(pinPath, sockopsLinkName))
+	}
+
 	l, err := link.AttachCgroup(link.CgroupOptions{
 		Path:    cgroupPath,
 		Program: p,
@@ -63,36 +168,79 @@ func attachSockopsProgram(p *ebpf.Program) (DetachFunc, error) {
 	}, nil
 }
 
-func attachPoolProgram(objs *bpfObjects) (DetachFunc, error) {
-	/*
+// attachPinnedSockopsProgram attaches p through the link pinned to path, which
+// keeps it attached once the process exits. The link pinned by a previous
+// process is updated to p.
+func attachPinnedSockopsProgram(p *ebpf.Program, cgroupPath, path string) (DetachFunc, error) {
+	l, err := link.LoadPinnedLink(path, nil)
+	switch {
+	case err == nil:
+		if err := l.Update(p); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("update pinned link: %w", err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		l, err = link.AttachCgroup(link.CgroupOptions{
+			Path:    cgroupPath,
+			Program: p,
+			Attach:  ebpf.AttachCGroupSockOps,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("attach %s to cgroup %s: %w", p.String(), cgroupPath, err)
+		}
+		if err := l.Pin(path); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("pin link: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("load pinned link: %w", err)
+	}
+
+	return func() {
+		if err := l.Close(); err != nil {
+			log.Printf("failed to close sockops link: %v", err)
+		}
+	}, nil
+}
+
+func attachPoolProgram(objs *bpfObjects, pinPath string) (DetachFunc, error) {
+	detachSockops, err := attachSockopsProgram(objs.SockopsProgPool, pinPath)
+	if err != nil {
+		return nil, err
+	}
+
 	if err := link.RawAttachProgram(link.RawAttachProgramOptions{
 		Target:  objs.Sockhash.FD(),
 		Program: objs.SkSkbStreamParserProgPool,
 		Attach:  ebpf.AttachSkSKBStreamParser,
 	}); err != nil {
+		detachSockops()
 		return nil, err
 	}
-	*/
 	if err := link.RawAttachProgram(link.RawAttachProgramOptions{
 		Target:  objs.Sockhash.FD(),
 		Program: objs.SkSkbStreamVerdictProgPool,
 		Attach:  ebpf.AttachSkSKBStreamVerdict,
 	}); err != nil {
+		detachSockops()
 		return nil, err
 	}
 
 	return func() {
-		/*
+		defer detachSockops()
+		// The programs stay attached to the pinned sockhash for the next process.
+		if pinPath != "" {
+			return
+		}
 		defer func() {
 			if err := link.RawDetachProgram(link.RawDetachProgramOptions{
 				Target:  objs.Sockhash.FD(),
 				Program: objs.SkSkbStreamParserProgPool,
 				Attach:  ebpf.AttachSkSKBStreamParser,
 			}); err != nil {
-				log.Printf("failed to detach sk_skb stream verdict program: %v", err)
+				log.Printf("failed to detach sk_skb stream parser program: %v", err)
 			}
 		}()
-		*/
 		defer func() {
 			if err := link.RawDetachProgram(link.RawDetachProgramOptions{
 				Target:  objs.Sockhash.FD(),
@@ -105,6 +253,12 @@ func attachPoolProgram(objs *bpfObjects) (DetachFunc, error) {
 	}, nil
 }
 
+// CgroupPath returns the mount point of cgroup2, whose root the sockops
+// program is attached to.
+func CgroupPath() (string, error) {
+	return findCgroupPath()
+}
+
 // findCgroupPath returns the first-found mount point of type cgroup2
 // and stores it in the cgroupPath global variable.
 func findCgroupPath() (string, error) {
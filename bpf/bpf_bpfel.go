@@ -13,25 +13,66 @@ import (
 )
 
 type bpfClientState struct {
-	Valid  uint8
-	_      [3]byte
-	Server bpfSocket4Tuple
+	Valid        uint8
+	Pinned       uint8
+	_            [2]byte
+	Pending      uint32
+	Params       uint32
+	Server       bpfSocket6Tuple
+	_            [4]byte
+	LastActiveNs uint64
+}
+
+type bpfEvent struct {
+	TimestampNs uint64
+	Type        uint32
+	Reason      uint32
+	Socket      bpfSocket6Tuple
+	Peer        bpfSocket6Tuple
+}
+
+type bpfLocalQuery struct{ Query [32]uint8 }
+
+type bpfOrphanedServer struct {
+	Server  bpfSocket6Tuple
+	Running uint8
+	Pinned  uint8
+	_       [2]byte
+}
+
+type bpfPartial struct{ Remaining uint32 }
+
+type bpfPreparedKey struct {
+	Server bpfSocket6Tuple
+	Name   [64]uint8
 }
 
 type bpfServerState struct {
-	Valid    uint8
-	_        [3]byte
-	Client   bpfSocket4Tuple
-	Prepared [256][64]uint8
+	Valid        uint32
+	Client       bpfSocket6Tuple
+	_            [4]byte
+	LastActiveNs uint64
+	Queue        uint8
+	Idle         uint8
+	_            [2]byte
+	Params       uint32
 }
 
-type bpfSocket4Tuple struct {
-	LocalIp4   uint32
+type bpfSocket6Tuple struct {
+	LocalIp6   [4]uint32
 	LocalPort  uint32
-	RemoteIp4  uint32
+	RemoteIp6  [4]uint32
 	RemotePort uint32
 }
 
+type bpfStateUpdate struct {
+	Op        uint32
+	Client    bpfSocket6Tuple
+	Server    bpfSocket6Tuple
+	Forwarded uint32
+	Params    uint32
+}
+
 // loadBpf returns the embedded CollectionSpec for bpf.
 func loadBpf() (*ebpf.CollectionSpec, error) {
 	reader := bytes.NewReader(_BpfBytes)
@@ -73,17 +114,27 @@ type bpfSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfProgramSpecs struct {
+	SkSkbStreamParserProgPool  *ebpf.ProgramSpec `ebpf:"sk_skb_stream_parser_prog_pool"`
 	SkSkbStreamVerdictProgPool *ebpf.ProgramSpec `ebpf:"sk_skb_stream_verdict_prog_pool"`
+	SockopsProgPool            *ebpf.ProgramSpec `ebpf:"sockops_prog_pool"`
+	SyscallProgUpdateState     *ebpf.ProgramSpec `ebpf:"syscall_prog_update_state"`
 }
 
 // bpfMapSpecs contains maps before they are loaded into the kernel.
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfMapSpecs struct {
-	ClientStates *ebpf.MapSpec `ebpf:"client_states"`
-	ServerStates *ebpf.MapSpec `ebpf:"server_states"`
-	Servers      *ebpf.MapSpec `ebpf:"servers"`
-	Sockhash     *ebpf.MapSpec `ebpf:"sockhash"`
+	ClientStates    *ebpf.MapSpec `ebpf:"client_states"`
+	KpgpoolEvents   *ebpf.MapSpec `ebpf:"kpgpool_events"`
+	LocalQueries    *ebpf.MapSpec `ebpf:"local_queries"`
+	OrphanedServers *ebpf.MapSpec `ebpf:"orphaned_servers"`
+	Partials        *ebpf.MapSpec `ebpf:"partials"`
+	Prepared        *ebpf.MapSpec `ebpf:"prepared"`
+	ServerStates    *ebpf.MapSpec `ebpf:"server_states"`
+	Servers         *ebpf.MapSpec `ebpf:"servers"`
+	Sockhash        *ebpf.MapSpec `ebpf:"sockhash"`
+	Stats           *ebpf.MapSpec `ebpf:"stats"`
+	Waiters         *ebpf.MapSpec `ebpf:"waiters"`
 }
 
 // bpfObjects contains all objects after they have been loaded into the kernel.
@@ -105,18 +156,32 @@ func (o *bpfObjects) Close() error {
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfMaps struct {
-	ClientStates *ebpf.Map `ebpf:"client_states"`
-	ServerStates *ebpf.Map `ebpf:"server_states"`
-	Servers      *ebpf.Map `ebpf:"servers"`
-	Sockhash     *ebpf.Map `ebpf:"sockhash"`
+	ClientStates    *ebpf.Map `ebpf:"client_states"`
+	KpgpoolEvents   *ebpf.Map `ebpf:"kpgpool_events"`
+	LocalQueries    *ebpf.Map `ebpf:"local_queries"`
+	OrphanedServers *ebpf.Map `ebpf:"orphaned_servers"`
+	Partials        *ebpf.Map `ebpf:"partials"`
+	Prepared        *ebpf.Map `ebpf:"prepared"`
+	ServerStates    *ebpf.Map `ebpf:"server_states"`
+	Servers         *ebpf.Map `ebpf:"servers"`
+	Sockhash        *ebpf.Map `ebpf:"sockhash"`
+	Stats           *ebpf.Map `ebpf:"stats"`
+	Waiters         *ebpf.Map `ebpf:"waiters"`
 }
 
 func (m *bpfMaps) Close() error {
 	return _BpfClose(
 		m.ClientStates,
+		m.KpgpoolEvents,
+		m.LocalQueries,
+		m.OrphanedServers,
+		m.Partials,
+		m.Prepared,
 		m.ServerStates,
 		m.Servers,
 		m.Sockhash,
+		m.Stats,
+		m.Waiters,
 	)
 }
 
@@ -124,12 +189,18 @@ func (m *bpfMaps) Close() error {
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfPrograms struct {
+	SkSkbStreamParserProgPool  *ebpf.Program `ebpf:"sk_skb_stream_parser_prog_pool"`
 	SkSkbStreamVerdictProgPool *ebpf.Program `ebpf:"sk_skb_stream_verdict_prog_pool"`
+	SockopsProgPool            *ebpf.Program `ebpf:"sockops_prog_pool"`
+	SyscallProgUpdateState     *ebpf.Program `ebpf:"syscall_prog_update_state"`
 }
 
 func (p *bpfPrograms) Close() error {
 	return _BpfClose(
+		p.SkSkbStreamParserProgPool,
 		p.SkSkbStreamVerdictProgPool,
+		p.SockopsProgPool,
+		p.SyscallProgUpdateState,
 	)
 }
 
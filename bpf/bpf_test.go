@@ -0,0 +1,142 @@
+package bpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/btf"
+)
+
+// TestSpecSizes checks that the Go types the maps are read and written with
+// have the sizes of the C types the embedded objects were built with, which
+// bindings generated from another bpf.c would not.
+func TestSpecSizes(t *testing.T) {
+	spec, err := loadBpf()
+	if err != nil {
+		t.Fatalf("load spec: %v", err)
+	}
+
+	maps := []struct {
+		name  string
+		key   interface{}
+		value interface{}
+	}{
+		{"client_states", bpfSocket6Tuple{}, bpfClientState{}},
+		{"server_states", bpfSocket6Tuple{}, bpfServerState{}},
+		{"servers", nil, bpfSocket6Tuple{}},
+		{"orphaned_servers", nil, bpfOrphanedServer{}},
+		{"partials", bpfSocket6Tuple{}, bpfPartial{}},
+		{"local_queries", bpfLocalQuery{}, uint8(0)},
+		{"prepared", bpfPreparedKey{}, uint8(0)},
+		{"sockhash", bpfSocket6Tuple{}, uint32(0)},
+		{"waiters", uint32(0), uint32(0)},
+		{"stats", uint32(0), uint64(0)},
+	}
+	for _, tt := range maps {
+		m, ok := spec.Maps[tt.name]
+		if !ok {
+			t.Errorf("map %s not found", tt.name)
+			continue
+		}
+		if tt.key != nil {
+			if want := binary.Size(tt.key); int(m.KeySize) != want {
+				t.Errorf("map %s: key size = %d, want %d (%T)", tt.name, m.KeySize, want, tt.key)
+			}
+		}
+		if want := binary.Size(tt.value); int(m.ValueSize) != want {
+			t.Errorf("map %s: value size = %d, want %d (%T)", tt.name, m.ValueSize, want, tt.value)
+		}
+	}
+
+	// The events and the state updates are not map values.
+	types := []struct {
+		name  string
+		value interface{}
+	}{
+		{"event", bpfEvent{}},
+		{"state_update", bpfStateUpdate{}},
+	}
+	for _, tt := range types {
+		var typ *btf.Struct
+		if err := spec.Types.TypeByName(tt.name, &typ); err != nil {
+			t.Errorf("type %s: %v", tt.name, err)
+			continue
+		}
+		if want := binary.Size(tt.value); int(typ.Size) != want {
+			t.Errorf("type %s: size = %d, want %d (%T)", tt.name, typ.Size, want, tt.value)
+		}
+	}
+}
+
+// TestSpecStateLayouts checks that the fields of the client and server states,
+// which user space reads one by one, are at the offsets of the bindings.
+func TestSpecStateLayouts(t *testing.T) {
+	spec, err := loadBpf()
+	if err != nil {
+		t.Fatalf("load spec: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{"client_state", bpfClientState{}},
+		{"server_state", bpfServerState{}},
+	}
+	for _, tt := range tests {
+		var typ *btf.Struct
+		if err := spec.Types.TypeByName(tt.name, &typ); err != nil {
+			t.Errorf("type %s: %v", tt.name, err)
+			continue
+		}
+
+		goType := reflect.TypeOf(tt.value)
+		for _, m := range typ.Members {
+			f, ok := goType.FieldByName(goFieldName(m.Name))
+			if !ok {
+				t.Errorf("type %s: member %s not in %T", tt.name, m.Name, tt.value)
+				continue
+			}
+			if want := m.Offset.Bytes(); uint32(f.Offset) != want {
+				t.Errorf("type %s: member %s at offset %d, want %d", tt.name, m.Name, f.Offset, want)
+			}
+		}
+	}
+}
+
+// goFieldName returns the name bpf2go gives the field of the C member.
+func goFieldName(member string) string {
+	parts := strings.Split(member, "_")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// TestLoadObjects checks that the verifier accepts the embedded programs, in
+// both modes, where the kernel and the privileges allow loading them.
+func TestLoadObjects(t *testing.T) {
+	if err := Missing(Probe()); err != nil {
+		t.Skipf("BPF proxy unavailable: %v", err)
+	}
+
+	for _, txMode := range []bool{false, true} {
+		objs, err := LoadObjects(Config{PoolerPort: 6432, BackendPort: 5432, TxMode: txMode})
+		if err != nil {
+			var verr *ebpf.VerifierError
+			if errors.As(err, &verr) {
+				t.Errorf("load objects, tx mode %v: %+v", txMode, verr)
+			} else {
+				t.Errorf("load objects, tx mode %v: %v", txMode, err)
+			}
+			continue
+		}
+		objs.Close()
+	}
+}
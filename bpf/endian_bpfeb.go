@@ -0,0 +1,9 @@
+//go:build arm64be || armbe || mips || mips64 || mips64p32 || ppc64 || s390 || s390x || sparc || sparc64
+
+package bpf
+
+import "encoding/binary"
+
+// hostEndian is the byte order of the host, in which the BPF program lays out
+// the words of the map keys and of the events.
+var hostEndian binary.ByteOrder = binary.BigEndian
@@ -0,0 +1,9 @@
+//go:build 386 || amd64 || amd64p32 || arm || arm64 || loong64 || mips64le || mips64p32le || mipsle || ppc64le || riscv64
+
+package bpf
+
+import "encoding/binary"
+
+// hostEndian is the byte order of the host, in which the BPF program lays out
+// the words of the map keys and of the events.
+var hostEndian binary.ByteOrder = binary.LittleEndian
@@ -0,0 +1,298 @@
+package bpf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/cilium/ebpf"
+)
+
+// ClientEntry is the state of a client in the maps of the BPF program.
+type ClientEntry struct {
+	Socket *Socket `json:"socket"`
+	// Server is the server the client is bound to, if any.
+	Server *Socket `json:"server,omitempty"`
+	Pinned bool    `json:"pinned"`
+	// Pending is the number of messages passed to user space and not forwarded
+	// to the server yet.
+	Pending    uint32    `json:"pending"`
+	LastActive time.Time `json:"lastActive"`
+	// Bound tells the server is bound back to the client.
+	Bound bool `json:"bound"`
+	// Leak tells why the entry is left over, if it is.
+	Leak string `json:"leak,omitempty"`
+}
+
+// ServerEntry is the state of a server in the maps of the BPF program.
+type ServerEntry struct {
+	Socket *Socket `json:"socket"`
+	// Client is the client the server is bound to, if any.
+	Client     *Socket   `json:"client,omitempty"`
+	Prepared   []string  `json:"prepared,omitempty"`
+	LastActive time.Time `json:"lastActive"`
+	// Bound tells the client is bound back to the server.
+	Bound bool `json:"bound"`
+	// Queue is the queue the unbound server is in, pool or orphaned, or empty
+	// while the server is held by user space.
+	Queue string `json:"queue,omitempty"`
+	// Leak tells why the entry is left over, if it is.
+	Leak string `json:"leak,omitempty"`
+}
+
+// SockhashEntry is a socket the BPF program redirects messages from and to.
+type SockhashEntry struct {
+	Socket *Socket `json:"socket"`
+	// Kind is client or server, as told by the state of the socket.
+	Kind string `json:"kind,omitempty"`
+	Leak string `json:"leak,omitempty"`
+}
+
+// Snapshot is the state of the maps of the BPF program of a running pool. The
+// maps are read one after the other while the program updates them, so a
+// binding or an unbinding in progress may show as a leak.
+type Snapshot struct {
+	Clients []*ClientEntry `json:"clients"`
+	Servers []*ServerEntry `json:"servers"`
+	// QueuedServers is the number of unbound servers queued in the pool.
+	QueuedServers int `json:"queuedServers"`
+	// OrphanedServers is the number of servers of closed clients queued for
+	// user space to reclaim.
+	OrphanedServers int `json:"orphanedServers"`
+	// HeldServers is the number of unbound servers held by user space, such as
+	// the ones being set up, reset or replayed to.
+	HeldServers int              `json:"heldServers"`
+	Waiters     uint32           `json:"waiters"`
+	Sockhash    []*SockhashEntry `json:"sockhash"`
+	// LeakedPrepared is the number of prepared statements of servers without
+	// a state.
+	LeakedPrepared int `json:"leakedPrepared"`
+}
+
+// Leaks returns the number of left over entries.
+func (s *Snapshot) Leaks() int {
+	n := s.LeakedPrepared
+	for _, c := range s.Clients {
+		if c.Leak != "" {
+			n++
+		}
+	}
+	for _, sv := range s.Servers {
+		if sv.Leak != "" {
+			n++
+		}
+	}
+	for _, e := range s.Sockhash {
+		if e.Leak != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// inspectedMaps are the maps read by Inspect.
+type inspectedMaps struct {
+	clientStates *ebpf.Map
+	serverStates *ebpf.Map
+	sockhash     *ebpf.Map
+	prepared     *ebpf.Map
+	waiters      *ebpf.Map
+}
+
+func (m *inspectedMaps) close() {
+	for _, mp := range []*ebpf.Map{m.clientStates, m.serverStates, m.sockhash, m.prepared, m.waiters} {
+		if mp != nil {
+			mp.Close()
+		}
+	}
+}
+
+// Inspect reads the maps of the BPF program of a running pool, those pinned
+// under pinPath, or else the first ones found loaded.
+func Inspect(pinPath string) (*Snapshot, error) {
+	var maps inspectedMaps
+	defer maps.close()
+
+	for _, m := range []struct {
+		name string
+		typ  ebpf.MapType
+		dst  **ebpf.Map
+	}{
+		{"client_states", ebpf.Hash, &maps.clientStates},
+		{"server_states", ebpf.Hash, &maps.serverStates},
+		{"sockhash", ebpf.SockHash, &maps.sockhash},
+		{"prepared", ebpf.LRUHash, &maps.prepared},
+		{"waiters", ebpf.Array, &maps.waiters},
+	} {
+		var err error
+		if pinPath != "" {
+			*m.dst, err = ebpf.LoadPinnedMap(filepath.Join(pinPath, m.name), nil)
+		} else {
+			*m.dst, err = findMap(m.name, m.typ)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("open map %s: %w", m.name, err)
+		}
+	}
+
+	return maps.snapshot()
+}
+
+func (m *inspectedMaps) snapshot() (*Snapshot, error) {
+	var (
+		key  bpfSocket6Tuple
+		cs   bpfClientState
+		ss   bpfServerState
+		pkey bpfPreparedKey
+		v    uint8
+	)
+
+	clients := make(map[bpfSocket6Tuple]bpfClientState)
+	iter := m.clientStates.Iterate()
+	for iter.Next(&key, &cs) {
+		clients[key] = cs
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterate client states: %w", err)
+	}
+
+	servers := make(map[bpfSocket6Tuple]bpfServerState)
+	iter = m.serverStates.Iterate()
+	for iter.Next(&key, &ss) {
+		servers[key] = ss
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterate server states: %w", err)
+	}
+
+	// The sockets cannot be looked up from user space, only their keys are
+	// listed.
+	sockets := make(map[bpfSocket6Tuple]bool)
+	var next interface{}
+	for {
+		if err := m.sockhash.NextKey(next, &key); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				break
+			}
+			return nil, fmt.Errorf("iterate sockhash: %w", err)
+		}
+		sockets[key] = true
+		k := key
+		next = &k
+	}
+
+	snap := &Snapshot{}
+
+	prepared := make(map[bpfSocket6Tuple][]string)
+	iter = m.prepared.Iterate()
+	for iter.Next(&pkey, &v) {
+		if _, ok := servers[pkey.Server]; !ok {
+			snap.LeakedPrepared++
+			continue
+		}
+		name := pkey.Name[:]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		prepared[pkey.Server] = append(prepared[pkey.Server], string(name))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterate prepared statements: %w", err)
+	}
+
+	if err := m.waiters.Lookup(uint32(0), &snap.Waiters); err != nil {
+		return nil, fmt.Errorf("lookup waiters: %w", err)
+	}
+
+	for key, cs := range clients {
+		key := key
+		e := &ClientEntry{
+			Socket:     socketOf(&key),
+			Pinned:     cs.Pinned != 0,
+			Pending:    cs.Pending,
+			LastActive: monotonicTime(cs.LastActiveNs),
+		}
+		if cs.Valid != 0 {
+			e.Server = socketOf(&cs.Server)
+			ss, ok := servers[cs.Server]
+			e.Bound = ok && ss.Valid != 0 && ss.Client == key
+			switch {
+			case !ok:
+				e.Leak = "bound to a server without state"
+			case !e.Bound:
+				e.Leak = "bound to a server bound elsewhere"
+			}
+		}
+		if !sockets[key] {
+			e.Leak = "socket not in sockhash"
+		}
+		snap.Clients = append(snap.Clients, e)
+	}
+
+	for key, ss := range servers {
+		key := key
+		e := &ServerEntry{
+			Socket:     socketOf(&key),
+			Prepared:   prepared[key],
+			LastActive: monotonicTime(ss.LastActiveNs),
+		}
+		sort.Strings(e.Prepared)
+		if ss.Valid != 0 {
+			e.Client = socketOf(&ss.Client)
+			cs, ok := clients[ss.Client]
+			e.Bound = ok && cs.Valid != 0 && cs.Server == key
+			switch {
+			case !ok:
+				e.Leak = "bound to a client without state"
+			case !e.Bound:
+				e.Leak = "bound to a client bound elsewhere"
+			}
+		} else {
+			switch ss.Queue {
+			case serverQueuePool:
+				e.Queue = "pool"
+				snap.QueuedServers++
+			case serverQueueOrphaned:
+				e.Queue = "orphaned"
+				snap.OrphanedServers++
+			default:
+				snap.HeldServers++
+			}
+		}
+		if !sockets[key] {
+			e.Leak = "socket not in sockhash"
+		}
+		snap.Servers = append(snap.Servers, e)
+	}
+
+	for key := range sockets {
+		key := key
+		e := &SockhashEntry{Socket: socketOf(&key)}
+		if _, ok := clients[key]; ok {
+			e.Kind = "client"
+		} else if _, ok := servers[key]; ok {
+			e.Kind = "server"
+		} else {
+			e.Leak = "no client or server state"
+		}
+		snap.Sockhash = append(snap.Sockhash, e)
+	}
+
+	sort.Slice(snap.Clients, func(i, j int) bool { return snap.Clients[i].Socket.String() < snap.Clients[j].Socket.String() })
+	sort.Slice(snap.Servers, func(i, j int) bool { return snap.Servers[i].Socket.String() < snap.Servers[j].Socket.String() })
+	sort.Slice(snap.Sockhash, func(i, j int) bool { return snap.Sockhash[i].Socket.String() < snap.Sockhash[j].Socket.String() })
+
+	return snap, nil
+}
+
+// monotonicTime returns the time of a timestamp of the monotonic clock, as the
+// BPF program stamps activity with, or the zero time for no timestamp.
+func monotonicTime(ns uint64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-time.Duration(monotonicNow() - ns))
+}
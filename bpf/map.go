@@ -2,16 +2,23 @@ package bpf
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"hash/fnv"
+	"log"
 	"net"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
 )
 
 /*
-	struct socket_4_tuple {
-		u32 local_ip4;		// network byte order
+	struct socket_6_tuple {
+		u32 local_ip6[4];	// network byte order
 		u32 local_port;		// host byte order
-		u32 remote_ip4;		// network byte order
+		u32 remote_ip6[4];	// network byte order
 		u32 remote_port;	// network byte order
 	};
 */
@@ -20,20 +27,28 @@ type MapDAO struct {
 	Objs *bpfObjects
 }
 
-func (dao *MapDAO) RegisterServer(conn net.Conn) error {
-	val := dao.toBPFSock4Tuple(conn)
-	// log.Printf("[RegisterServer] %d %d %d %d", val.LocalIp4, val.LocalPort, val.RemoteIp4, val.RemotePort)
-	return dao.Objs.Servers.Put(nil, val)
+// RegisterServer puts the server back to the queue the BPF program binds
+// clients from. params identifies the parameters applied to the server, the
+// BPF program binds it the clients with the same parameters only.
+func (dao *MapDAO) RegisterServer(conn net.Conn, params uint32) error {
+	if _, err := dao.updateState(bpfStateUpdate{
+		Op:     stateOpQueue,
+		Server: *dao.toBPFSock6Tuple(conn),
+		Params: params,
+	}); err != nil {
+		return fmt.Errorf("register server: %w", err)
+	}
+	return nil
 }
 
 func (dao *MapDAO) SetupServerState(conn net.Conn) error {
-	key := dao.toBPFSock4Tuple(conn)
+	key := dao.toBPFSock6Tuple(conn)
 	var state bpfServerState
 	return dao.Objs.ServerStates.Put(key, state)
 }
 
 func (dao *MapDAO) GetClientState(conn net.Conn) (*bpfClientState, error) {
-	key := dao.toBPFSock4Tuple(conn)
+	key := dao.toBPFSock6Tuple(conn)
 	var cs bpfClientState
 	if err := dao.Objs.ClientStates.Lookup(key, &cs); err != nil {
 		return nil, err
@@ -41,34 +56,673 @@ func (dao *MapDAO) GetClientState(conn net.Conn) (*bpfClientState, error) {
 	return &cs, nil
 }
 
-func (dao *MapDAO) UpdateServerStatePrepared(conn net.Conn, name []byte) error {
-	key := dao.toBPFSock4Tuple(conn)
+func (dao *MapDAO) PinClient(conn net.Conn) error {
+	if _, err := dao.updateState(bpfStateUpdate{
+		Op:     stateOpPin,
+		Client: *dao.toBPFSock6Tuple(conn),
+	}); err != nil {
+		return fmt.Errorf("pin client: %w", err)
+	}
+	return nil
+}
+
+// ClientActivity is the activity of a client recorded by the BPF program.
+type ClientActivity struct {
+	// Bound indicates whether the client is bound to a server.
+	Bound bool
+	// Pinned indicates whether the client keeps its server between
+	// transactions.
+	Pinned bool
+	// ClientIdle is the time since the client last sent data.
+	ClientIdle time.Duration
+	// ServerIdle is the time since the bound server last sent data.
+	ServerIdle time.Duration
+	// ServerPort is the local port of the bound server.
+	ServerPort int
+	// Pending is the number of messages of the client passed to user space
+	// and not forwarded yet.
+	Pending int
+	// TxIdle indicates whether the bound server last reported that it is
+	// outside of a transaction.
+	TxIdle bool
+}
+
+func (dao *MapDAO) GetClientActivity(conn net.Conn) (*ClientActivity, error) {
+	cs, err := dao.GetClientState(conn)
+	if err != nil {
+		return nil, fmt.Errorf("lookup client state: %w", err)
+	}
+
+	now := monotonicNow()
+	act := &ClientActivity{
+		Bound:      cs.Valid != 0,
+		Pinned:     cs.Pinned != 0,
+		ClientIdle: time.Duration(now - cs.LastActiveNs),
+		Pending:    int(cs.Pending),
+	}
+	if !act.Bound {
+		return act, nil
+	}
+
 	var ss bpfServerState
-	if err := dao.Objs.ServerStates.Lookup(key, &ss); err != nil {
-		return fmt.Errorf("lookup server state: %w", err)
+	if err := dao.Objs.ServerStates.Lookup(&cs.Server, &ss); err != nil {
+		return nil, fmt.Errorf("lookup server state: %w", err)
+	}
+	act.ServerPort = int(cs.Server.LocalPort)
+	act.TxIdle = ss.Idle != 0
+	act.ServerIdle = time.Duration(now - ss.LastActiveNs)
+	if ss.LastActiveNs < cs.LastActiveNs {
+		// The server has not answered the client yet.
+		act.ServerIdle = act.ClientIdle + 1
+	}
+
+	return act, nil
+}
+
+// UnbindClient removes the binding between the client and its server, so that
+// the BPF program passes the messages of the server to user space. It returns
+// the local port of the server, and whether the client was bound.
+func (dao *MapDAO) UnbindClient(conn net.Conn) (int, bool, error) {
+	port, err := dao.updateState(bpfStateUpdate{
+		Op:     stateOpUnbind,
+		Client: *dao.toBPFSock6Tuple(conn),
+	})
+	if err != nil {
+		return 0, false, fmt.Errorf("unbind client: %w", err)
+	}
+	// The BPF program may have released the server meanwhile.
+	return int(port), port != 0, nil
+}
+
+// PopServer takes a server out of the queue the BPF program binds clients
+// from, and returns its local port, and whether there was one.
+func (dao *MapDAO) PopServer() (int, bool, error) {
+	var (
+		sock bpfSocket6Tuple
+		ss   bpfServerState
+	)
+	for {
+		if err := dao.Objs.Servers.LookupAndDelete(nil, &sock); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				return 0, false, nil
+			}
+			return 0, false, fmt.Errorf("pop server: %w", err)
+		}
+
+		if err := dao.Objs.ServerStates.Lookup(&sock, &ss); err != nil {
+			// The server was closed while in the queue.
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				continue
+			}
+			return 0, false, fmt.Errorf("lookup server state: %w", err)
+		}
+		if err := dao.dequeueServer(&sock); err != nil {
+			return 0, false, err
+		}
+		return int(sock.LocalPort), true, nil
+	}
+}
+
+// RequeueServer puts the server popped by its local port back to the queue,
+// with the parameters it has. A server closed meanwhile is left out.
+func (dao *MapDAO) RequeueServer(port int) error {
+	var (
+		key bpfSocket6Tuple
+		ss  bpfServerState
+	)
+	iter := dao.Objs.ServerStates.Iterate()
+	for iter.Next(&key, &ss) {
+		if int(key.LocalPort) != port {
+			continue
+		}
+		if _, err := dao.updateState(bpfStateUpdate{Op: stateOpQueue, Server: key, Params: ss.Params}); err != nil && !errors.Is(err, unix.ENOENT) {
+			return fmt.Errorf("requeue server: %w", err)
+		}
+		return nil
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("iterate server states: %w", err)
+	}
+	return nil
+}
+
+// BindClient binds the waiting client to the server taken out of the queue,
+// params identifies the parameters applied to the server. The BPF program
+// keeps passing the messages of the client to user space until they are
+// forwarded, and redirects the messages of the server to the client.
+func (dao *MapDAO) BindClient(conn net.Conn, server net.Conn, params uint32) error {
+	if _, err := dao.updateState(bpfStateUpdate{
+		Op:     stateOpBind,
+		Client: *dao.toBPFSock6Tuple(conn),
+		Server: *dao.toBPFSock6Tuple(server),
+		Params: params,
+	}); err != nil {
+		return fmt.Errorf("bind client: %w", err)
+	}
+	return nil
+}
+
+// ForwardedMessages tells the BPF program that user space forwarded n of the
+// messages of the client it passed, to the server or answered them. Once none
+// is pending, it redirects the next messages of the client again.
+func (dao *MapDAO) ForwardedMessages(conn net.Conn, n int) error {
+	if _, err := dao.updateState(bpfStateUpdate{
+		Op:        stateOpForwarded,
+		Client:    *dao.toBPFSock6Tuple(conn),
+		Forwarded: uint32(n),
+	}); err != nil {
+		return fmt.Errorf("forwarded messages: %w", err)
+	}
+	return nil
+}
+
+// stateOp mirrors the state_op enum of the BPF program.
+const (
+	stateOpPin uint32 = iota + 1
+	stateOpBind
+	stateOpForwarded
+	stateOpUnbind
+	stateOpQueue
+	stateOpDequeue
+)
+
+// serverQueue mirrors the server_queue enum of the BPF program.
+const (
+	serverQueueNone uint8 = iota
+	serverQueuePool
+	serverQueueOrphaned
+)
+
+// dequeueServer records that user space took the server out of its queue. The
+// server may have been closed meanwhile.
+func (dao *MapDAO) dequeueServer(sock *bpfSocket6Tuple) error {
+	if _, err := dao.updateState(bpfStateUpdate{
+		Op:     stateOpDequeue,
+		Server: *sock,
+	}); err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("dequeue server: %w", err)
+	}
+	return nil
+}
+
+// updateState runs the update of the state of a client in the kernel, which
+// writes only the fields that change, while the BPF program updates the others
+// concurrently. It returns the result of the update.
+func (dao *MapDAO) updateState(u bpfStateUpdate) (uint32, error) {
+	ret, err := runSyscallProgram(dao.Objs.SyscallProgUpdateState, unsafe.Pointer(&u), unsafe.Sizeof(u))
+	if err != nil {
+		return 0, fmt.Errorf("run update: %w", err)
+	}
+	if errno := int32(ret); errno < 0 {
+		return 0, fmt.Errorf("update state: %w", unix.Errno(-errno))
+	}
+	return ret, nil
+}
+
+// progRunAttr is the part of union bpf_attr used by BPF_PROG_TEST_RUN. The
+// context is held as a pointer, so that it is kept track of if the stack
+// moves, and padded to the 64 bits of the kernel field.
+type progRunAttr struct {
+	progFd      uint32
+	retval      uint32
+	dataSizeIn  uint32
+	dataSizeOut uint32
+	dataIn      uint64
+	dataOut     uint64
+	repeat      uint32
+	duration    uint32
+	ctxSizeIn   uint32
+	ctxSizeOut  uint32
+	ctxIn       unsafe.Pointer
+	_           [8 - unsafe.Sizeof(uintptr(0))]byte
+	ctxOut      uint64
+	flags       uint32
+	cpu         uint32
+	batchSize   uint32
+	_           uint32
+}
+
+// runSyscallProgram runs the syscall program with the context at ctx, and
+// returns its return value. The program is run through the bpf syscall, since
+// ebpf.Program.Run sets a repeat count the kernel rejects for syscall
+// programs.
+func runSyscallProgram(prog *ebpf.Program, ctx unsafe.Pointer, size uintptr) (uint32, error) {
+	attr := progRunAttr{
+		progFd:    uint32(prog.FD()),
+		ctxSizeIn: uint32(size),
+		ctxIn:     ctx,
+	}
+	_, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_PROG_TEST_RUN, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	if errno != 0 {
+		return 0, fmt.Errorf("run program: %w", errno)
+	}
+	return attr.retval, nil
+}
+
+// SetWaiters sets the number of clients waiting in user space for a server,
+// the BPF program leaves them the servers put back to the queue.
+func (dao *MapDAO) SetWaiters(n int) error {
+	if err := dao.Objs.Waiters.Put(uint32(0), uint32(n)); err != nil {
+		return fmt.Errorf("put waiters: %w", err)
+	}
+	return nil
+}
+
+// OrphanedServer is a server the BPF program unbound from a closed client.
+type OrphanedServer struct {
+	// Port is the local port of the server.
+	Port int
+	// Running indicates whether the server had not answered the client yet.
+	Running bool
+	// Pinned indicates whether the client left session state on the server.
+	Pinned bool
+}
+
+// PopOrphanedServer returns a server unbound from a closed client, or nil if
+// there is none. The server must be reset before it is registered again.
+func (dao *MapDAO) PopOrphanedServer() (*OrphanedServer, error) {
+	var orphan bpfOrphanedServer
+	if err := dao.Objs.OrphanedServers.LookupAndDelete(nil, &orphan); err != nil {
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("pop orphaned server: %w", err)
+	}
+	if err := dao.dequeueServer(&orphan.Server); err != nil {
+		return nil, err
+	}
+	return &OrphanedServer{
+		Port:    int(orphan.Server.LocalPort),
+		Running: orphan.Running != 0,
+		Pinned:  orphan.Pinned != 0,
+	}, nil
+}
+
+// RemoveClient removes the state of the client, once it is released. The BPF
+// program removes it as well once the connection is closed.
+func (dao *MapDAO) RemoveClient(conn net.Conn) error {
+	key := dao.toBPFSock6Tuple(conn)
+	if err := dao.Objs.ClientStates.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("delete client state: %w", err)
+	}
+	return nil
+}
+
+// RemoveServer removes the state and the prepared statements of the server,
+// once it is closed. The BPF program skips the servers left in the queue
+// without a state.
+func (dao *MapDAO) RemoveServer(conn net.Conn) error {
+	key := dao.toBPFSock6Tuple(conn)
+	if err := dao.Objs.ServerStates.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return fmt.Errorf("delete server state: %w", err)
+	}
+	return dao.removePrepared(key)
+}
+
+// SetPrepared records that the statement is prepared on the server, so that
+// the BPF program redirects its Binds to the server.
+func (dao *MapDAO) SetPrepared(conn net.Conn, name []byte) error {
+	key := bpfPreparedKey{Server: *dao.toBPFSock6Tuple(conn)}
+	// The BPF program passes the Binds of longer names to user space.
+	if len(name) >= len(key.Name) {
+		return fmt.Errorf("prepared statement name too long: %q", name)
+	}
+	copy(key.Name[:], name)
+
+	if err := dao.Objs.Prepared.Put(&key, uint8(1)); err != nil {
+		return fmt.Errorf("put prepared statement: %w", err)
+	}
+
+	return nil
+}
+
+// RemovePrepared removes the statements recorded as prepared on the server,
+// once its session is reset.
+func (dao *MapDAO) RemovePrepared(conn net.Conn) error {
+	return dao.removePrepared(dao.toBPFSock6Tuple(conn))
+}
+
+// removePrepared removes the statements prepared on the server.
+func (dao *MapDAO) removePrepared(server *bpfSocket6Tuple) error {
+	var (
+		key   bpfPreparedKey
+		value uint8
+		keys  []bpfPreparedKey
+	)
+	iter := dao.Objs.Prepared.Iterate()
+	for iter.Next(&key, &value) {
+		if key.Server == *server {
+			keys = append(keys, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("iterate prepared statements: %w", err)
+	}
+
+	for i := range keys {
+		if err := dao.Objs.Prepared.Delete(&keys[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return fmt.Errorf("delete prepared statement: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// SetLocalQueries registers the queries answered by user space without a
+// server. The BPF program matches them byte by byte, so the common spellings
+// of each query are registered. The spellings too long for the BPF program are
+// skipped, the servers answer them.
+func (dao *MapDAO) SetLocalQueries(queries []string) error {
+	for _, query := range queries {
+		var key bpfLocalQuery
+		// The query is terminated by a NUL byte.
+		if len(query) >= len(key.Query) {
+			log.Printf("Local query %q is longer than %d bytes, the BPF program forwards it to the servers",
+				query, len(key.Query)-1)
+			continue
+		}
+
+		for _, q := range []string{
+			query,
+			strings.ToLower(query),
+			strings.ToUpper(query),
+			query + ";",
+			strings.ToLower(query) + ";",
+			strings.ToUpper(query) + ";",
+		} {
+			if len(q) >= len(key.Query) {
+				continue
+			}
+			key = bpfLocalQuery{}
+			copy(key.Query[:], q)
+
+			if err := dao.Objs.LocalQueries.Put(key, uint8(1)); err != nil {
+				return fmt.Errorf("put local query: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Clear removes every entry of the maps, once the pool is shut down.
+func (dao *MapDAO) Clear() error {
+	var sock bpfSocket6Tuple
+	if err := clearQueue(dao.Objs.Servers, &sock); err != nil {
+		return fmt.Errorf("clear servers: %w", err)
+	}
+	var orphan bpfOrphanedServer
+	if err := clearQueue(dao.Objs.OrphanedServers, &orphan); err != nil {
+		return fmt.Errorf("clear orphaned servers: %w", err)
+	}
+
+	for name, m := range map[string]*ebpf.Map{
+		"sockhash":      dao.Objs.Sockhash,
+		"client states": dao.Objs.ClientStates,
+		"server states": dao.Objs.ServerStates,
+		"partials":      dao.Objs.Partials,
+	} {
+		if err := clearMap(m, &sock); err != nil {
+			return fmt.Errorf("clear %s: %w", name, err)
+		}
+	}
+
+	var query bpfLocalQuery
+	if err := clearMap(dao.Objs.LocalQueries, &query); err != nil {
+		return fmt.Errorf("clear local queries: %w", err)
+	}
+
+	var prepared bpfPreparedKey
+	if err := clearMap(dao.Objs.Prepared, &prepared); err != nil {
+		return fmt.Errorf("clear prepared statements: %w", err)
+	}
+
+	if err := dao.SetWaiters(0); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reconcile rebuilds the maps pinned by a previous process from the servers
+// and the clients of the pool, the ones handed off by that process and the
+// ones connected since. The states of the other sockets, closed along with the
+// previous process, are removed. The handed off sockets keep their states:
+// the bound clients stay bound, and the servers stay in their queue. A client
+// bound to a server that was not handed off is unbound, a server bound to a
+// client that was not handed off is orphaned, and a server user space held is
+// put back to the queue. It returns the servers without a state, to be set up
+// again.
+func (dao *MapDAO) Reconcile(servers, clients []net.Conn) ([]net.Conn, error) {
+	serverConns := make(map[bpfSocket6Tuple]net.Conn, len(servers))
+	for _, conn := range servers {
+		serverConns[*dao.toBPFSock6Tuple(conn)] = conn
+	}
+	clientConns := make(map[bpfSocket6Tuple]bool, len(clients))
+	for _, conn := range clients {
+		clientConns[*dao.toBPFSock6Tuple(conn)] = true
+	}
+
+	var (
+		key          bpfSocket6Tuple
+		cs           bpfClientState
+		staleClients []bpfSocket6Tuple
+		unbound      []bpfSocket6Tuple
+	)
+	iter := dao.Objs.ClientStates.Iterate()
+	for iter.Next(&key, &cs) {
+		switch _, ok := serverConns[cs.Server]; {
+		case !clientConns[key]:
+			staleClients = append(staleClients, key)
+		case cs.Valid != 0 && !ok:
+			unbound = append(unbound, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterate client states: %w", err)
+	}
+	// The server states are still there to unbind from.
+	for i := range unbound {
+		if _, err := dao.updateState(bpfStateUpdate{Op: stateOpUnbind, Client: unbound[i]}); err != nil {
+			return nil, fmt.Errorf("unbind client: %w", err)
+		}
+	}
+
+	var (
+		ss           bpfServerState
+		staleServers []bpfSocket6Tuple
+	)
+	kept := make(map[bpfSocket6Tuple]bpfServerState)
+	iter = dao.Objs.ServerStates.Iterate()
+	for iter.Next(&key, &ss) {
+		if _, ok := serverConns[key]; ok {
+			kept[key] = ss
+		} else {
+			staleServers = append(staleServers, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterate server states: %w", err)
+	}
+
+	for key, ss := range kept {
+		switch {
+		case ss.Valid != 0 && !clientConns[ss.Client]:
+			if err := dao.orphanServer(key, ss); err != nil {
+				return nil, err
+			}
+		case ss.Valid == 0 && ss.Queue == serverQueueNone:
+			if _, err := dao.updateState(bpfStateUpdate{Op: stateOpQueue, Server: key, Params: ss.Params}); err != nil {
+				return nil, fmt.Errorf("register server: %w", err)
+			}
+		}
+	}
+
+	for i := range staleClients {
+		if err := dao.Objs.ClientStates.Delete(&staleClients[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return nil, fmt.Errorf("delete client state: %w", err)
+		}
+	}
+	for i := range staleServers {
+		if err := dao.Objs.ServerStates.Delete(&staleServers[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return nil, fmt.Errorf("delete server state: %w", err)
+		}
+		if err := dao.removePrepared(&staleServers[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := dao.filterQueues(kept); err != nil {
+		return nil, err
+	}
+
+	var (
+		partial       bpfPartial
+		stalePartials []bpfSocket6Tuple
+	)
+	iter = dao.Objs.Partials.Iterate()
+	for iter.Next(&key, &partial) {
+		if _, ok := serverConns[key]; !ok && !clientConns[key] {
+			stalePartials = append(stalePartials, key)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("iterate partials: %w", err)
+	}
+	for i := range stalePartials {
+		if err := dao.Objs.Partials.Delete(&stalePartials[i]); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return nil, fmt.Errorf("delete partial: %w", err)
+		}
+	}
+
+	// The clients waiting for a server were not handed off.
+	if err := dao.SetWaiters(0); err != nil {
+		return nil, err
 	}
 
-	h := fnv.New32a()
-	h.Write(name)
-	copy(ss.Prepared[h.Sum32()&0xFF][:], name)
+	var missing []net.Conn
+	for key, conn := range serverConns {
+		if _, ok := kept[key]; !ok {
+			missing = append(missing, conn)
+		}
+	}
+	return missing, nil
+}
+
+// orphanServer unbinds the server from its client gone along with the previous
+// process, and leaves it to user space to reset, as the BPF program does for
+// the clients closing. Without the state of the client, the server is reset as
+// if a query was running and the client was pinned.
+func (dao *MapDAO) orphanServer(key bpfSocket6Tuple, ss bpfServerState) error {
+	orphan := bpfOrphanedServer{Server: key, Running: 1, Pinned: 1}
+	var cs bpfClientState
+	if err := dao.Objs.ClientStates.Lookup(&ss.Client, &cs); err == nil {
+		if ss.LastActiveNs >= cs.LastActiveNs {
+			orphan.Running = 0
+		}
+		orphan.Pinned = cs.Pinned
+	}
 
-	// log.Println("Update server state prepared statement hash:", h.Sum32())
-	if err := dao.Objs.ServerStates.Put(key, ss); err != nil {
+	ss.Valid = 0
+	ss.Queue = serverQueueOrphaned
+	if err := dao.Objs.ServerStates.Put(&key, &ss); err != nil {
 		return fmt.Errorf("put server state: %w", err)
 	}
+	if err := dao.Objs.OrphanedServers.Put(nil, &orphan); err != nil {
+		return fmt.Errorf("push orphaned server: %w", err)
+	}
+	return nil
+}
+
+// filterQueues leaves the kept servers only in the queues, so that a new
+// server reusing the local port of a stale one is not taken for it. The order
+// of the queues is kept.
+func (dao *MapDAO) filterQueues(kept map[bpfSocket6Tuple]bpfServerState) error {
+	var (
+		sock  bpfSocket6Tuple
+		socks []bpfSocket6Tuple
+	)
+	for {
+		if err := dao.Objs.Servers.LookupAndDelete(nil, &sock); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				break
+			}
+			return fmt.Errorf("pop server: %w", err)
+		}
+		if _, ok := kept[sock]; ok {
+			socks = append(socks, sock)
+		}
+	}
+	for i := range socks {
+		if err := dao.Objs.Servers.Put(nil, &socks[i]); err != nil {
+			return fmt.Errorf("push server: %w", err)
+		}
+	}
+
+	var (
+		orphan  bpfOrphanedServer
+		orphans []bpfOrphanedServer
+	)
+	for {
+		if err := dao.Objs.OrphanedServers.LookupAndDelete(nil, &orphan); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				break
+			}
+			return fmt.Errorf("pop orphaned server: %w", err)
+		}
+		if _, ok := kept[orphan.Server]; ok {
+			orphans = append(orphans, orphan)
+		}
+	}
+	for i := range orphans {
+		if err := dao.Objs.OrphanedServers.Put(nil, &orphans[i]); err != nil {
+			return fmt.Errorf("push orphaned server: %w", err)
+		}
+	}
 
 	return nil
 }
 
+// clearQueue pops the values of the queue q one by one, using value to hold
+// each of them.
+func clearQueue(q *ebpf.Map, value interface{}) error {
+	for {
+		if err := q.LookupAndDelete(nil, value); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				return nil
+			}
+			return fmt.Errorf("pop value: %w", err)
+		}
+	}
+}
+
+// clearMap deletes the keys of the hash map m one by one, using key to hold
+// each of them.
+func clearMap(m *ebpf.Map, key interface{}) error {
+	for {
+		if err := m.NextKey(nil, key); err != nil {
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				return nil
+			}
+			return fmt.Errorf("next key: %w", err)
+		}
+		if err := m.Delete(key); err != nil {
+			return fmt.Errorf("delete key: %w", err)
+		}
+	}
+}
+
 func (dao *MapDAO) SetSockhash(conn net.Conn, fd uint32) error {
-	key := dao.toBPFSock4Tuple(conn)
+	key := dao.toBPFSock6Tuple(conn)
 	// log.Printf("[SetSockhash] %d %d %d %d", key.LocalIp4, key.LocalPort, key.RemoteIp4, key.RemotePort)
 	return dao.Objs.Sockhash.Put(key, fd)
 }
 
-func (dao *MapDAO) SetupClientState(conn net.Conn, id uint32) error {
-	key := dao.toBPFSock4Tuple(conn)
-	var state bpfClientState
+// SetupClientState sets up the state of the client, whose parameters params
+// identifies.
+func (dao *MapDAO) SetupClientState(conn net.Conn, id uint32, params uint32) error {
+	key := dao.toBPFSock6Tuple(conn)
+	state := bpfClientState{Params: params, LastActiveNs: monotonicNow()}
 	/*
 		copy(state.Id[:], []byte(fmt.Sprintf("%09d", id)))
 	*/
@@ -76,26 +730,40 @@ func (dao *MapDAO) SetupClientState(conn net.Conn, id uint32) error {
 	return dao.Objs.ClientStates.Put(key, state)
 }
 
-func (dao *MapDAO) toBPFSock4Tuple(conn net.Conn) *bpfSocket4Tuple {
-	return &bpfSocket4Tuple{
-		LocalIp4:   dao.parseIP4(conn.LocalAddr().(*net.TCPAddr).IP),
+func (dao *MapDAO) toBPFSock6Tuple(conn net.Conn) *bpfSocket6Tuple {
+	return &bpfSocket6Tuple{
+		LocalIp6:   dao.parseIP6(conn.LocalAddr().(*net.TCPAddr).IP),
 		LocalPort:  uint32(conn.LocalAddr().(*net.TCPAddr).Port),
-		RemoteIp4:  dao.parseIP4(conn.RemoteAddr().(*net.TCPAddr).IP),
+		RemoteIp6:  dao.parseIP6(conn.RemoteAddr().(*net.TCPAddr).IP),
 		RemotePort: dao.htonl(uint32(conn.RemoteAddr().(*net.TCPAddr).Port)),
 	}
 }
 
-func (dao *MapDAO) parseIP4(ip net.IP) uint32 {
-	if len(ip) == 16 {
-		return binary.LittleEndian.Uint32(ip[12:16])
+// parseIP6 returns the IPv6 address, or the IPv4-mapped IPv6 address, as the
+// BPF program keys sockets by.
+func (dao *MapDAO) parseIP6(ip net.IP) [4]uint32 {
+	ip = ip.To16()
+
+	var words [4]uint32
+	for i := range words {
+		words[i] = hostEndian.Uint32(ip[4*i:])
+	}
+	return words
+}
+
+// monotonicNow returns the time of the clock used by bpf_ktime_get_ns.
+func monotonicNow() uint64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		panic(err)
 	}
-	return binary.LittleEndian.Uint32(ip)
+	return uint64(ts.Nano())
 }
 
 // htonl converts a uint32 from host to network byte order.
 func (dao *MapDAO) htonl(x uint32) uint32 {
 	b := make([]byte, 4)
-	binary.LittleEndian.PutUint32(b, x)
+	hostEndian.PutUint32(b, x)
 	return binary.BigEndian.Uint32(b)
 }
 
@@ -103,5 +771,5 @@ func (dao *MapDAO) htonl(x uint32) uint32 {
 func (dao *MapDAO) ntohl(x uint32) uint32 {
 	b := make([]byte, 4)
 	binary.BigEndian.PutUint32(b, x)
-	return binary.LittleEndian.Uint32(b)
+	return hostEndian.Uint32(b)
 }
@@ -0,0 +1,118 @@
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/features"
+	"golang.org/x/sys/unix"
+)
+
+// Feature is a privilege or a kernel feature the BPF proxy requires.
+type Feature struct {
+	Name string
+	// Err tells why the feature is unavailable, nil if it is available.
+	Err error
+}
+
+// Probe checks the privileges and the kernel features the BPF proxy requires:
+// the cgroup2 mount, the map and program types, and the helpers the programs
+// call.
+func Probe() []Feature {
+	var fs []Feature
+	add := func(name string, err error) {
+		fs = append(fs, Feature{Name: name, Err: err})
+	}
+
+	add("CAP_BPF or CAP_SYS_ADMIN capability", haveCapability(unix.CAP_BPF, unix.CAP_SYS_ADMIN))
+	add("CAP_NET_ADMIN capability", haveCapability(unix.CAP_NET_ADMIN, unix.CAP_SYS_ADMIN))
+	// bpf_printk is a tracing helper.
+	add("CAP_PERFMON or CAP_SYS_ADMIN capability", haveCapability(unix.CAP_PERFMON, unix.CAP_SYS_ADMIN))
+
+	_, err := findCgroupPath()
+	add("cgroup2 mount", err)
+
+	for _, mt := range []ebpf.MapType{
+		ebpf.SockHash,
+		ebpf.Hash,
+		ebpf.LRUHash,
+		ebpf.Array,
+		ebpf.PerCPUArray,
+		ebpf.Queue,
+		ebpf.RingBuf,
+	} {
+		add(fmt.Sprintf("%s map", mt), features.HaveMapType(mt))
+	}
+
+	helpers := map[ebpf.ProgramType][]asm.BuiltinFunc{
+		ebpf.SkSKB: {
+			asm.FnSkRedirectHash,
+			asm.FnSkbLoadBytes,
+			asm.FnMapPopElem,
+			asm.FnMapPushElem,
+			asm.FnRingbufReserve,
+			asm.FnRingbufSubmit,
+			asm.FnKtimeGetNs,
+			asm.FnLoop,
+		},
+		ebpf.SockOps: {
+			asm.FnSockOpsCbFlagsSet,
+			asm.FnMapPushElem,
+			asm.FnRingbufReserve,
+			asm.FnRingbufSubmit,
+		},
+		ebpf.Syscall: {
+			asm.FnMapPushElem,
+		},
+	}
+	// user space updates the states through a syscall program
+	for _, pt := range []ebpf.ProgramType{ebpf.SkSKB, ebpf.SockOps, ebpf.Syscall} {
+		if err := features.HaveProgramType(pt); err != nil {
+			// The helpers cannot be probed without the program type.
+			add(fmt.Sprintf("%s program", pt), err)
+			continue
+		}
+		add(fmt.Sprintf("%s program", pt), nil)
+
+		for _, fn := range helpers[pt] {
+			add(fmt.Sprintf("%s helper of %s programs", fn, pt), features.HaveProgramHelper(pt, fn))
+		}
+	}
+
+	return fs
+}
+
+// Missing returns an error listing the unavailable features, or nil if every
+// feature is available.
+func Missing(fs []Feature) error {
+	var missing []string
+	for _, f := range fs {
+		if f.Err != nil {
+			missing = append(missing, fmt.Sprintf("%s: %v", f.Name, f.Err))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("missing %s", strings.Join(missing, "; "))
+}
+
+// haveCapability reports whether the process has any of caps in its effective
+// set.
+func haveCapability(caps ...int) error {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("capget: %w", err)
+	}
+
+	for _, c := range caps {
+		if data[c/32].Effective&(1<<(uint(c)%32)) != 0 {
+			return nil
+		}
+	}
+	return errors.New("not in the effective capabilities")
+}
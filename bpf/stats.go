@@ -0,0 +1,110 @@
+package bpf
+
+import (
+	"fmt"
+)
+
+// stat mirrors the stat enum of the BPF program, indexing the stats map.
+type stat uint32
+
+const (
+	statClientRedirects stat = iota
+	statClientRedirectBytes
+	statServerRedirects
+	statServerRedirectBytes
+	statTransactions
+	statServerPops
+	statServerPushes
+	statPassNoClientState
+	statPassNoServer
+	statPassPending
+	statPassLargeMessage
+	statPassUnpreparedStatement
+	statPassSessionStatement
+	statPassLocalQuery
+	statPassTerminate
+	statPassUnboundServer
+	statPassNonTargeted
+	statPassParameters
+	statMax
+)
+
+// Stats are the counters of the BPF program, summed over the CPUs since it was
+// loaded.
+type Stats struct {
+	// ClientRedirects is the number of client messages redirected to servers.
+	ClientRedirects uint64
+	// ClientRedirectBytes is the size of the client messages redirected.
+	ClientRedirectBytes uint64
+	// ServerRedirects is the number of server messages redirected to clients.
+	ServerRedirects uint64
+	// ServerRedirectBytes is the size of the server messages redirected.
+	ServerRedirectBytes uint64
+	// Transactions is the number of transactions completed.
+	Transactions uint64
+	// ServerPops is the number of servers taken out of the queue.
+	ServerPops uint64
+	// ServerPushes is the number of servers put back to the queue.
+	ServerPushes uint64
+	// Passes are the number of messages passed to user space, by reason.
+	Passes PassStats
+}
+
+// PassStats are the number of messages the BPF program passed to user space,
+// by reason.
+type PassStats struct {
+	NoClientState uint64
+	NoServer      uint64
+	// Pending are the messages following one passed to user space, which
+	// forwards them in order.
+	Pending uint64
+	// LargeMessage are the messages batched along with the rest of a message
+	// larger than the batches, whose server was unbound meanwhile.
+	LargeMessage        uint64
+	UnpreparedStatement uint64
+	SessionStatement    uint64
+	LocalQuery          uint64
+	Terminate           uint64
+	UnboundServer       uint64
+	NonTargeted         uint64
+	// Parameters are the messages of the clients no queued server has the
+	// parameters of, which user space applies before binding them a server.
+	Parameters uint64
+}
+
+// Stats returns the counters of the BPF program.
+func (dao *MapDAO) Stats() (*Stats, error) {
+	var sums [statMax]uint64
+	var values []uint64
+	for i := range sums {
+		if err := dao.Objs.Stats.Lookup(uint32(i), &values); err != nil {
+			return nil, fmt.Errorf("lookup stat %d: %w", i, err)
+		}
+		for _, v := range values {
+			sums[i] += v
+		}
+	}
+
+	return &Stats{
+		ClientRedirects:     sums[statClientRedirects],
+		ClientRedirectBytes: sums[statClientRedirectBytes],
+		ServerRedirects:     sums[statServerRedirects],
+		ServerRedirectBytes: sums[statServerRedirectBytes],
+		Transactions:        sums[statTransactions],
+		ServerPops:          sums[statServerPops],
+		ServerPushes:        sums[statServerPushes],
+		Passes: PassStats{
+			NoClientState:       sums[statPassNoClientState],
+			NoServer:            sums[statPassNoServer],
+			Pending:             sums[statPassPending],
+			LargeMessage:        sums[statPassLargeMessage],
+			UnpreparedStatement: sums[statPassUnpreparedStatement],
+			SessionStatement:    sums[statPassSessionStatement],
+			LocalQuery:          sums[statPassLocalQuery],
+			Terminate:           sums[statPassTerminate],
+			UnboundServer:       sums[statPassUnboundServer],
+			NonTargeted:         sums[statPassNonTargeted],
+			Parameters:          sums[statPassParameters],
+		},
+	}, nil
+}
@@ -0,0 +1,202 @@
+package bpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/ringbuf"
+)
+
+// eventsMapName is the name of the ring buffer the BPF program traces its
+// events into, as found by the tracers.
+const eventsMapName = "kpgpool_events"
+
+// eventType mirrors the event_type enum of the BPF program.
+type eventType uint32
+
+const (
+	eventBind eventType = iota + 1
+	eventUnbind
+	eventPass
+	eventPreparedMiss
+)
+
+var eventTypeNames = map[eventType]string{
+	eventBind:         "bind",
+	eventUnbind:       "unbind",
+	eventPass:         "pass",
+	eventPreparedMiss: "prepared-miss",
+}
+
+var passReasonNames = map[stat]string{
+	statPassNoClientState:       "no-client-state",
+	statPassNoServer:            "no-server",
+	statPassPending:             "pending",
+	statPassLargeMessage:        "large-message",
+	statPassUnpreparedStatement: "unprepared-statement",
+	statPassSessionStatement:    "session-statement",
+	statPassLocalQuery:          "local-query",
+	statPassTerminate:           "terminate",
+	statPassUnboundServer:       "unbound-server",
+	statPassNonTargeted:         "non-targeted",
+	statPassParameters:          "parameters",
+}
+
+// Socket is a socket of the pool, as seen from the pool.
+type Socket struct {
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+func (s *Socket) String() string {
+	return s.Local + "<->" + s.Remote
+}
+
+// Event is an event traced by the BPF program.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Type is bind, unbind, pass or prepared-miss.
+	Type string `json:"type"`
+	// Reason is the reason a message is passed to user space.
+	Reason string `json:"reason,omitempty"`
+	// Socket is the client, or the socket the passed message comes from.
+	Socket *Socket `json:"socket"`
+	// Peer is the server of the client, if any.
+	Peer *Socket `json:"peer,omitempty"`
+}
+
+func (e *Event) String() string {
+	s := e.Time.Format("15:04:05.000000") + " " + e.Type
+	if e.Reason != "" {
+		s += " (" + e.Reason + ")"
+	}
+	s += " " + e.Socket.String()
+	if e.Peer != nil {
+		s += " with " + e.Peer.String()
+	}
+	return s
+}
+
+// EventReader reads the events traced by the BPF program of a running pool.
+// The events are consumed, concurrent readers each get part of them.
+type EventReader struct {
+	m  *ebpf.Map
+	rd *ringbuf.Reader
+}
+
+// OpenEvents opens the events of the BPF program of the running pool, the one
+// pinned to pinPath if set, or the first one found loaded otherwise.
+func OpenEvents(pinPath string) (*EventReader, error) {
+	var (
+		m   *ebpf.Map
+		err error
+	)
+	if pinPath != "" {
+		m, err = ebpf.LoadPinnedMap(filepath.Join(pinPath, eventsMapName), nil)
+	} else {
+		m, err = findMap(eventsMapName, ebpf.RingBuf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open map %s: %w", eventsMapName, err)
+	}
+
+	rd, err := ringbuf.NewReader(m)
+	if err != nil {
+		m.Close()
+		return nil, fmt.Errorf("open ring buffer: %w", err)
+	}
+
+	return &EventReader{m: m, rd: rd}, nil
+}
+
+// Read waits for the next event, until the reader is closed.
+func (r *EventReader) Read() (*Event, error) {
+	rec, err := r.rd.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	var raw bpfEvent
+	if err := binary.Read(bytes.NewReader(rec.RawSample), hostEndian, &raw); err != nil {
+		return nil, fmt.Errorf("decode event: %w", err)
+	}
+
+	e := &Event{
+		Time:   monotonicTime(raw.TimestampNs),
+		Type:   eventTypeNames[eventType(raw.Type)],
+		Socket: socketOf(&raw.Socket),
+	}
+	if e.Type == "" {
+		e.Type = fmt.Sprintf("unknown(%d)", raw.Type)
+	}
+	if eventType(raw.Type) == eventPass || eventType(raw.Type) == eventPreparedMiss {
+		e.Reason = passReasonNames[stat(raw.Reason)]
+	}
+	if raw.Peer != (bpfSocket6Tuple{}) {
+		e.Peer = socketOf(&raw.Peer)
+	}
+
+	return e, nil
+}
+
+// Close closes the reader, unblocking Read.
+func (r *EventReader) Close() error {
+	if err := r.rd.Close(); err != nil {
+		return err
+	}
+	return r.m.Close()
+}
+
+// findMap returns the loaded map by its name and type.
+func findMap(name string, typ ebpf.MapType) (*ebpf.Map, error) {
+	var id ebpf.MapID
+	for {
+		var err error
+		if id, err = ebpf.MapGetNextID(id); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("map %s not found, is the pool running in BPF mode?", name)
+			}
+			return nil, fmt.Errorf("get next map id: %w", err)
+		}
+
+		m, err := ebpf.NewMapFromID(id)
+		if err != nil {
+			// The map was removed meanwhile.
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("open map %d: %w", id, err)
+		}
+		info, err := m.Info()
+		if err == nil && info.Name == name && info.Type == typ {
+			return m, nil
+		}
+		m.Close()
+	}
+}
+
+// socketOf returns the addresses of the socket keyed by the tuple.
+func socketOf(t *bpfSocket6Tuple) *Socket {
+	var remotePort [4]byte
+	hostEndian.PutUint32(remotePort[:], t.RemotePort)
+
+	local := &net.TCPAddr{IP: ipOf(t.LocalIp6), Port: int(t.LocalPort)}
+	remote := &net.TCPAddr{IP: ipOf(t.RemoteIp6), Port: int(binary.BigEndian.Uint32(remotePort[:]))}
+	return &Socket{Local: local.String(), Remote: remote.String()}
+}
+
+// ipOf returns the address in the words of the tuple, the reverse of parseIP6.
+func ipOf(words [4]uint32) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	for i, w := range words {
+		hostEndian.PutUint32(ip[4*i:], w)
+	}
+	return ip
+}
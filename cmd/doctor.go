@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/features"
+	"github.com/justin0u0/kpgpool/bpf"
+	"github.com/justin0u0/kpgpool/pool/conn"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// minKernelVersion is the oldest kernel the BPF proxy is known to work on.
+var minKernelVersion = kernelVersion(6, 1, 0)
+
+// memlockKernelVersion is the first kernel accounting BPF memory to the cgroup
+// rather than to RLIMIT_MEMLOCK.
+var memlockKernelVersion = kernelVersion(5, 11, 0)
+
+func doctorCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use: "doctor",
+		Run: runDoctor,
+	}
+	cmd.Flags().StringP("url", "u", "10.140.0.10:5432", "database URL, host:port or unix:// followed by the socket path")
+	cmd.Flags().IntP("port", "p", 6432, "pool port")
+	cmd.Flags().Duration("timeout", 5*time.Second, "timeout of the connection to the database")
+
+	return cmd
+}
+
+func runDoctor(cmd *cobra.Command, args []string) {
+	url, err := cmd.Flags().GetString("url")
+	if err != nil {
+		log.Fatalln("Failed to get url flag:", err)
+	}
+	port, err := cmd.Flags().GetInt("port")
+	if err != nil {
+		log.Fatalln("Failed to get port flag:", err)
+	}
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		log.Fatalln("Failed to get timeout flag:", err)
+	}
+
+	var d doctor
+
+	version, err := features.LinuxVersionCode()
+	if err == nil && version < minKernelVersion {
+		err = fmt.Errorf("older than %s", formatKernelVersion(minKernelVersion))
+	}
+	d.report("kernel version", kernelRelease(), err)
+
+	_, err = btf.LoadKernelSpec()
+	d.report("kernel BTF", "/sys/kernel/btf/vmlinux", err)
+
+	cgroupPath, err := bpf.CgroupPath()
+	d.report("cgroup2 mount", cgroupPath, err)
+
+	d.report("bpffs mount", "/sys/fs/bpf", checkBPFFS("/sys/fs/bpf"))
+
+	limit, err := checkMemlock(version)
+	d.report("memlock limit", limit, err)
+
+	fs := bpf.Probe()
+	for _, f := range fs {
+		d.report(f.Name, "", f.Err)
+	}
+	probeErr := bpf.Missing(fs)
+
+	var backendPort int
+	if _, portStr, err := net.SplitHostPort(url); err == nil {
+		backendPort, _ = strconv.Atoi(portStr)
+	}
+	// The pool falls back to user space with --bpf=auto on missing features
+	// only, a program failing to load otherwise stops it.
+	if probeErr != nil {
+		d.report("load and verify bpf programs", "", errors.New("skipped on the missing features, --bpf=auto falls back to the userspace proxy"))
+	} else {
+		objs, err := bpf.LoadObjects(bpf.Config{
+			PoolerPort:  port,
+			BackendPort: backendPort,
+			TxMode:      true,
+		})
+		if err != nil {
+			logVerifierError(err)
+			err = fmt.Errorf("%w, the pool fails to start even with --bpf=auto", err)
+		} else {
+			objs.Close()
+		}
+		d.report("load and verify bpf programs", "", err)
+	}
+
+	d.report("database", url, checkBackend(url, timeout))
+
+	if d.failed {
+		os.Exit(1)
+	}
+}
+
+// doctor prints the result of each check.
+type doctor struct {
+	failed bool
+}
+
+func (d *doctor) report(name, detail string, err error) {
+	if detail != "" {
+		name += " (" + detail + ")"
+	}
+	if err != nil {
+		d.failed = true
+		fmt.Printf("[FAIL] %s: %v\n", name, err)
+		return
+	}
+	fmt.Printf("[ OK ] %s\n", name)
+}
+
+func kernelVersion(major, minor, patch uint32) uint32 {
+	return major<<16 | minor<<8 | patch
+}
+
+func formatKernelVersion(v uint32) string {
+	return fmt.Sprintf("%d.%d.%d", v>>16, v>>8&0xff, v&0xff)
+}
+
+// kernelRelease returns the release of the running kernel, as uname -r does.
+func kernelRelease() string {
+	var u unix.Utsname
+	if err := unix.Uname(&u); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(u.Release[:])
+}
+
+// checkBPFFS checks that the BPF maps can be pinned under path.
+func checkBPFFS(path string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return fmt.Errorf("statfs: %w", err)
+	}
+	// the type of the field depends on the architecture, and is signed on some
+	if uint32(st.Type) != unix.BPF_FS_MAGIC {
+		return errors.New("not a bpf filesystem, mount it with: mount -t bpf bpf " + path)
+	}
+	return nil
+}
+
+// checkMemlock checks that RLIMIT_MEMLOCK does not limit the BPF maps, which
+// it does before the kernel accounts them to the cgroup.
+func checkMemlock(version uint32) (string, error) {
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_MEMLOCK, &rlim); err != nil {
+		return "", fmt.Errorf("getrlimit: %w", err)
+	}
+	if rlim.Cur == unix.RLIM_INFINITY {
+		return "unlimited", nil
+	}
+
+	limit := strconv.FormatUint(rlim.Cur, 10) + " bytes"
+	if version != 0 && version < memlockKernelVersion {
+		return limit, errors.New("limits the bpf maps, raise it with ulimit -l unlimited")
+	}
+	return limit, nil
+}
+
+// checkBackend connects to the database the way the pool does.
+func checkBackend(url string, timeout time.Duration) error {
+	network, address := "tcp", url
+	if strings.HasPrefix(url, "unix://") {
+		network, address = "unix", strings.TrimPrefix(url, "unix://")
+	}
+
+	rconn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer rconn.Close()
+
+	if err := rconn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
+	if err := conn.NewServer(rconn).Setup(); err != nil {
+		return fmt.Errorf("setup: %w", err)
+	}
+	return nil
+}
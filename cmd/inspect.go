@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/justin0u0/kpgpool/bpf"
+	"github.com/spf13/cobra"
+)
+
+func inspectCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use: "inspect",
+		Run: runInspect,
+	}
+	cmd.Flags().String("bpf-pin-instance", "", "read the BPF maps pinned by the pool of the instance, instead of the first ones found loaded")
+	cmd.Flags().Bool("json", false, "print the state as JSON")
+
+	return cmd
+}
+
+func runInspect(cmd *cobra.Command, args []string) {
+	pinInstance, err := cmd.Flags().GetString("bpf-pin-instance")
+	if err != nil {
+		log.Fatalln("Failed to get bpf-pin-instance flag:", err)
+	}
+	asJSON, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		log.Fatalln("Failed to get json flag:", err)
+	}
+
+	var pinPath string
+	if pinInstance != "" {
+		pinPath = bpf.PinPath(pinInstance)
+	}
+	snap, err := bpf.Inspect(pinPath)
+	if err != nil {
+		log.Fatalln("Failed to inspect BPF maps:", err)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(snap); err != nil {
+			log.Fatalln("Failed to encode state:", err)
+		}
+		return
+	}
+	printSnapshot(snap)
+}
+
+// printSnapshot prints the state of the BPF maps, marking the bound clients
+// and servers with => and the leaked entries with !!.
+func printSnapshot(snap *bpf.Snapshot) {
+	fmt.Printf("Clients: %d\n", len(snap.Clients))
+	for _, c := range snap.Clients {
+		var attrs []string
+		if c.Server != nil {
+			attrs = append(attrs, "bound to "+c.Server.String())
+		}
+		if c.Pinned {
+			attrs = append(attrs, "pinned")
+		}
+		if c.Pending > 0 {
+			attrs = append(attrs, fmt.Sprintf("%d pending", c.Pending))
+		}
+		attrs = append(attrs, "last active "+sinceString(c.LastActive))
+		printEntry(c.Socket, c.Bound, c.Leak, attrs)
+	}
+
+	fmt.Printf("Servers: %d, %d queued, %d orphaned, %d held by user space\n",
+		len(snap.Servers), snap.QueuedServers, snap.OrphanedServers, snap.HeldServers)
+	for _, s := range snap.Servers {
+		var attrs []string
+		if s.Client != nil {
+			attrs = append(attrs, "bound to "+s.Client.String())
+		} else if s.Queue != "" {
+			attrs = append(attrs, "unbound, "+s.Queue+" queue")
+		} else {
+			attrs = append(attrs, "unbound, held by user space")
+		}
+		if len(s.Prepared) > 0 {
+			attrs = append(attrs, "prepared "+strings.Join(s.Prepared, " "))
+		}
+		attrs = append(attrs, "last active "+sinceString(s.LastActive))
+		printEntry(s.Socket, s.Bound, s.Leak, attrs)
+	}
+
+	fmt.Printf("Waiters: %d\n", snap.Waiters)
+
+	fmt.Printf("Sockhash: %d\n", len(snap.Sockhash))
+	for _, e := range snap.Sockhash {
+		var attrs []string
+		if e.Kind != "" {
+			attrs = append(attrs, e.Kind)
+		}
+		printEntry(e.Socket, false, e.Leak, attrs)
+	}
+
+	if snap.LeakedPrepared > 0 {
+		fmt.Printf("!! %d prepared statements of servers without state\n", snap.LeakedPrepared)
+	}
+	fmt.Printf("Leaks: %d\n", snap.Leaks())
+}
+
+func printEntry(socket *bpf.Socket, bound bool, leak string, attrs []string) {
+	mark := "  "
+	switch {
+	case leak != "":
+		mark = "!!"
+		attrs = append(attrs, "leak: "+leak)
+	case bound:
+		mark = "=>"
+	}
+	fmt.Printf("%s %s, %s\n", mark, socket, strings.Join(attrs, ", "))
+}
+
+// sinceString returns the time elapsed since t, rounded for display.
+func sinceString(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Round(time.Millisecond).String() + " ago"
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"runtime/pprof"
 	"strconv"
+	"time"
 
 	"github.com/cilium/ebpf"
 	"github.com/justin0u0/kpgpool/bpf"
 	"github.com/justin0u0/kpgpool/pool"
+	"github.com/justin0u0/kpgpool/pool/conn"
 	"github.com/spf13/cobra"
 )
 
@@ -18,21 +22,51 @@ func poolCommand() *cobra.Command {
 		Use: "pool",
 		Run: runPool,
 	}
-	cmd.Flags().BoolP("bpf", "b", false, "use bpf proxy")
-	cmd.Flags().StringP("url", "u", "10.140.0.10:5432", "database URL")
+	cmd.Flags().StringP("bpf", "b", "false", "use bpf proxy, true, false, or auto to fall back to the userspace proxy when BPF is unsupported")
+	cmd.Flags().Lookup("bpf").NoOptDefVal = "true"
+	cmd.Flags().StringP("url", "u", "10.140.0.10:5432", "database URL, host:port or unix:// followed by the socket path")
 	cmd.Flags().IntP("port", "p", 6432, "pool port")
 	cmd.Flags().IntP("size", "s", 10, "pool size")
+	cmd.Flags().Bool("proxy-protocol", false, "require clients to send a PROXY protocol v1 or v2 header, as load balancers do")
+	cmd.Flags().String("unix-socket", "", "unix socket to listen on besides the pool port, such as /var/run/postgresql/.s.PGSQL.6432")
 	cmd.Flags().StringP("mode", "m", "transaction", "pooling mode, transaction or session")
+	cmd.Flags().String("pin-policy", "pin", "handling of session state statements in transaction mode, pin, reject or none")
+	cmd.Flags().StringSlice("track-parameters", conn.DefaultTrackedParameters, "parameters tracked per client and applied to its server")
+	cmd.Flags().StringSlice("local-queries", conn.DefaultLocalQueries, "health check queries answered without a server")
+	cmd.Flags().String("server-reset-query", "DISCARD ALL", "query run on the servers left with session state before reuse, empty disables it")
+	cmd.Flags().Duration("client-idle-timeout", 0, "disconnect clients idle outside of a transaction for longer, 0 to disable")
+	cmd.Flags().Duration("idle-transaction-timeout", 0, "disconnect clients idle inside a transaction for longer, 0 to disable")
+	cmd.Flags().Duration("query-timeout", 0, "cancel queries running longer on the server, 0 to disable")
+	cmd.Flags().StringToString("user-query-timeout", nil, "query timeout of specific users, as user=duration")
+	cmd.Flags().Duration("query-wait-timeout", 0, "disconnect clients waiting longer for a server, 0 to disable")
+	cmd.Flags().Duration("stats-period", 0, "log the counters of the BPF program over each period, 0 to disable")
+	cmd.Flags().String("metrics-addr", "", "serve the counters of the BPF program for scraping on this address at /metrics, each worker on the next port")
+	cmd.Flags().Int("bpf-max-message-size", bpf.MaxMessageSize, "size of the largest message of a client the BPF proxy handles, larger ones disconnect the client, 0 keeps the kernel default")
+	cmd.Flags().String("bpf-pin-instance", "", "pin the BPF maps and programs under "+bpf.PinRoot+"/<instance>, to be reused by the next process")
+	cmd.Flags().Duration("shutdown-timeout", 30*time.Second, "wait as long for transactions to complete on shutdown, 0 to wait until they do")
+	cmd.Flags().String("handoff-socket", "", "unix socket to take the pool over from the previous process, and hand it off to the next one, requires --bpf-pin-instance in BPF mode")
+	cmd.Flags().Int("workers", 1, "number of worker processes sharing the port, each owning its split of the pool size")
+	cmd.Flags().Bool("reuse-port", false, "listen with SO_REUSEPORT, to share the port with other processes")
 	cmd.Flags().Bool("pprof", false, "enable pprof CPU profiling")
 
 	return cmd
 }
 
 func runPool(cmd *cobra.Command, args []string) {
-	bpfEnabled, err := cmd.Flags().GetBool("bpf")
+	bpfMode, err := cmd.Flags().GetString("bpf")
 	if err != nil {
 		log.Fatalln("Failed to get bpf flag:", err)
 	}
+	var bpfEnabled, bpfAuto bool
+	switch bpfMode {
+	case "true":
+		bpfEnabled = true
+	case "auto":
+		bpfEnabled, bpfAuto = true, true
+	case "false":
+	default:
+		log.Fatalf("invalid bpf mode: %s", bpfMode)
+	}
 	url, err := cmd.Flags().GetString("url")
 	if err != nil {
 		log.Fatalln("Failed to get url flag:", err)
@@ -45,6 +79,14 @@ func runPool(cmd *cobra.Command, args []string) {
 	if err != nil {
 		log.Fatalln("Failed to get size flag:", err)
 	}
+	unixSocket, err := cmd.Flags().GetString("unix-socket")
+	if err != nil {
+		log.Fatalln("Failed to get unix-socket flag:", err)
+	}
+	proxyProtocol, err := cmd.Flags().GetBool("proxy-protocol")
+	if err != nil {
+		log.Fatalln("Failed to get proxy-protocol flag:", err)
+	}
 	mode, err := cmd.Flags().GetString("mode")
 	if err != nil {
 		log.Fatalln("Failed to get mode flag:", err)
@@ -58,31 +100,144 @@ func runPool(cmd *cobra.Command, args []string) {
 	default:
 		log.Fatalf("invalid mode: %s", mode)
 	}
+	pinPolicy, err := cmd.Flags().GetString("pin-policy")
+	if err != nil {
+		log.Fatalln("Failed to get pin-policy flag:", err)
+	}
+	switch conn.PinPolicy(pinPolicy) {
+	case conn.PinPolicyPin, conn.PinPolicyReject, conn.PinPolicyNone:
+	default:
+		log.Fatalf("invalid pin policy: %s", pinPolicy)
+	}
+	trackedParams, err := cmd.Flags().GetStringSlice("track-parameters")
+	if err != nil {
+		log.Fatalln("Failed to get track-parameters flag:", err)
+	}
+	localQueries, err := cmd.Flags().GetStringSlice("local-queries")
+	if err != nil {
+		log.Fatalln("Failed to get local-queries flag:", err)
+	}
+	serverResetQuery, err := cmd.Flags().GetString("server-reset-query")
+	if err != nil {
+		log.Fatalln("Failed to get server-reset-query flag:", err)
+	}
+	clientIdleTimeout, err := cmd.Flags().GetDuration("client-idle-timeout")
+	if err != nil {
+		log.Fatalln("Failed to get client-idle-timeout flag:", err)
+	}
+	idleTxTimeout, err := cmd.Flags().GetDuration("idle-transaction-timeout")
+	if err != nil {
+		log.Fatalln("Failed to get idle-transaction-timeout flag:", err)
+	}
+	queryTimeout, err := cmd.Flags().GetDuration("query-timeout")
+	if err != nil {
+		log.Fatalln("Failed to get query-timeout flag:", err)
+	}
+	userQueryTimeoutFlags, err := cmd.Flags().GetStringToString("user-query-timeout")
+	if err != nil {
+		log.Fatalln("Failed to get user-query-timeout flag:", err)
+	}
+	userQueryTimeouts := make(map[string]time.Duration, len(userQueryTimeoutFlags))
+	for user, v := range userQueryTimeoutFlags {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Invalid query timeout %q of user %q: %v", v, user, err)
+		}
+		userQueryTimeouts[user] = d
+	}
+	queryWaitTimeout, err := cmd.Flags().GetDuration("query-wait-timeout")
+	if err != nil {
+		log.Fatalln("Failed to get query-wait-timeout flag:", err)
+	}
+	statsPeriod, err := cmd.Flags().GetDuration("stats-period")
+	if err != nil {
+		log.Fatalln("Failed to get stats-period flag:", err)
+	}
+	metricsAddr, err := cmd.Flags().GetString("metrics-addr")
+	if err != nil {
+		log.Fatalln("Failed to get metrics-addr flag:", err)
+	}
+	maxMessageSize, err := cmd.Flags().GetInt("bpf-max-message-size")
+	if err != nil {
+		log.Fatalln("Failed to get bpf-max-message-size flag:", err)
+	}
+	if maxMessageSize < 0 || maxMessageSize > bpf.MaxMessageSize {
+		log.Fatalf("invalid bpf max message size: %d, must be between 0 and %d", maxMessageSize, bpf.MaxMessageSize)
+	}
+	pinInstance, err := cmd.Flags().GetString("bpf-pin-instance")
+	if err != nil {
+		log.Fatalln("Failed to get bpf-pin-instance flag:", err)
+	}
+	shutdownTimeout, err := cmd.Flags().GetDuration("shutdown-timeout")
+	if err != nil {
+		log.Fatalln("Failed to get shutdown-timeout flag:", err)
+	}
+	handoffSocket, err := cmd.Flags().GetString("handoff-socket")
+	if err != nil {
+		log.Fatalln("Failed to get handoff-socket flag:", err)
+	}
+	workers, err := cmd.Flags().GetInt("workers")
+	if err != nil {
+		log.Fatalln("Failed to get workers flag:", err)
+	}
+	if workers < 1 || workers > size {
+		log.Fatalf("invalid workers: %d, must be between 1 and the pool size", workers)
+	}
+	// Each worker would replace the socket of the previous one.
+	if workers > 1 && unixSocket != "" {
+		log.Fatalln("--unix-socket is not supported with --workers")
+	}
+	reusePort, err := cmd.Flags().GetBool("reuse-port")
+	if err != nil {
+		log.Fatalln("Failed to get reuse-port flag:", err)
+	}
 	pprofEnabled, err := cmd.Flags().GetBool("pprof")
 	if err != nil {
 		log.Fatalln("Failed to get pprof flag:", err)
 	}
 
-	objs, err := bpf.LoadObjects()
-	if err != nil {
-		var ve *ebpf.VerifierError
-		if errors.As(err, &ve) {
-			for _, l := range ve.Log {
-				log.Println(l)
-			}
-		}
-		log.Fatalf("failed to load bpf objects: %v", err)
+	if workers > 1 {
+		runWorkers(cmd.Context(), workers, size, handoffSocket, pinInstance, metricsAddr)
+		return
 	}
-	defer objs.Close()
-	log.Println("Loaded bpf objects")
 
+	// The BPF program tells the packets of clients and servers apart by port, a
+	// Unix socket backend leaves it unset as BPF mode falls back to user space.
+	var backendPort int
+	if _, portStr, err := net.SplitHostPort(url); err == nil {
+		backendPort, _ = strconv.Atoi(portStr)
+	}
+	var pinPath string
+	if pinInstance != "" {
+		pinPath = bpf.PinPath(pinInstance)
+	}
+	// The BPF program redirects between TCP sockets only, it is not loaded for
+	// a pool serving Unix sockets.
+	if bpfEnabled && (pool.IsUnixAddr(url) || unixSocket != "") {
+		log.Println("WARNING: BPF proxy supports TCP clients and servers only, falling back to the userspace proxy")
+		bpfEnabled = false
+	}
+	mapDAO := &bpf.MapDAO{}
 	if bpfEnabled {
-		detach, err := bpf.AttachProgram(objs, bpf.ProgramPool)
+		dao, cleanup, err := setupBPF(bpf.Config{
+			PoolerPort:  port,
+			BackendPort: backendPort,
+			TxMode:      poolMode == pool.ModeTx,
+			PinPath:     pinPath,
+		})
 		if err != nil {
-			log.Fatalf("failed to attach program: %v", err)
+			// Only a kernel missing a feature is fallen back from, a program
+			// failing on a kernel that has them all is a bug to fix.
+			if !bpfAuto || !errors.Is(err, errBPFUnsupported) {
+				log.Fatalln("Failed to set up bpf proxy:", err)
+			}
+			// Without sockmap redirection, the pool still serves in user space.
+			log.Println("WARNING: BPF proxy unsupported, falling back to the userspace proxy:", err)
+			bpfEnabled = false
+		} else {
+			defer cleanup()
+			mapDAO = dao
 		}
-		defer detach()
-		log.Println("Attached bpf program")
 	}
 
 	ctx := cmd.Context()
@@ -111,14 +266,39 @@ func runPool(cmd *cobra.Command, args []string) {
 		":"+strconv.Itoa(port),
 		size,
 		poolMode,
-		&bpf.MapDAO{Objs: objs},
+		mapDAO,
 		bpfEnabled,
+		pool.Options{
+			PinPolicy:         conn.PinPolicy(pinPolicy),
+			TrackedParameters: trackedParams,
+			LocalQueries:      localQueries,
+			ServerResetQuery:  serverResetQuery,
+			Timeouts: conn.Timeouts{
+				ClientIdle:      clientIdleTimeout,
+				IdleTransaction: idleTxTimeout,
+				Query:           queryTimeout,
+				QueryWait:       queryWaitTimeout,
+			},
+			UserQueryTimeouts: userQueryTimeouts,
+			ShutdownTimeout:   shutdownTimeout,
+			HandoffSocket:     handoffSocket,
+			ReusePort:         reusePort,
+			UnixSocket:        unixSocket,
+			ProxyProtocol:     proxyProtocol,
+			StatsPeriod:       statsPeriod,
+			MetricsAddr:       metricsAddr,
+			BPFMaxMessageSize: maxMessageSize,
+			BPFPinned:         pinPath != "",
+		},
 	)
 	if err := p.Serve(ctx); err != nil {
 		log.Println("Failed to serve:", err)
 	}
 
-	<-ctx.Done()
+	select {
+	case <-ctx.Done():
+	case <-p.HandedOff():
+	}
 
 	if err := p.Close(); err != nil {
 		log.Println("Failed to close:", err)
@@ -126,3 +306,45 @@ func runPool(cmd *cobra.Command, args []string) {
 
 	log.Println("Done")
 }
+
+// errBPFUnsupported is returned by setupBPF when the kernel or the process
+// misses a feature the BPF proxy requires.
+var errBPFUnsupported = errors.New("bpf unsupported")
+
+// setupBPF probes the features the BPF proxy requires, then loads and attaches
+// the BPF program. The returned function detaches and closes it.
+func setupBPF(cfg bpf.Config) (*bpf.MapDAO, func(), error) {
+	if err := bpf.Missing(bpf.Probe()); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errBPFUnsupported, err)
+	}
+
+	objs, err := bpf.LoadObjects(cfg)
+	if err != nil {
+		logVerifierError(err)
+		return nil, nil, fmt.Errorf("load bpf objects: %w", err)
+	}
+	log.Println("Loaded bpf objects")
+
+	detach, err := bpf.AttachProgram(objs, bpf.ProgramPool, cfg.PinPath)
+	if err != nil {
+		objs.Close()
+		return nil, nil, fmt.Errorf("attach bpf program: %w", err)
+	}
+	log.Println("Attached bpf program")
+
+	return &bpf.MapDAO{Objs: objs}, func() {
+		detach()
+		objs.Close()
+	}, nil
+}
+
+// logVerifierError logs the verifier log of the program rejected by err, if
+// any.
+func logVerifierError(err error) {
+	var ve *ebpf.VerifierError
+	if errors.As(err, &ve) {
+		for _, l := range ve.Log {
+			log.Println(l)
+		}
+	}
+}
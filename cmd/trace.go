@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/cilium/ebpf/ringbuf"
+	"github.com/justin0u0/kpgpool/bpf"
+	"github.com/spf13/cobra"
+)
+
+func traceCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use: "trace",
+		Run: runTrace,
+	}
+	cmd.Flags().String("bpf-pin-instance", "", "trace the BPF program pinned by the pool of the instance, instead of the first one found loaded")
+	cmd.Flags().Bool("json", false, "print the events as JSON lines")
+
+	return cmd
+}
+
+func runTrace(cmd *cobra.Command, args []string) {
+	pinInstance, err := cmd.Flags().GetString("bpf-pin-instance")
+	if err != nil {
+		log.Fatalln("Failed to get bpf-pin-instance flag:", err)
+	}
+	asJSON, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		log.Fatalln("Failed to get json flag:", err)
+	}
+
+	var pinPath string
+	if pinInstance != "" {
+		pinPath = bpf.PinPath(pinInstance)
+	}
+	rd, err := bpf.OpenEvents(pinPath)
+	if err != nil {
+		log.Fatalln("Failed to open events:", err)
+	}
+
+	// Closing the reader unblocks Read.
+	go func() {
+		<-cmd.Context().Done()
+		rd.Close()
+	}()
+
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		e, err := rd.Read()
+		if err != nil {
+			if errors.Is(err, ringbuf.ErrClosed) {
+				return
+			}
+			log.Fatalln("Failed to read event:", err)
+		}
+
+		if asJSON {
+			if err := enc.Encode(e); err != nil {
+				log.Fatalln("Failed to encode event:", err)
+			}
+		} else {
+			fmt.Println(e)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// workerRestartDelay is the delay before a worker that exited is restarted.
+const workerRestartDelay = time.Second
+
+// runWorkers runs the pool as worker processes sharing the port with
+// SO_REUSEPORT, each owning its share of the servers. The workers do not share
+// their servers, in BPF mode either, as each of them loads its own BPF program
+// and maps. A worker that exits is restarted, so that the workers can be
+// restarted one at a time.
+func runWorkers(ctx context.Context, workers, size int, handoffSocket, pinInstance, metricsAddr string) {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalln("Failed to get executable:", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		share := size / workers
+		if i < size%workers {
+			share++
+		}
+
+		// The last occurrence of a flag wins.
+		args := append(os.Args[1:len(os.Args):len(os.Args)],
+			"--workers=1",
+			"--reuse-port",
+			"--size="+strconv.Itoa(share),
+		)
+		if handoffSocket != "" {
+			args = append(args, "--handoff-socket="+handoffSocket+"."+strconv.Itoa(i))
+		}
+		if pinInstance != "" {
+			args = append(args, "--bpf-pin-instance="+pinInstance+"."+strconv.Itoa(i))
+		}
+		// Each worker serves the counters of its own BPF program.
+		if metricsAddr != "" {
+			addr, err := workerAddr(metricsAddr, i)
+			if err != nil {
+				log.Fatalln("Invalid metrics address:", err)
+			}
+			args = append(args, "--metrics-addr="+addr)
+		}
+
+		wg.Add(1)
+		go func(i int, args []string) {
+			defer wg.Done()
+			superviseWorker(ctx, i, exe, args)
+		}(i, args)
+	}
+
+	wg.Wait()
+	log.Println("All workers are stopped")
+}
+
+// superviseWorker runs the worker until ctx is done, restarting it whenever it
+// exits.
+func superviseWorker(ctx context.Context, i int, exe string, args []string) {
+	for {
+		cmd := exec.Command(exe, args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			log.Println("Failed to start worker", i, "-", err)
+		} else {
+			log.Println("Started worker", i, "with pid", cmd.Process.Pid)
+
+			done := make(chan error, 1)
+			go func() {
+				done <- cmd.Wait()
+			}()
+
+			select {
+			case <-ctx.Done():
+				// The worker shuts down gracefully on interrupt.
+				if err := cmd.Process.Signal(os.Interrupt); err != nil {
+					log.Println("Failed to stop worker", i, "-", err)
+				}
+				<-done
+				log.Println("Stopped worker", i)
+				return
+			case err := <-done:
+				log.Println("Worker", i, "exited:", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(workerRestartDelay):
+		}
+	}
+}
+
+// workerAddr returns the address of worker i, on the i-th port after the port
+// of addr.
+func workerAddr(addr string, i int) (string, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port == 0 {
+		return "", fmt.Errorf("port of %q must be set", addr)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port+i)), nil
+}
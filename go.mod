@@ -6,6 +6,7 @@ require (
 	github.com/cilium/ebpf v0.11.0
 	github.com/jackc/pgx/v5 v5.5.5
 	github.com/spf13/cobra v1.7.0
+	golang.org/x/sys v0.18.0
 )
 
 require (
@@ -15,6 +16,5 @@ require (
 	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/crypto v0.21.0 // indirect
 	golang.org/x/exp v0.0.0-20230817173708-d852ddb80c63 // indirect
-	golang.org/x/sys v0.18.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 )
@@ -0,0 +1,121 @@
+package pool
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/justin0u0/kpgpool/pool/conn"
+)
+
+// bpfDispatchInterval is the interval at which the servers put back to the
+// BPF servers queue are handed to the waiting clients.
+const bpfDispatchInterval = 10 * time.Millisecond
+
+// waitBPFServer waits in line for a server, when the BPF program found none
+// for the client, until the query wait timeout of the client expires or it is
+// gone.
+func (p *Pool) waitBPFServer(client *conn.Client) (*conn.Server, error) {
+	ch := make(chan *conn.Server, 1)
+	p.bpfWaitersMu.Lock()
+	p.bpfWaiters = append(p.bpfWaiters, ch)
+	p.setBPFWaiters()
+	p.bpfWaitersMu.Unlock()
+
+	var timeoutC <-chan time.Time
+	if timeout := p.timeouts(client).QueryWait; timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+
+	var err error
+	select {
+	case s := <-ch:
+		return s, nil
+	case <-timeoutC:
+		err = conn.ErrQueryWaitTimeout
+	case <-client.Draining():
+		err = client.DrainReason()
+	case <-client.Done():
+		err = conn.ErrClientClosed
+	}
+
+	p.bpfWaitersMu.Lock()
+	for i, w := range p.bpfWaiters {
+		if w == ch {
+			p.bpfWaiters = append(p.bpfWaiters[:i], p.bpfWaiters[i+1:]...)
+			break
+		}
+	}
+	p.setBPFWaiters()
+	p.bpfWaitersMu.Unlock()
+
+	// The server may have been handed over meanwhile.
+	select {
+	case s := <-ch:
+		if err := p.mapDAO.RegisterServer(s.Conn(), s.ParamsID()); err != nil {
+			log.Println("Failed to register server:", err)
+			go p.replaceServer(s)
+		}
+	default:
+	}
+
+	return nil, err
+}
+
+// dispatchBPFServers hands the servers put back to the BPF servers queue to
+// the waiting clients, in the order they started waiting, until the pool is
+// shut down.
+func (p *Pool) dispatchBPFServers(ctx context.Context) {
+	ticker := time.NewTicker(bpfDispatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		p.bpfWaitersMu.Lock()
+		for len(p.bpfWaiters) > 0 {
+			port, ok, err := p.mapDAO.PopServer()
+			if err != nil {
+				log.Println("Failed to pop server:", err)
+				break
+			}
+			if !ok {
+				break
+			}
+
+			s, ok := p.server(port)
+			if !ok {
+				// The server is put back rather than left out of the queue for good,
+				// and the waiters are served on the next tick, so as not to pop it
+				// again right away.
+				log.Println("Server not found for port", port)
+				if err := p.mapDAO.RequeueServer(port); err != nil {
+					log.Println("Failed to requeue server:", err)
+				}
+				break
+			}
+
+			p.bpfWaiters[0] <- s
+			p.bpfWaiters = p.bpfWaiters[1:]
+			p.setBPFWaiters()
+		}
+		p.bpfWaitersMu.Unlock()
+	}
+}
+
+// setBPFWaiters tells the BPF program the number of waiting clients, which
+// take the servers put back to the queue before the other clients.
+// bpfWaitersMu must be held.
+func (p *Pool) setBPFWaiters() {
+	if err := p.mapDAO.SetWaiters(len(p.bpfWaiters)); err != nil {
+		log.Println("Failed to set waiters:", err)
+	}
+}
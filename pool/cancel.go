@@ -0,0 +1,49 @@
+package pool
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/justin0u0/kpgpool/pool/conn"
+)
+
+// cancel forwards the CancelRequest received on req to the server the targeted
+// client is bound to, with the BackendKeyData of the server. Like Postgres,
+// requests with an unknown key and clients without a server are ignored.
+func (p *Pool) cancel(req *conn.Client) error {
+	id, key := req.CancelKey()
+
+	p.clientsMu.Lock()
+	client, ok := p.clients[id]
+	p.clientsMu.Unlock()
+	if !ok || !client.MatchesSecretKey(key) {
+		log.Println("Ignoring cancel request with an unknown key for client", id)
+		return nil
+	}
+
+	s, ok := p.boundServer(client)
+	if !ok {
+		log.Println("Ignoring cancel request for client", id, "without a server")
+		return nil
+	}
+
+	if err := s.Cancel(); err != nil {
+		return fmt.Errorf("cancel query of client %d: %w", id, err)
+	}
+	return nil
+}
+
+// boundServer returns the server the client is bound to, by the BPF program or
+// the userspace proxy.
+func (p *Pool) boundServer(client *conn.Client) (*conn.Server, bool) {
+	if !p.bpf {
+		s := client.Server()
+		return s, s != nil
+	}
+
+	act, err := p.mapDAO.GetClientActivity(client.Conn())
+	if err != nil || !act.Bound {
+		return nil, false
+	}
+	return p.server(act.ServerPort)
+}
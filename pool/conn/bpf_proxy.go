@@ -1,6 +1,7 @@
 package conn
 
 import (
+	"errors"
 	"fmt"
 	"log"
 
@@ -9,31 +10,72 @@ import (
 )
 
 type BPFProxy struct {
-	c       *Client
-	servers map[int]*Server
-	mapDAO  *bpf.MapDAO
-	txMode  bool
+	c *Client
+	// servers returns the server by its local port.
+	servers func(port int) (*Server, bool)
+	// wait waits in line for a server, when the BPF program found none for the
+	// client.
+	wait      func(c *Client) (*Server, error)
+	mapDAO    *bpf.MapDAO
+	txMode    bool
+	pinPolicy PinPolicy
+	// localQueries are answered in user space, the BPF program passes them
+	// without binding a server.
+	localQueries LocalQueries
+	// pending is the message the client was waiting for a server with when it
+	// was handed off.
+	pending pgproto3.FrontendMessage
 }
 
 func NewBPFProxy(
 	c *Client,
-	servers map[int]*Server,
+	servers func(port int) (*Server, bool),
+	wait func(c *Client) (*Server, error),
 	mapDAO *bpf.MapDAO,
 	txMode bool,
+	pinPolicy PinPolicy,
+	localQueries LocalQueries,
 ) *BPFProxy {
 	return &BPFProxy{
-		c:       c,
-		servers: servers,
-		mapDAO:  mapDAO,
-		txMode:  txMode,
+		c:            c,
+		servers:      servers,
+		wait:         wait,
+		mapDAO:       mapDAO,
+		txMode:       txMode,
+		pinPolicy:    pinPolicy,
+		localQueries: localQueries,
 	}
 }
 
 func (p *BPFProxy) Start() error {
 	log.Printf("Start BPF proxy for client %s->%s",
-		p.c.conn.RemoteAddr(), p.c.conn.LocalAddr())
+		p.c.remoteAddr, p.c.conn.LocalAddr())
+
+	// The BPF program counts the messages it passes as pending, and passes the
+	// next ones as well until they are forwarded, so that the messages reach
+	// the server in order. The messages sent but not flushed yet are not
+	// forwarded.
+	var (
+		unflushed int
+		sent      *Server
+	)
+	drainC := p.c.Draining()
 	for {
 		select {
+		case <-drainC:
+			// The BPF program keeps the binding of the client handed off, user
+			// space stops once the messages it handles are forwarded. The
+			// clients drained otherwise are disconnected by the pool.
+			if !errors.Is(p.c.DrainReason(), ErrHandoff) {
+				drainC = nil
+				continue
+			}
+			if unflushed > 0 {
+				if err := p.flush(sent, unflushed); err != nil {
+					return err
+				}
+			}
+			return ErrHandoff
 		case msg, ok := <-p.c.ch:
 			if !ok {
 				return ErrClientClosed
@@ -50,17 +92,57 @@ func (p *BPFProxy) Start() error {
 			if err != nil {
 				return fmt.Errorf("get client binding: %w", err)
 			}
+
+			var s *Server
 			if cs.Valid == 0 {
-				return fmt.Errorf("no server binding for client %s->%s",
-					p.c.conn.RemoteAddr(), p.c.conn.LocalAddr())
-			}
+				answered, err := p.localQueries.Answer(p.c, msg)
+				if err != nil {
+					return err
+				}
+				if answered {
+					if err := p.mapDAO.ForwardedMessages(p.c.conn, 1); err != nil {
+						return fmt.Errorf("forwarded messages: %w", err)
+					}
+					continue
+				}
 
-			s, ok := p.servers[int(cs.Server.LocalPort)]
-			if !ok {
-				return fmt.Errorf("server not found for port %d", cs.Server.LocalPort)
+				// The BPF program found no server for the client.
+				if s, err = p.wait(p.c); err != nil {
+					if errors.Is(err, ErrHandoff) {
+						p.pending = msg
+					}
+					return fmt.Errorf("wait for server: %w", err)
+				}
+				// The BPF program passes the answers of the server to user space
+				// until it is bound. A server failing to apply them is still bound,
+				// to be reclaimed once the client is gone.
+				syncErr := s.syncParameters(p.c)
+				if err := p.mapDAO.BindClient(p.c.conn, s.conn, s.ParamsID()); err != nil {
+					return fmt.Errorf("bind client: %w", err)
+				}
+				if syncErr != nil {
+					return fmt.Errorf("sync parameters: %w", syncErr)
+				}
+			} else {
+				var ok bool
+				if s, ok = p.servers(int(cs.Server.LocalPort)); !ok {
+					return fmt.Errorf("server not found for port %d", cs.Server.LocalPort)
+				}
 			}
 
 			if p.txMode {
+				// The BPF program passes session state statements to user space, and
+				// stops releasing the server once the client state is pinned. Every
+				// SET pins the client, since the BPF program redirects the
+				// ParameterStatus messages user space would follow them by. The
+				// parameters of the startup message are applied by user space, to
+				// the servers the BPF program finds none with them.
+				if p.c.applyPinPolicy(msg, p.pinPolicy, nil) {
+					if err := p.mapDAO.PinClient(p.c.conn); err != nil {
+						return fmt.Errorf("pin client: %w", err)
+					}
+				}
+
 				switch m := msg.(type) {
 				// We handle Parse messages to transform the name of the prepared
 				// statement.
@@ -77,7 +159,7 @@ func (p *BPFProxy) Start() error {
 					s.prepared[m.Name] = struct{}{}
 					p.c.prepared[m.Name] = m.Query
 
-					p.mapDAO.UpdateServerStatePrepared(s.conn, []byte(m.Name))
+					p.setPrepared(s, m.Name)
 
 				// We handle Bind messages to transform the name of the prepared
 				// statement, as well as to inject Parse messages before Bind if it
@@ -91,9 +173,11 @@ func (p *BPFProxy) Start() error {
 						// log.Printf("Send message to server: %T(%+v)", msg, msg)
 						s.frontend.Send(msg)
 						s.prepared[m.PreparedStatement] = struct{}{}
-
-						p.mapDAO.UpdateServerStatePrepared(s.conn, []byte(m.PreparedStatement))
 					}
+
+					// The BPF program passes the Binds of the statements it does not
+					// know of, evicted ones are registered again.
+					p.setPrepared(s, m.PreparedStatement)
 				}
 			}
 
@@ -104,11 +188,47 @@ func (p *BPFProxy) Start() error {
 			}
 
 			s.frontend.Send(msg)
+			unflushed, sent = unflushed+1, s
 			if !isPendingExtendedQueryMessages {
-				if err := s.frontend.Flush(); err != nil {
-					return fmt.Errorf("send message to server: %w", err)
+				if err := p.flush(s, unflushed); err != nil {
+					return err
 				}
+				unflushed = 0
 			}
 		}
 	}
 }
+
+// flush writes the n messages sent to the server, and tells the BPF program
+// they are forwarded.
+func (p *BPFProxy) flush(s *Server, n int) error {
+	if err := s.frontend.Flush(); err != nil {
+		return fmt.Errorf("send message to server: %w", err)
+	}
+	// The BPF program may redirect the next messages of the client once these
+	// are written to the server.
+	if err := p.mapDAO.ForwardedMessages(p.c.conn, n); err != nil {
+		return fmt.Errorf("forwarded messages: %w", err)
+	}
+	return nil
+}
+
+// Pending returns the message the client was waiting for a server with when
+// it was handed off, if any, to be handled by the next process.
+func (p *BPFProxy) Pending() []pgproto3.FrontendMessage {
+	if p.pending == nil {
+		return nil
+	}
+	return []pgproto3.FrontendMessage{p.pending}
+}
+
+// setPrepared registers the statement prepared on the server to the BPF
+// program, the unnamed statement is parsed along with its Bind.
+func (p *BPFProxy) setPrepared(s *Server, name string) {
+	if name == "" {
+		return
+	}
+	if err := p.mapDAO.SetPrepared(s.conn, []byte(name)); err != nil {
+		log.Println("Failed to set prepared statement:", err)
+	}
+}
@@ -6,87 +6,215 @@ import (
 	"io"
 	"log"
 	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgproto3"
 )
 
-var startupMessageRespones = []pgproto3.BackendMessage{
-	&pgproto3.AuthenticationOk{},
-	&pgproto3.ParameterStatus{Name: "client_encoding", Value: "UTF8"},
-	&pgproto3.ParameterStatus{Name: "standard_conforming_strings", Value: "on"},
-	&pgproto3.ParameterStatus{Name: "server_version", Value: "15.3 (Debian 15.3-1.pgdg120+1)"},
-	&pgproto3.BackendKeyData{ProcessID: 1234, SecretKey: 5678},
-	&pgproto3.ReadyForQuery{TxStatus: 'I'},
+var startupParameterStatuses = []*pgproto3.ParameterStatus{
+	{Name: "client_encoding", Value: "UTF8"},
+	{Name: "standard_conforming_strings", Value: "on"},
+	{Name: "server_version", Value: "15.3 (Debian 15.3-1.pgdg120+1)"},
 }
 
 type Client struct {
-	conn    net.Conn
-	id      uint32
-	backend *pgproto3.Backend
-	ch      chan pgproto3.FrontendMessage
+	conn net.Conn
+	// remoteAddr is the address of the client, which differs from the one of
+	// the connection behind a load balancer using the PROXY protocol.
+	remoteAddr net.Addr
+	id         uint32
+	backend    *pgproto3.Backend
+	// reader is the reader of the backend, which keeps the bytes of the
+	// message being received for the handoff.
+	reader *messageReader
+	ch     chan pgproto3.FrontendMessage
 	// prepared maps the name of the prepared statement to the query string.
 	prepared map[string]string
-	done     chan struct{}
+	// user is the user name of the StartupMessage.
+	user string
+	// protocolMinor is the negotiated minor version of protocol 3.
+	protocolMinor uint32
+	// secretKey is the cancel key handed out to the client.
+	secretKey []byte
+	// cancelProcessID and cancelSecretKey are the key of the CancelRequest the
+	// client sent instead of a StartupMessage.
+	cancelProcessID uint32
+	cancelSecretKey []byte
+	// server is the server the userspace proxy currently forwards the client
+	// to, for its CancelRequests.
+	server atomic.Pointer[Server]
+	// tracked is the set of parameters tracked for the client, in lower case.
+	tracked map[string]struct{}
+	// params maps the tracked parameters to the values set by the client.
+	params map[string]string
+	// pinned indicates whether the client has changed session state, and must
+	// keep its server for the rest of the session.
+	pinned bool
+	// receiving indicates whether LoopReceive started, and closes done once
+	// it returns.
+	receiving atomic.Bool
+	done      chan struct{}
+	// closed is closed once the client is closed, so that LoopReceive stops
+	// waiting for the proxy to take the last message.
+	closed    chan struct{}
+	closeOnce sync.Once
+	// drain is closed once the client is asked to give up its server, for
+	// drainErr.
+	drain     chan struct{}
+	drainErr  error
+	drainOnce sync.Once
 }
 
-func NewClient(conn net.Conn, id uint32) *Client {
-	return &Client{
-		conn:     conn,
-		id:       id,
-		backend:  pgproto3.NewBackend(conn, conn),
-		ch:       make(chan pgproto3.FrontendMessage),
-		prepared: make(map[string]string),
-		done:     make(chan struct{}),
+func NewClient(conn net.Conn, id uint32, trackedParams []string) *Client {
+	tracked := make(map[string]struct{}, len(trackedParams))
+	for _, name := range trackedParams {
+		tracked[strings.ToLower(name)] = struct{}{}
 	}
-}
 
-func (c *Client) Startup() error {
-	msg, err := c.backend.ReceiveStartupMessage()
-	if err != nil {
-		return fmt.Errorf("receive startup message: %w", err)
+	reader := newMessageReader(conn)
+	return &Client{
+		conn:       conn,
+		remoteAddr: conn.RemoteAddr(),
+		id:         id,
+		backend:    pgproto3.NewBackend(reader, conn),
+		reader:     reader,
+		ch:         make(chan pgproto3.FrontendMessage),
+		prepared:   make(map[string]string),
+		tracked:    tracked,
+		params:     make(map[string]string),
+		done:       make(chan struct{}),
+		closed:     make(chan struct{}),
+		drain:      make(chan struct{}),
 	}
-	log.Println("Received startup message:", msg)
-	return nil
 }
 
 func (c *Client) NotifyReady() error {
-	for _, msg := range startupMessageRespones {
-		c.backend.Send(msg)
+	c.backend.Send(&pgproto3.AuthenticationOk{})
+
+	// Report the parameters of the client, so that it sees the values it asked
+	// for before the first transaction applies them on a server.
+	reported := make(map[string]struct{})
+	for _, ps := range startupParameterStatuses {
+		value, ok := c.params[strings.ToLower(ps.Name)]
+		if !ok {
+			value = ps.Value
+		}
+		c.backend.Send(&pgproto3.ParameterStatus{Name: ps.Name, Value: value})
+		reported[strings.ToLower(ps.Name)] = struct{}{}
+	}
+	names := make([]string, 0, len(c.params))
+	for name := range c.params {
+		if _, ok := reported[name]; !ok {
+			names = append(names, name)
+		}
 	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.backend.Send(&pgproto3.ParameterStatus{Name: name, Value: c.params[name]})
+	}
+
+	c.backend.Send(c.backendKeyData())
+	c.backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
 	if err := c.backend.Flush(); err != nil {
 		return fmt.Errorf("send startup messages: %w", err)
 	}
 
 	log.Println("Notified ready to the client:",
-		c.conn.RemoteAddr(), "->", c.conn.LocalAddr())
+		c.remoteAddr, "->", c.conn.LocalAddr())
 	return nil
 }
 
+// Receive returns the next message received from the client. It fails with
+// ErrClientIdleTimeout when no message arrives within idleTimeout, unless
+// idleTimeout is zero, and with the drain reason once the client is drained.
+func (c *Client) Receive(idleTimeout time.Duration) (pgproto3.FrontendMessage, error) {
+	var timeoutC <-chan time.Time
+	if idleTimeout > 0 {
+		timer := time.NewTimer(idleTimeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+
+	select {
+	case msg, ok := <-c.ch:
+		if !ok {
+			return nil, ErrClientClosed
+		}
+		return msg, nil
+	case <-timeoutC:
+		return nil, ErrClientIdleTimeout
+	case <-c.drain:
+		return nil, c.drainErr
+	}
+}
+
+// Conn returns the connection to the client.
+func (c *Client) Conn() net.Conn {
+	return c.conn
+}
+
+// RemoteAddr returns the address of the client.
+func (c *Client) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// User returns the user name the client connected with.
+func (c *Client) User() string {
+	return c.user
+}
+
+// Done is closed once the client stops receiving messages.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
 func (c *Client) LoopReceive() {
+	c.receiving.Store(true)
 	defer close(c.ch)
 	defer close(c.done)
 
 	log.Println("Start receiving message from the client:",
-		c.conn.RemoteAddr(), "->", c.conn.LocalAddr())
+		c.remoteAddr, "->", c.conn.LocalAddr())
 	for {
 		msg, err := c.backend.Receive()
 		if err != nil {
-			if !errors.Is(err, io.ErrUnexpectedEOF) {
+			if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, os.ErrDeadlineExceeded) &&
+				!errors.Is(err, net.ErrClosed) {
 				log.Println("Failed to receive message from the client:", err)
 			}
 			return
 		}
+		c.reader.decoded()
 
-		c.ch <- msg
+		select {
+		case c.ch <- msg:
+		case <-c.closed:
+			return
+		}
 	}
 }
 
+// Server returns the server the userspace proxy forwards the client to, or nil.
+func (c *Client) Server() *Server {
+	return c.server.Load()
+}
+
 func (c *Client) Close() error {
 	log.Println("Closing client connection:",
-		c.conn.RemoteAddr(), "->", c.conn.LocalAddr())
+		c.remoteAddr, "->", c.conn.LocalAddr())
+	c.closeOnce.Do(func() { close(c.closed) })
 	if err := c.conn.Close(); err != nil {
 		return err
 	}
-	<-c.done
+	// A client closed during the startup, or after a CancelRequest, never
+	// received messages.
+	if c.receiving.Load() {
+		<-c.done
+	}
 	return nil
 }
@@ -0,0 +1,200 @@
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+var ErrHandoff = errors.New("handed off to another process")
+
+// ClientState is the state of a client handed off to another process.
+type ClientState struct {
+	ID            uint32
+	RemoteAddr    string
+	User          string
+	ProtocolMinor uint32
+	SecretKey     []byte
+	Params        map[string]string
+	Prepared      map[string]string
+	Pinned        bool
+	// Pending holds the messages received from the client but not handled yet.
+	Pending []byte
+}
+
+// ServerState is the state of a server handed off to another process.
+type ServerState struct {
+	ProcessID uint32
+	SecretKey uint32
+	Params    map[string]string
+	Defaults  map[string]string
+	Prepared  []string
+	// Pending holds the messages received from the server but not handled yet.
+	Pending []byte
+}
+
+// Handoff stops receiving from the client, and returns its state. The pending
+// messages are followed by the ones received in the meantime, and by the part
+// of the next ones received from the connection already.
+func (c *Client) Handoff(pending ...pgproto3.FrontendMessage) (*ClientState, error) {
+	// Unblock LoopReceive without reading from the connection.
+	if err := c.conn.SetReadDeadline(time.Now()); err != nil {
+		return nil, fmt.Errorf("set read deadline: %w", err)
+	}
+
+	var buf []byte
+	for _, msg := range pending {
+		var err error
+		if buf, err = msg.Encode(buf); err != nil {
+			return nil, fmt.Errorf("encode pending message: %w", err)
+		}
+	}
+	for msg := range c.ch {
+		var err error
+		if buf, err = msg.Encode(buf); err != nil {
+			return nil, fmt.Errorf("encode pending message: %w", err)
+		}
+	}
+	// LoopReceive is stopped once the channel is closed.
+	buf = append(buf, c.reader.unread...)
+
+	return &ClientState{
+		ID:            c.id,
+		RemoteAddr:    c.remoteAddr.String(),
+		User:          c.user,
+		ProtocolMinor: c.protocolMinor,
+		SecretKey:     c.secretKey,
+		Params:        c.params,
+		Prepared:      c.prepared,
+		Pinned:        c.pinned,
+		Pending:       buf,
+	}, nil
+}
+
+// RestoreClient returns the client handed off by another process.
+func RestoreClient(conn net.Conn, trackedParams []string, st *ClientState) *Client {
+	c := NewClient(conn, st.ID, trackedParams)
+	c.reader = newMessageReader(pendingReader(st.Pending, conn))
+	c.backend = pgproto3.NewBackend(c.reader, conn)
+	if _, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		if addr, err := net.ResolveTCPAddr("tcp", st.RemoteAddr); err == nil {
+			c.remoteAddr = addr
+		}
+	}
+	c.user = st.User
+	c.protocolMinor = st.ProtocolMinor
+	c.secretKey = st.SecretKey
+	c.pinned = st.Pinned
+	for name, value := range st.Params {
+		c.setParameter(name, value)
+	}
+	for name, query := range st.Prepared {
+		c.prepared[name] = query
+	}
+	return c
+}
+
+// Handoff stops receiving from the server, and returns its state. The server
+// must be idle, the messages it sent in the meantime are kept along.
+func (s *Server) Handoff() (*ServerState, error) {
+	if err := s.conn.SetReadDeadline(time.Now()); err != nil {
+		return nil, fmt.Errorf("set read deadline: %w", err)
+	}
+
+	var buf []byte
+	for msg := range s.ch {
+		var err error
+		if buf, err = msg.Encode(buf); err != nil {
+			return nil, fmt.Errorf("encode pending message: %w", err)
+		}
+	}
+	// LoopReceive is stopped once the channel is closed.
+	buf = append(buf, s.reader.unread...)
+
+	prepared := make([]string, 0, len(s.prepared))
+	for name := range s.prepared {
+		prepared = append(prepared, name)
+	}
+
+	return &ServerState{
+		ProcessID: s.processID,
+		SecretKey: s.secretKey,
+		Params:    s.params,
+		Defaults:  s.defaults,
+		Prepared:  prepared,
+		Pending:   buf,
+	}, nil
+}
+
+// RestoreServer returns the server handed off by another process.
+func RestoreServer(conn net.Conn, st *ServerState) *Server {
+	s := NewServer(conn)
+	s.reader = newMessageReader(pendingReader(st.Pending, conn))
+	s.frontend = pgproto3.NewFrontend(s.reader, conn)
+	s.processID = st.ProcessID
+	s.secretKey = st.SecretKey
+	for name, value := range st.Params {
+		s.params[strings.ToLower(name)] = value
+	}
+	for name, value := range st.Defaults {
+		s.defaults[strings.ToLower(name)] = value
+	}
+	for _, name := range st.Prepared {
+		s.prepared[name] = struct{}{}
+	}
+	return s
+}
+
+// pendingReader reads the pending messages before the connection.
+func pendingReader(pending []byte, conn net.Conn) io.Reader {
+	if len(pending) == 0 {
+		return conn
+	}
+	return io.MultiReader(bytes.NewReader(pending), conn)
+}
+
+// maxKeptBufferSize is the size up to which the buffer of messageReader is
+// reused once every byte is decoded.
+const maxKeptBufferSize = 8192
+
+// messageReader keeps the bytes read from r until they are decoded into a
+// message, so that the bytes pgproto3 buffered are handed off along with the
+// messages decoded already.
+type messageReader struct {
+	r io.Reader
+	// unread holds the bytes read but not decoded yet.
+	unread []byte
+}
+
+func newMessageReader(r io.Reader) *messageReader {
+	return &messageReader{r: r}
+}
+
+func (mr *messageReader) Read(p []byte) (int, error) {
+	n, err := mr.r.Read(p)
+	mr.unread = append(mr.unread, p[:n]...)
+	return n, err
+}
+
+// decoded drops the bytes of the message decoded last. The message type and
+// the length come first, the length includes itself.
+func (mr *messageReader) decoded() {
+	n := len(mr.unread)
+	if n >= 5 {
+		if l := 1 + int(binary.BigEndian.Uint32(mr.unread[1:])); l < n {
+			n = l
+		}
+	}
+	mr.unread = mr.unread[n:]
+
+	if len(mr.unread) == 0 && cap(mr.unread) > maxKeptBufferSize {
+		mr.unread = nil
+	}
+}
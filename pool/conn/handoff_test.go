@@ -0,0 +1,196 @@
+package conn
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+func encode(t *testing.T, msgs ...pgproto3.FrontendMessage) []byte {
+	t.Helper()
+
+	var buf []byte
+	for _, msg := range msgs {
+		var err error
+		if buf, err = msg.Encode(buf); err != nil {
+			t.Fatalf("encode %T: %v", msg, err)
+		}
+	}
+	return buf
+}
+
+func TestClientHandoff(t *testing.T) {
+	first := &pgproto3.Query{String: "SELECT 1"}
+	next := encode(t, &pgproto3.Query{String: "SELECT 2"})
+
+	tests := []struct {
+		name string
+		// pending are the messages passed to Handoff.
+		pending []pgproto3.FrontendMessage
+		// received are the bytes received from the client before the handoff,
+		// and rest the ones received by the restored client.
+		received []byte
+		rest     []byte
+		// queries are the queries the restored client receives.
+		queries []string
+	}{
+		{
+			name:    "idle",
+			rest:    next,
+			queries: []string{"SELECT 2"},
+		},
+		{
+			name:    "pending",
+			pending: []pgproto3.FrontendMessage{first},
+			queries: []string{"SELECT 1"},
+		},
+		{
+			name:     "received",
+			received: encode(t, first),
+			queries:  []string{"SELECT 1"},
+		},
+		{
+			name:     "partial header",
+			pending:  []pgproto3.FrontendMessage{first},
+			received: next[:3],
+			rest:     next[3:],
+			queries:  []string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			name:     "partial body",
+			received: append(encode(t, first), next[:8]...),
+			rest:     next[8:],
+			queries:  []string{"SELECT 1", "SELECT 2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lconn, rconn := net.Pipe()
+			defer lconn.Close()
+			defer rconn.Close()
+
+			c := NewClient(lconn, 7, []string{"search_path"})
+			c.user = "postgres"
+			c.protocolMinor = 2
+			c.secretKey = []byte{1, 2, 3, 4}
+			c.params["search_path"] = "public"
+			c.prepared["stmt"] = "SELECT $1"
+			c.pinned = true
+			go c.LoopReceive()
+
+			// The write returns once LoopReceive read every byte.
+			if len(tt.received) > 0 {
+				if _, err := rconn.Write(tt.received); err != nil {
+					t.Fatalf("write: %v", err)
+				}
+			}
+
+			st, err := c.Handoff(tt.pending...)
+			if err != nil {
+				t.Fatalf("Handoff() = %v", err)
+			}
+
+			lconn2, rconn2 := net.Pipe()
+			defer lconn2.Close()
+			defer rconn2.Close()
+
+			r := RestoreClient(lconn2, []string{"search_path"}, st)
+			if r.id != c.id || r.user != c.user || r.protocolMinor != c.protocolMinor ||
+				!bytes.Equal(r.secretKey, c.secretKey) || r.pinned != c.pinned {
+				t.Errorf("restored client = %+v, want %+v", r, c)
+			}
+			if !reflect.DeepEqual(r.params, c.params) {
+				t.Errorf("restored params = %v, want %v", r.params, c.params)
+			}
+			if !reflect.DeepEqual(r.prepared, c.prepared) {
+				t.Errorf("restored prepared = %v, want %v", r.prepared, c.prepared)
+			}
+
+			// The backend reuses its messages, each is checked before the next one
+			// can be received.
+			go r.LoopReceive()
+			for i, want := range tt.queries {
+				if i == len(tt.queries)-1 && len(tt.rest) > 0 {
+					go rconn2.Write(tt.rest)
+				}
+				msg := <-r.ch
+				if m, ok := msg.(*pgproto3.Query); !ok || m.String != want {
+					t.Fatalf("restored client received %T(%+v), want query %q", msg, msg, want)
+				}
+			}
+		})
+	}
+}
+
+func TestServerHandoff(t *testing.T) {
+	lconn, rconn := net.Pipe()
+	defer lconn.Close()
+	defer rconn.Close()
+
+	s := NewServer(lconn)
+	s.processID = 42
+	s.secretKey = 4242
+	s.params["timezone"] = "UTC"
+	s.defaults["timezone"] = "Etc/UTC"
+	s.prepared["stmt"] = struct{}{}
+	go s.LoopReceive()
+
+	st, err := s.Handoff()
+	if err != nil {
+		t.Fatalf("Handoff() = %v", err)
+	}
+	if len(st.Pending) != 0 {
+		t.Errorf("pending = %v, want none", st.Pending)
+	}
+
+	r := RestoreServer(lconn, st)
+	if r.processID != s.processID || r.secretKey != s.secretKey {
+		t.Errorf("restored key = %d/%d, want %d/%d", r.processID, r.secretKey, s.processID, s.secretKey)
+	}
+	if !reflect.DeepEqual(r.params, s.params) {
+		t.Errorf("restored params = %v, want %v", r.params, s.params)
+	}
+	if !reflect.DeepEqual(r.defaults, s.defaults) {
+		t.Errorf("restored defaults = %v, want %v", r.defaults, s.defaults)
+	}
+	if !reflect.DeepEqual(r.prepared, s.prepared) {
+		t.Errorf("restored prepared = %v, want %v", r.prepared, s.prepared)
+	}
+}
+
+func TestMessageReader(t *testing.T) {
+	msgs := encode(t, &pgproto3.Query{String: "SELECT 1"}, &pgproto3.Sync{}, &pgproto3.Query{String: "SELECT 2"})
+
+	tests := []struct {
+		name    string
+		read    int
+		decoded int
+		want    []byte
+	}{
+		{"nothing read", 0, 0, nil},
+		{"partial message", 3, 0, msgs[:3]},
+		{"one decoded", len(msgs), 1, msgs[14:]},
+		{"every message decoded", len(msgs), 3, nil},
+		{"empty body decoded", 19, 2, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := newMessageReader(bytes.NewReader(msgs))
+			buf := make([]byte, tt.read)
+			if _, err := mr.Read(buf); tt.read > 0 && err != nil {
+				t.Fatalf("Read() = %v", err)
+			}
+			for i := 0; i < tt.decoded; i++ {
+				mr.decoded()
+			}
+			if !bytes.Equal(mr.unread, tt.want) {
+				t.Errorf("unread = %v, want %v", mr.unread, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package conn
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// DefaultLocalQueries are the health check queries answered by the pool when
+// it is not configured otherwise.
+var DefaultLocalQueries = []string{
+	"SELECT 1",
+	"-- ping",
+}
+
+// LocalQueries maps the normalized queries answered by the pool without a
+// server to the integer they select. Queries without statements map to "".
+type LocalQueries map[string]string
+
+// ParseLocalQueries validates the queries to answer locally. Only queries
+// without statements, such as pgx's "-- ping", and queries selecting a single
+// integer constant are supported.
+func ParseLocalQueries(queries []string) (LocalQueries, error) {
+	lq := make(LocalQueries, len(queries))
+	for _, query := range queries {
+		norm := normalizeQuery(query)
+		if norm == "" {
+			lq[norm] = ""
+			continue
+		}
+
+		if !strings.HasPrefix(norm, "select ") {
+			return nil, fmt.Errorf("unsupported local query: %q", query)
+		}
+		value := strings.TrimPrefix(norm, "select ")
+		if _, err := strconv.ParseInt(value, 10, 32); err != nil {
+			return nil, fmt.Errorf("unsupported local query: %q", query)
+		}
+		lq[norm] = value
+	}
+
+	return lq, nil
+}
+
+// Answer answers the message on behalf of a server when possible, and reports
+// whether it did. The client must not be bound to a server: a lone Sync and
+// queries without statements are always answered, other queries when they
+// are configured.
+func (lq LocalQueries) Answer(c *Client, msg pgproto3.FrontendMessage) (bool, error) {
+	switch m := msg.(type) {
+	case *pgproto3.Sync:
+	case *pgproto3.Query:
+		norm := normalizeQuery(m.String)
+		value, ok := lq[norm]
+		if !ok && norm != "" {
+			return false, nil
+		}
+
+		if norm == "" {
+			c.backend.Send(&pgproto3.EmptyQueryResponse{})
+			break
+		}
+		c.backend.Send(&pgproto3.RowDescription{
+			Fields: []pgproto3.FieldDescription{{
+				Name:         []byte("?column?"),
+				DataTypeOID:  23, // int4
+				DataTypeSize: 4,
+				TypeModifier: -1,
+			}},
+		})
+		c.backend.Send(&pgproto3.DataRow{Values: [][]byte{[]byte(value)}})
+		c.backend.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+	default:
+		return false, nil
+	}
+
+	c.backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if err := c.backend.Flush(); err != nil {
+		return false, fmt.Errorf("send local answer: %w", err)
+	}
+
+	return true, nil
+}
+
+// normalizeQuery drops comments, empty statements and redundant white space of
+// the query, and turns it into lower case.
+func normalizeQuery(query string) string {
+	var stmts []string
+	for _, stmt := range splitStatements(query) {
+		if stmt := strings.Join(strings.Fields(stmt), " "); stmt != "" {
+			stmts = append(stmts, strings.ToLower(stmt))
+		}
+	}
+	return strings.Join(stmts, "; ")
+}
@@ -0,0 +1,160 @@
+package conn
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+func TestParseLocalQueries(t *testing.T) {
+	tests := []struct {
+		name    string
+		queries []string
+		want    LocalQueries
+		invalid bool
+	}{
+		{
+			name:    "defaults",
+			queries: DefaultLocalQueries,
+			want:    LocalQueries{"select 1": "1", "": ""},
+		},
+		{
+			name:    "normalized",
+			queries: []string{"  SELECT   42 ; ", "/* ping */"},
+			want:    LocalQueries{"select 42": "42", "": ""},
+		},
+		{
+			name:    "negative",
+			queries: []string{"SELECT -1"},
+			want:    LocalQueries{"select -1": "-1"},
+		},
+		{
+			name:    "not a select",
+			queries: []string{"SHOW server_version"},
+			invalid: true,
+		},
+		{
+			name:    "not an integer",
+			queries: []string{"SELECT 'ok'"},
+			invalid: true,
+		},
+		{
+			name:    "out of range",
+			queries: []string{"SELECT 4294967296"},
+			invalid: true,
+		},
+		{
+			name:    "several statements",
+			queries: []string{"SELECT 1; SELECT 2"},
+			invalid: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLocalQueries(tt.queries)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("ParseLocalQueries(%q) = %v, want an error", tt.queries, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseLocalQueries(%q) = %v", tt.queries, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseLocalQueries(%q) = %v, want %v", tt.queries, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalQueriesAnswer(t *testing.T) {
+	lq, err := ParseLocalQueries(DefaultLocalQueries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		msg  pgproto3.FrontendMessage
+		// want are the messages answered, nil if the message is not answered.
+		want []pgproto3.BackendMessage
+	}{
+		{
+			name: "configured query",
+			msg:  &pgproto3.Query{String: "select  1;"},
+			want: []pgproto3.BackendMessage{
+				&pgproto3.RowDescription{},
+				&pgproto3.DataRow{},
+				&pgproto3.CommandComplete{},
+				&pgproto3.ReadyForQuery{},
+			},
+		},
+		{
+			name: "empty query",
+			msg:  &pgproto3.Query{String: "-- ping"},
+			want: []pgproto3.BackendMessage{
+				&pgproto3.EmptyQueryResponse{},
+				&pgproto3.ReadyForQuery{},
+			},
+		},
+		{
+			name: "lone sync",
+			msg:  &pgproto3.Sync{},
+			want: []pgproto3.BackendMessage{
+				&pgproto3.ReadyForQuery{},
+			},
+		},
+		{
+			name: "other query",
+			msg:  &pgproto3.Query{String: "SELECT 2"},
+		},
+		{
+			name: "extended query",
+			msg:  &pgproto3.Parse{Query: "SELECT 1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lconn, rconn := net.Pipe()
+			defer lconn.Close()
+			defer rconn.Close()
+
+			type result struct {
+				answered bool
+				err      error
+			}
+			done := make(chan result, 1)
+			go func() {
+				answered, err := lq.Answer(NewClient(lconn, 1, nil), tt.msg)
+				done <- result{answered, err}
+			}()
+
+			frontend := pgproto3.NewFrontend(rconn, rconn)
+			for _, want := range tt.want {
+				got, err := frontend.Receive()
+				if err != nil {
+					t.Fatalf("receive answer: %v", err)
+				}
+				if reflect.TypeOf(got) != reflect.TypeOf(want) {
+					t.Fatalf("answer = %T, want %T", got, want)
+				}
+				if m, ok := got.(*pgproto3.DataRow); ok && string(m.Values[0]) != "1" {
+					t.Errorf("answered value = %q, want 1", m.Values[0])
+				}
+			}
+
+			res := <-done
+			if res.err != nil {
+				t.Fatalf("Answer() = %v", res.err)
+			}
+			if res.answered != (tt.want != nil) {
+				t.Errorf("Answer() = %v, want %v", res.answered, tt.want != nil)
+			}
+		})
+	}
+}
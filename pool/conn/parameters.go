@@ -0,0 +1,233 @@
+package conn
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// DefaultTrackedParameters are the parameters tracked per client when the pool
+// is not configured otherwise, similar to pgbouncer's defaults plus
+// track_extra_parameters.
+var DefaultTrackedParameters = []string{
+	"application_name",
+	"client_encoding",
+	"datestyle",
+	"intervalstyle",
+	"search_path",
+	"standard_conforming_strings",
+	"timezone",
+}
+
+// setParameter records a tracked parameter reported by the StartupMessage or a
+// ParameterStatus message.
+func (c *Client) setParameter(name, value string) {
+	name = strings.ToLower(name)
+	if _, ok := c.tracked[name]; ok {
+		c.params[name] = value
+	}
+}
+
+// setStartupParameters records the tracked parameters of the StartupMessage,
+// including the ones passed as command-line options.
+func (c *Client) setStartupParameters(params map[string]string) {
+	for name, value := range params {
+		if name == "options" {
+			for name, value := range parseOptions(value) {
+				c.setParameter(name, value)
+			}
+			continue
+		}
+		c.setParameter(name, value)
+	}
+}
+
+// ParamsID identifies the tracked parameters the client sets to other values
+// than the defaults of the server, 0 if it sets none. The server has the same
+// ID once they are applied to it. The BPF program binds the client the servers
+// with the same ID only, user space applies the parameters otherwise.
+func (c *Client) ParamsID(s *Server) uint32 {
+	return paramsID(c.params, s.defaults)
+}
+
+// ParamsID identifies the parameters of the server that differ from its
+// defaults, 0 if none does.
+func (s *Server) ParamsID() uint32 {
+	return paramsID(s.params, s.defaults)
+}
+
+// paramsID hashes the parameters that differ from the defaults, sorted by
+// name. 0 is left for the defaults.
+func paramsID(params, defaults map[string]string) uint32 {
+	names := make([]string, 0, len(params))
+	for name, value := range params {
+		if d, ok := defaults[name]; !ok || d != value {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return 0
+	}
+	sort.Strings(names)
+
+	h := fnv.New32a()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%s\x00", name, params[name])
+	}
+	if id := h.Sum32(); id != 0 {
+		return id
+	}
+	return 1
+}
+
+// parseOptions parses the "-c name=value" and "--name=value" switches of the
+// options startup parameter. Spaces are escaped by backslashes.
+func parseOptions(options string) map[string]string {
+	var (
+		args []string
+		b    strings.Builder
+	)
+	for i := 0; i < len(options); i++ {
+		switch c := options[i]; {
+		case c == '\\' && i+1 < len(options):
+			i++
+			b.WriteByte(options[i])
+		case c == ' ' || c == '\t':
+			if b.Len() > 0 {
+				args = append(args, b.String())
+				b.Reset()
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if b.Len() > 0 {
+		args = append(args, b.String())
+	}
+
+	params := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		var arg string
+		switch {
+		case args[i] == "-c" && i+1 < len(args):
+			i++
+			arg = args[i]
+		case strings.HasPrefix(args[i], "-c"):
+			arg = args[i][2:]
+		case strings.HasPrefix(args[i], "--"):
+			arg = args[i][2:]
+		default:
+			continue
+		}
+
+		if name, value, ok := strings.Cut(arg, "="); ok {
+			params[strings.ReplaceAll(name, "-", "_")] = value
+		}
+	}
+
+	return params
+}
+
+// isReplayed reports whether the pool restores the parameter when the client
+// moves to another server. Only parameters the server reports through
+// ParameterStatus can be followed after a SET, so a SET of search_path, which
+// Postgres reports from version 18 only, pins the client on older servers.
+func (p *Proxy) isReplayed(name string) bool {
+	name = strings.ToLower(name)
+	if _, ok := p.c.tracked[name]; !ok {
+		return false
+	}
+	_, ok := p.s.defaults[name]
+	return ok
+}
+
+// syncParameters applies the tracked parameters of the client that differ from
+// the current values of the server. Parameters the client never set are
+// restored to the server defaults.
+func (s *Server) syncParameters(c *Client) error {
+	// want maps the parameters to change to their new values, nil for RESET.
+	want := make(map[string]*string)
+	for name := range c.tracked {
+		value, ok := c.params[name]
+		if !ok {
+			value, ok = s.defaults[name]
+		}
+		cur, set := s.params[name]
+		switch {
+		case ok && (!set || cur != value):
+			want[name] = &value
+		case !ok && set:
+			want[name] = nil
+		}
+	}
+	if len(want) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(want))
+	for name := range want {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// set_config parses list parameters like search_path the same way SET does,
+	// while both arguments can be passed as literals.
+	var b strings.Builder
+	for _, name := range names {
+		if value := want[name]; value != nil {
+			fmt.Fprintf(&b, "SELECT pg_catalog.set_config(%s, %s, false);",
+				quoteLiteral(name), quoteLiteral(*value))
+		} else {
+			fmt.Fprintf(&b, "RESET %s;", quoteIdentifier(name))
+		}
+	}
+
+	s.frontend.Send(&pgproto3.Query{String: b.String()})
+	if err := s.frontend.Flush(); err != nil {
+		return fmt.Errorf("send parameters: %w", err)
+	}
+
+	var errResp *pgproto3.ErrorResponse
+	for {
+		msg, ok := <-s.ch
+		if !ok {
+			return ErrServerClosed
+		}
+
+		switch m := msg.(type) {
+		case *pgproto3.ParameterStatus:
+			s.params[strings.ToLower(m.Name)] = m.Value
+		case *pgproto3.ErrorResponse:
+			errResp = m
+		case *pgproto3.ReadyForQuery:
+			if errResp != nil {
+				return fmt.Errorf("set parameters: %s", errResp.Message)
+			}
+
+			// Not every parameter is reported back by the server.
+			for name, value := range want {
+				if value != nil {
+					s.params[name] = *value
+				} else {
+					delete(s.params, name)
+				}
+			}
+
+			log.Println("Synced parameters", names, "to server",
+				s.conn.LocalAddr(), "->", s.conn.RemoteAddr())
+			return nil
+		}
+	}
+}
+
+func quoteIdentifier(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
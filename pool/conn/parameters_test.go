@@ -0,0 +1,91 @@
+package conn
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		options string
+		want    map[string]string
+	}{
+		{"", map[string]string{}},
+		{"-c search_path=public", map[string]string{"search_path": "public"}},
+		{"-csearch_path=public", map[string]string{"search_path": "public"}},
+		{"--search_path=public", map[string]string{"search_path": "public"}},
+		{"--statement-timeout=5s", map[string]string{"statement_timeout": "5s"}},
+		{
+			"-c search_path=public -c timezone=UTC",
+			map[string]string{"search_path": "public", "timezone": "UTC"},
+		},
+		{"  -c\tdatestyle=ISO  ", map[string]string{"datestyle": "ISO"}},
+		{`-c application_name=my\ app`, map[string]string{"application_name": "my app"}},
+		{`-c search_path=a,\\b`, map[string]string{"search_path": `a,\b`}},
+		{"-c search_path=a -c search_path=b", map[string]string{"search_path": "b"}},
+		{"-c search_path", map[string]string{}},
+		{"-c", map[string]string{}},
+		{"-x search_path=public", map[string]string{}},
+		{"search_path=public", map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.options, func(t *testing.T) {
+			if got := parseOptions(tt.options); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseOptions(%q) = %v, want %v", tt.options, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetStartupParameters(t *testing.T) {
+	c := &Client{
+		tracked: map[string]struct{}{"search_path": {}, "timezone": {}, "application_name": {}},
+		params:  make(map[string]string),
+	}
+	c.setStartupParameters(map[string]string{
+		"user":             "postgres",
+		"Application_Name": "app",
+		"options":          "-c search_path=public -c work_mem=64MB",
+	})
+
+	want := map[string]string{"application_name": "app", "search_path": "public"}
+	if !reflect.DeepEqual(c.params, want) {
+		t.Errorf("params = %v, want %v", c.params, want)
+	}
+}
+
+func TestParamsID(t *testing.T) {
+	defaults := map[string]string{"application_name": "", "timezone": "UTC"}
+	s := &Server{params: map[string]string{"application_name": "", "timezone": "UTC"}, defaults: defaults}
+
+	client := func(params map[string]string) *Client {
+		return &Client{params: params}
+	}
+
+	if id := client(map[string]string{}).ParamsID(s); id != 0 {
+		t.Errorf("ParamsID() without parameters = %d, want 0", id)
+	}
+	if id := client(map[string]string{"timezone": "UTC"}).ParamsID(s); id != 0 {
+		t.Errorf("ParamsID() of the defaults = %d, want 0", id)
+	}
+	if id := s.ParamsID(); id != 0 {
+		t.Errorf("server ParamsID() = %d, want 0", id)
+	}
+
+	c := client(map[string]string{"application_name": "app", "search_path": "public"})
+	id := c.ParamsID(s)
+	if id == 0 {
+		t.Fatal("ParamsID() of other values = 0")
+	}
+	if other := client(map[string]string{"application_name": "other", "search_path": "public"}).ParamsID(s); other == id {
+		t.Errorf("ParamsID() of other values = %d, same as %v", other, c.params)
+	}
+
+	// The server has the ID of the client once its parameters are applied.
+	s.params["application_name"] = "app"
+	s.params["search_path"] = "public"
+	if got := s.ParamsID(); got != id {
+		t.Errorf("server ParamsID() = %d, want %d", got, id)
+	}
+}
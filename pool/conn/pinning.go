@@ -0,0 +1,326 @@
+package conn
+
+import (
+	"log"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+// PinPolicy decides what transaction mode does with statements that change
+// session state, which would otherwise be lost when the next transaction is
+// run on a different server.
+type PinPolicy string
+
+const (
+	// PinPolicyPin pins the client to its current server for the rest of the
+	// session.
+	PinPolicyPin PinPolicy = "pin"
+	// PinPolicyReject makes the server answer the statement with an error.
+	PinPolicyReject PinPolicy = "reject"
+	// PinPolicyNone forwards the statement as is.
+	PinPolicyNone PinPolicy = "none"
+)
+
+// rejectedStatementQuery replaces rejected statements, so that the server
+// raises the error itself and reports the correct transaction status, no
+// matter whether the message is proxied in user space or redirected by BPF.
+const rejectedStatementQuery = `DO $$ BEGIN RAISE EXCEPTION USING ` +
+	`ERRCODE = 'feature_not_supported', ` +
+	`MESSAGE = 'session state statements are not allowed in transaction pooling mode'; END $$`
+
+// applyPinPolicy applies the pin policy to Query and Parse messages carrying
+// session state statements, rewriting the message in place when the statement
+// is rejected. SET of the parameters for which replayed returns true does not
+// count, replayed may be nil. It reports whether the client has just been
+// pinned.
+func (c *Client) applyPinPolicy(
+	msg pgproto3.FrontendMessage,
+	policy PinPolicy,
+	replayed func(name string) bool,
+) bool {
+	if c.pinned || policy == PinPolicyNone {
+		return false
+	}
+
+	switch m := msg.(type) {
+	case *pgproto3.Query:
+		if !isSessionStatement(m.String, replayed) {
+			return false
+		}
+		if policy == PinPolicyReject {
+			m.String = rejectedStatementQuery
+			return false
+		}
+	case *pgproto3.Parse:
+		if !isSessionStatement(m.Query, replayed) {
+			return false
+		}
+		if policy == PinPolicyReject {
+			m.Query = rejectedStatementQuery
+			m.ParameterOIDs = nil
+			return false
+		}
+	default:
+		return false
+	}
+
+	c.pinned = true
+	log.Println("Pinned client to its server:",
+		c.remoteAddr, "->", c.conn.LocalAddr())
+	return true
+}
+
+// Pinned reports whether the client changed session state, which its server
+// keeps until it is reset.
+func (c *Client) Pinned() bool {
+	return c.pinned
+}
+
+// isSessionStatement reports whether any statement in the query changes
+// session state: SET without LOCAL, set_config not local to the transaction,
+// LISTEN, temporary objects, session level advisory locks and SQL level
+// PREPARE. SET of the parameters for which replayed returns true is not
+// reported. Comments and literals are not matched.
+func isSessionStatement(query string, replayed func(name string) bool) bool {
+	for _, stmt := range splitStatements(query) {
+		stmt = strings.ToLower(stripLiterals(stmt))
+
+		if strings.Contains(stmt, "advisory_lock") || hasSessionSetConfig(stmt) {
+			return true
+		}
+
+		fields := strings.Fields(stmt)
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "set":
+			if fields[1] == "local" || fields[1] == "transaction" {
+				continue
+			}
+			if replayed != nil && replayed(setParameterName(fields[1:])) {
+				continue
+			}
+			return true
+		case "listen":
+			return true
+		case "prepare":
+			if fields[1] != "transaction" {
+				return true
+			}
+		case "create":
+			if fields[1] == "temp" || fields[1] == "temporary" {
+				return true
+			}
+			if len(fields) > 2 && (fields[1] == "global" || fields[1] == "local") &&
+				(fields[2] == "temp" || fields[2] == "temporary") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// setParameterName returns the parameter name of the fields following SET.
+func setParameterName(fields []string) string {
+	if fields[0] == "session" && len(fields) > 1 {
+		fields = fields[1:]
+	}
+	if fields[0] == "time" && len(fields) > 1 && fields[1] == "zone" {
+		return "timezone"
+	}
+	name, _, _ := strings.Cut(fields[0], "=")
+	return name
+}
+
+// hasSessionSetConfig reports whether the statement calls set_config with
+// is_local other than true, which keeps the setting for the session.
+func hasSessionSetConfig(stmt string) bool {
+	for {
+		i := strings.Index(stmt, "set_config")
+		if i < 0 {
+			return false
+		}
+		stmt = strings.TrimLeft(stmt[i+len("set_config"):], " \t\r\n")
+		if !strings.HasPrefix(stmt, "(") {
+			continue
+		}
+
+		args, depth := []string{""}, 0
+	scan:
+		for _, c := range stmt[1:] {
+			switch {
+			case c == '(':
+				depth++
+			case c == ')' && depth == 0:
+				break scan
+			case c == ')':
+				depth--
+			case c == ',' && depth == 0:
+				args = append(args, "")
+				continue
+			}
+			args[len(args)-1] += string(c)
+		}
+		if len(args) != 3 || strings.TrimSpace(args[2]) != "true" {
+			return true
+		}
+	}
+}
+
+// stripLiterals empties the string literals and the dollar-quoted strings of
+// the statement, so that their contents are not matched as SQL.
+func stripLiterals(stmt string) string {
+	var b strings.Builder
+	for i := 0; i < len(stmt); i++ {
+		c := stmt[i]
+
+		switch {
+		case c == '\'':
+			end := literalEnd(stmt, i)
+			if end < 0 {
+				end = len(stmt) - 1
+			}
+			b.WriteString("''")
+			i = end
+		case c == '"':
+			end := strings.IndexByte(stmt[i+1:], c)
+			if end < 0 {
+				b.WriteString(stmt[i:])
+				return b.String()
+			}
+			b.WriteString(stmt[i : i+end+2])
+			i += end + 1
+		case c == '$':
+			tag := dollarQuoteTag(stmt[i:])
+			if tag == "" {
+				b.WriteByte(c)
+				continue
+			}
+			end := strings.Index(stmt[i+len(tag):], tag)
+			if end < 0 {
+				end = len(stmt) - i - 2*len(tag)
+			}
+			b.WriteString("''")
+			i += 2*len(tag) + end - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// literalEnd returns the index of the quote closing the string literal opened
+// at query[i], or -1 if it is not closed. Backslashes escape the next byte in
+// the escape strings, E'...'.
+func literalEnd(query string, i int) int {
+	escapes := i > 0 && (query[i-1] == 'e' || query[i-1] == 'E') &&
+		(i == 1 || !isIdentByte(query[i-2]))
+	for j := i + 1; j < len(query); j++ {
+		switch {
+		case escapes && query[j] == '\\':
+			j++
+		case query[j] == '\'':
+			return j
+		}
+	}
+	return -1
+}
+
+// isIdentByte reports whether c may be part of an unquoted identifier.
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// splitStatements splits a query string into statements. Comments are
+// dropped, and semicolons inside quoted identifiers, string literals and
+// dollar-quoted strings do not end a statement.
+func splitStatements(query string) []string {
+	var (
+		stmts []string
+		b     strings.Builder
+	)
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+
+		switch {
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end
+			}
+			b.WriteByte(' ')
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 3
+			}
+			b.WriteByte(' ')
+		case c == '\'':
+			end := literalEnd(query, i)
+			if end < 0 {
+				b.WriteString(query[i:])
+				i = len(query)
+				continue
+			}
+			b.WriteString(query[i : end+1])
+			i = end
+		case c == '"':
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				b.WriteString(query[i:])
+				i = len(query)
+				continue
+			}
+			b.WriteString(query[i : i+end+2])
+			i += end + 1
+		case c == '$':
+			tag := dollarQuoteTag(query[i:])
+			if tag == "" {
+				b.WriteByte(c)
+				continue
+			}
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				b.WriteString(query[i:])
+				i = len(query)
+				continue
+			}
+			n := 2*len(tag) + end
+			b.WriteString(query[i : i+n])
+			i += n - 1
+		case c == ';':
+			stmts = append(stmts, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return append(stmts, b.String())
+}
+
+// dollarQuoteTag returns the opening tag, such as "$$" or "$body$", if s
+// starts with one.
+func dollarQuoteTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if c == '$' {
+			return s[:i+1]
+		}
+		if !(c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' ||
+			i > 1 && '0' <= c && c <= '9') {
+			return ""
+		}
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+package conn
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+func TestIsSessionStatement(t *testing.T) {
+	replayed := func(name string) bool { return name == "search_path" || name == "timezone" }
+
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"SELECT 1", false},
+		{"SET statement_timeout = 0", true},
+		{"set SESSION statement_timeout to 0", true},
+		{"SET LOCAL statement_timeout = 0", false},
+		{"SET TRANSACTION ISOLATION LEVEL SERIALIZABLE", false},
+		{"SET search_path = public", false},
+		{"SET search_path='a;b'", false},
+		{"SET SESSION search_path TO public", false},
+		{"SET TIME ZONE 'UTC'", false},
+		{"LISTEN channel", true},
+		{"PREPARE stmt AS SELECT 1", true},
+		{"PREPARE TRANSACTION 'tx'", false},
+		{"CREATE TEMP TABLE t (id int)", true},
+		{"CREATE TEMPORARY TABLE t (id int)", true},
+		{"CREATE GLOBAL TEMPORARY TABLE t (id int)", true},
+		{"CREATE TABLE t (id int)", false},
+		{"SELECT pg_advisory_lock(1)", true},
+		{"SELECT pg_try_advisory_lock(1)", true},
+		{"SELECT pg_advisory_xact_lock(1)", false},
+		{"SELECT set_config('statement_timeout', '0', false)", true},
+		{"SELECT set_config('statement_timeout', '0', true)", false},
+		{"SELECT set_config('statement_timeout', '0', $1)", true},
+		{"SELECT set_config('statement_timeout', lower('0'), TRUE)", false},
+		{"SELECT 1; SET statement_timeout = 0", true},
+		{"BEGIN; SET LOCAL statement_timeout = 0; COMMIT", false},
+		// literals and comments are not matched
+		{"SELECT 'pg_advisory_lock(1)'", false},
+		{"SELECT 'it''s; LISTEN channel'", false},
+		{`SELECT E'it\'s; LISTEN channel'`, false},
+		{"SELECT $$; LISTEN channel$$", false},
+		{"SELECT $body$ SET statement_timeout = 0 $body$", false},
+		{"SELECT 1 -- SET statement_timeout = 0", false},
+		{"/* LISTEN channel; */ SELECT 1", false},
+		{`SELECT "pg_advisory_lock"`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := isSessionStatement(tt.query, replayed); got != tt.want {
+				t.Errorf("isSessionStatement(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"SELECT 1", []string{"SELECT 1"}},
+		{"SELECT 1; SELECT 2", []string{"SELECT 1", " SELECT 2"}},
+		{"SELECT 1;", []string{"SELECT 1", ""}},
+		{"SELECT ';'", []string{"SELECT ';'"}},
+		{`SELECT ";"`, []string{`SELECT ";"`}},
+		{`SELECT E'\';'; SELECT 2`, []string{`SELECT E'\';'`, " SELECT 2"}},
+		{"SELECT $$;$$; SELECT 2", []string{"SELECT $$;$$", " SELECT 2"}},
+		{"SELECT $1; SELECT 2", []string{"SELECT $1", " SELECT 2"}},
+		{"SELECT 1 -- ;\nFROM t", []string{"SELECT 1  FROM t"}},
+		{"SELECT /* ; */ 1", []string{"SELECT   1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := splitStatements(tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitStatements(%q) = %q, want %q", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyPinPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy PinPolicy
+		msg    pgproto3.FrontendMessage
+		pinned bool
+		// query is the query of the message once the policy is applied.
+		query string
+	}{
+		{
+			name:   "pin query",
+			policy: PinPolicyPin,
+			msg:    &pgproto3.Query{String: "LISTEN channel"},
+			pinned: true,
+			query:  "LISTEN channel",
+		},
+		{
+			name:   "pin parse",
+			policy: PinPolicyPin,
+			msg:    &pgproto3.Parse{Query: "SELECT pg_advisory_lock($1)"},
+			pinned: true,
+			query:  "SELECT pg_advisory_lock($1)",
+		},
+		{
+			name:   "reject query",
+			policy: PinPolicyReject,
+			msg:    &pgproto3.Query{String: "LISTEN channel"},
+			query:  rejectedStatementQuery,
+		},
+		{
+			name:   "reject parse",
+			policy: PinPolicyReject,
+			msg:    &pgproto3.Parse{Query: "LISTEN channel"},
+			query:  rejectedStatementQuery,
+		},
+		{
+			name:   "none",
+			policy: PinPolicyNone,
+			msg:    &pgproto3.Query{String: "LISTEN channel"},
+			query:  "LISTEN channel",
+		},
+		{
+			name:   "no session state",
+			policy: PinPolicyPin,
+			msg:    &pgproto3.Query{String: "SELECT 1"},
+			query:  "SELECT 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lconn, rconn := net.Pipe()
+			defer lconn.Close()
+			defer rconn.Close()
+
+			c := NewClient(lconn, 1, nil)
+			if got := c.applyPinPolicy(tt.msg, tt.policy, nil); got != tt.pinned {
+				t.Errorf("applyPinPolicy() = %v, want %v", got, tt.pinned)
+			}
+			if c.Pinned() != tt.pinned {
+				t.Errorf("Pinned() = %v, want %v", c.Pinned(), tt.pinned)
+			}
+
+			var query string
+			switch m := tt.msg.(type) {
+			case *pgproto3.Query:
+				query = m.String
+			case *pgproto3.Parse:
+				query = m.Query
+			}
+			if query != tt.query {
+				t.Errorf("query = %q, want %q", query, tt.query)
+			}
+		})
+	}
+}
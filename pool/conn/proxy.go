@@ -3,6 +3,8 @@ package conn
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgproto3"
 )
@@ -17,82 +19,89 @@ var (
 const maxIdentifierLength = 63
 
 type Proxy struct {
-	s      *Server
-	c      *Client
-	txMode bool
+	s         *Server
+	c         *Client
+	txMode    bool
+	pinPolicy PinPolicy
+	timeouts  Timeouts
+	// synced indicates whether the client parameters have been applied to the
+	// server.
+	synced bool
+	// running indicates whether the server is processing a query, that is,
+	// whether a ReadyForQuery is expected.
+	running bool
+	// txStatus is the transaction status of the last ReadyForQuery.
+	txStatus byte
+	// since is the time the proxy entered its current state.
+	since time.Time
+	// cancelled is the time the running query was cancelled, for running past
+	// the query timeout.
+	cancelled time.Time
+	// draining indicates whether the client is to give up the server once its
+	// transaction completes.
+	draining bool
 }
 
-func NewProxy(s *Server, c *Client, txMode bool) *Proxy {
+func NewProxy(s *Server, c *Client, txMode bool, pinPolicy PinPolicy, timeouts Timeouts) *Proxy {
 	return &Proxy{
-		s:      s,
-		c:      c,
-		txMode: txMode,
+		s:         s,
+		c:         c,
+		txMode:    txMode,
+		pinPolicy: pinPolicy,
+		timeouts:  timeouts,
+		txStatus:  'I',
+		since:     time.Now(),
 	}
 }
 
-func (p *Proxy) Start() error {
+// Start proxies the messages between the client and the server, beginning
+// with first if it is not nil.
+func (p *Proxy) Start(first pgproto3.FrontendMessage) error {
+	p.c.server.Store(p.s)
+	defer p.c.server.Store(nil)
+
+	if first != nil {
+		if err := p.handleClientMessage(first); err != nil {
+			return err
+		}
+	}
+
 	for {
+		var (
+			timer    *time.Timer
+			timeoutC <-chan time.Time
+		)
+		left, timeoutErr := p.timeout()
+		if timeoutErr != nil {
+			timer = time.NewTimer(left)
+			timeoutC = timer.C
+		}
+		var drainC <-chan struct{}
+		if !p.draining {
+			drainC = p.c.drain
+		}
+
 		select {
 		case msg, ok := <-p.c.ch:
 			if !ok {
-				return ErrClientClosed
-			}
-
-			// don't send Terminate to the server
-			if _, ok := msg.(*pgproto3.Terminate); ok {
-				return ErrClientTerminated
-			}
-
-			if p.txMode {
-				switch m := msg.(type) {
-				// We handle Parse messages to transform the name of the prepared
-				// statement.
-				case *pgproto3.Parse:
-					// We'll mark the statement as prepared in the current session even
-					// though we don't know if the Parse message will succeed.
-					//
-					// We can store `stmt` in the server state and mark it as prepared
-					// after we receive ParseComplete message from the server for sake
-					// of correctly handling the error case.
-					//
-					// However, we'll just keep it simple here and assume that the Parse
-					// message will always succeed for now.
-					p.s.prepared[m.Name] = struct{}{}
-					p.c.prepared[m.Name] = m.Query
-
-				// We handle Bind messages to transform the name of the prepared
-				// statement, as well as to inject Parse messages before Bind if it
-				// hasn't been prepared in the current session.
-				case *pgproto3.Bind:
-					if _, ok := p.s.prepared[m.PreparedStatement]; !ok {
-						msg := &pgproto3.Parse{
-							Name:  m.PreparedStatement,
-							Query: p.c.prepared[m.PreparedStatement],
-						}
-						// log.Printf("Send message to server: %T(%+v)", msg, msg)
-						p.s.frontend.Send(msg)
-						p.s.prepared[m.PreparedStatement] = struct{}{}
-					}
-				}
+				return p.abort(ErrClientClosed)
 			}
 
-			isPendingExtendedQueryMessages := false
-			switch msg.(type) {
-			case *pgproto3.Parse, *pgproto3.Describe, *pgproto3.Bind, *pgproto3.Execute:
-				isPendingExtendedQueryMessages = true
-			}
-
-			p.s.frontend.Send(msg)
-			if !isPendingExtendedQueryMessages {
-				if err := p.s.frontend.Flush(); err != nil {
-					return fmt.Errorf("send message to server: %w", err)
-				}
+			if err := p.handleClientMessage(msg); err != nil {
+				return err
 			}
 		case msg, ok := <-p.s.ch:
 			if !ok {
 				return ErrServerClosed
 			}
 
+			// Follow the parameters changed by the client, so that they can be
+			// applied to the next server.
+			if m, ok := msg.(*pgproto3.ParameterStatus); ok {
+				p.s.params[strings.ToLower(m.Name)] = m.Value
+				p.c.setParameter(m.Name, m.Value)
+			}
+
 			isReadyForQuery := false
 			isReadyForQueryIdle := false
 			if m, ok := msg.(*pgproto3.ReadyForQuery); ok {
@@ -100,6 +109,16 @@ func (p *Proxy) Start() error {
 				if m.TxStatus == 'I' {
 					isReadyForQueryIdle = true
 				}
+
+				p.running = false
+				p.txStatus = m.TxStatus
+				p.since = time.Now()
+				p.cancelled = time.Time{}
+			}
+
+			// Tell the client why its query was cancelled.
+			if m, ok := msg.(*pgproto3.ErrorResponse); ok && m.Code == "57014" && !p.cancelled.IsZero() {
+				m.Message = "canceling statement due to query timeout"
 			}
 
 			// We buffer as much as possible, until ReadyForQuery
@@ -113,9 +132,109 @@ func (p *Proxy) Start() error {
 				}
 			}
 
-			if p.txMode && isReadyForQueryIdle {
+			// A pinned client keeps the server until it terminates.
+			if p.txMode && isReadyForQueryIdle && !p.c.pinned {
 				return ErrServerTxComplete
 			}
+
+			// A drained client gives up the server once its transaction
+			// completes.
+			if p.draining && isReadyForQueryIdle {
+				return p.leave()
+			}
+		case <-timeoutC:
+			if !errors.Is(timeoutErr, ErrQueryTimeout) {
+				return p.abort(timeoutErr)
+			}
+
+			if err := p.cancel(); err != nil {
+				return err
+			}
+		case <-drainC:
+			p.draining = true
+			if !p.running && p.txStatus == 'I' {
+				return p.leave()
+			}
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (p *Proxy) handleClientMessage(msg pgproto3.FrontendMessage) error {
+	// don't send Terminate to the server
+	if _, ok := msg.(*pgproto3.Terminate); ok {
+		return ErrClientTerminated
+	}
+
+	// The parameters are applied lazily, once the client actually uses the
+	// server.
+	if !p.synced {
+		if err := p.s.syncParameters(p.c); err != nil {
+			return fmt.Errorf("sync parameters: %w", err)
+		}
+		p.synced = true
+	}
+
+	if p.txMode {
+		p.c.applyPinPolicy(msg, p.pinPolicy, p.isReplayed)
+
+		switch m := msg.(type) {
+		// We handle Parse messages to transform the name of the prepared
+		// statement.
+		case *pgproto3.Parse:
+			// We'll mark the statement as prepared in the current session even
+			// though we don't know if the Parse message will succeed.
+			//
+			// We can store `stmt` in the server state and mark it as prepared
+			// after we receive ParseComplete message from the server for sake
+			// of correctly handling the error case.
+			//
+			// However, we'll just keep it simple here and assume that the Parse
+			// message will always succeed for now.
+			p.s.prepared[m.Name] = struct{}{}
+			p.c.prepared[m.Name] = m.Query
+
+		// We handle Bind messages to transform the name of the prepared
+		// statement, as well as to inject Parse messages before Bind if it
+		// hasn't been prepared in the current session.
+		case *pgproto3.Bind:
+			if _, ok := p.s.prepared[m.PreparedStatement]; !ok {
+				msg := &pgproto3.Parse{
+					Name:  m.PreparedStatement,
+					Query: p.c.prepared[m.PreparedStatement],
+				}
+				// log.Printf("Send message to server: %T(%+v)", msg, msg)
+				p.s.frontend.Send(msg)
+				p.s.prepared[m.PreparedStatement] = struct{}{}
+			}
+		}
+	}
+
+	isPendingExtendedQueryMessages := false
+	switch msg.(type) {
+	case *pgproto3.Parse, *pgproto3.Describe, *pgproto3.Bind, *pgproto3.Execute:
+		isPendingExtendedQueryMessages = true
+	}
+
+	p.s.frontend.Send(msg)
+	if !isPendingExtendedQueryMessages {
+		if err := p.s.frontend.Flush(); err != nil {
+			return fmt.Errorf("send message to server: %w", err)
+		}
+	}
+
+	// The idle timeouts restart on every client message, the query timeout
+	// runs from the message the server answers with ReadyForQuery.
+	if !p.running {
+		switch msg.(type) {
+		case *pgproto3.Query, *pgproto3.Sync, *pgproto3.FunctionCall:
+			p.running = true
 		}
+		p.since = time.Now()
 	}
+
+	return nil
 }
@@ -0,0 +1,161 @@
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxProxyV1HeaderLength is the longest PROXY protocol v1 header, including
+	// the CRLF.
+	maxProxyV1HeaderLength = 107
+
+	proxyV2CommandLocal = 0x0
+	proxyV2FamilyTCP4   = 0x11
+	proxyV2FamilyTCP6   = 0x21
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeaderTimeout is the time the balancer has to send the PROXY protocol
+// header, so that a connection sending nothing does not hold a goroutine.
+var proxyHeaderTimeout = 5 * time.Second
+
+var errInvalidProxyHeader = errors.New("invalid proxy header")
+
+// ReadProxyHeader reads the PROXY protocol v1 or v2 header a load balancer
+// sends before the startup packets, and takes the client address from it. The
+// address of the balancer is kept when the header carries none. Exactly the
+// header is read from the connection, within proxyHeaderTimeout.
+func (c *Client) ReadProxyHeader() error {
+	if err := c.conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return fmt.Errorf("set read deadline: %w", err)
+	}
+
+	var first [1]byte
+	if _, err := io.ReadFull(c.conn, first[:]); err != nil {
+		return fmt.Errorf("read proxy header: %w", err)
+	}
+
+	var (
+		addr net.Addr
+		err  error
+	)
+	switch first[0] {
+	case 'P':
+		addr, err = c.readProxyV1Header()
+	case proxyV2Signature[0]:
+		addr, err = c.readProxyV2Header()
+	default:
+		return errors.New("missing proxy header")
+	}
+	if err != nil {
+		return err
+	}
+
+	// The startup packets are read without a deadline.
+	if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("clear read deadline: %w", err)
+	}
+
+	if addr != nil {
+		log.Println("Client", c.conn.RemoteAddr(), "is proxied for", addr)
+		c.remoteAddr = addr
+	}
+	return nil
+}
+
+// readProxyV1Header reads the human-readable header, past its first byte:
+//
+//	PROXY TCP4 192.168.0.1 192.168.0.11 56324 6432\r\n
+func (c *Client) readProxyV1Header() (net.Addr, error) {
+	line := []byte{'P'}
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyV1HeaderLength {
+			return nil, fmt.Errorf("%w: v1 header too long", errInvalidProxyHeader)
+		}
+
+		var b [1]byte
+		if _, err := io.ReadFull(c.conn, b[:]); err != nil {
+			return nil, fmt.Errorf("read proxy header: %w", err)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("%w: %q", errInvalidProxyHeader, line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("%w: %q", errInvalidProxyHeader, line)
+		}
+		ip := net.ParseIP(fields[2])
+		port, err := strconv.ParseUint(fields[4], 10, 16)
+		if ip == nil || err != nil {
+			return nil, fmt.Errorf("%w: %q", errInvalidProxyHeader, line)
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown protocol %q", errInvalidProxyHeader, fields[1])
+}
+
+// readProxyV2Header reads the binary header, past its first byte.
+func (c *Client) readProxyV2Header() (net.Addr, error) {
+	hdr := make([]byte, 16)
+	hdr[0] = proxyV2Signature[0]
+	if _, err := io.ReadFull(c.conn, hdr[1:]); err != nil {
+		return nil, fmt.Errorf("read proxy header: %w", err)
+	}
+	if !bytes.Equal(hdr[:len(proxyV2Signature)], proxyV2Signature) {
+		return nil, fmt.Errorf("%w: bad v2 signature", errInvalidProxyHeader)
+	}
+	if version := hdr[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", errInvalidProxyHeader, version)
+	}
+
+	// The addresses are followed by TLVs, which are skipped.
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		return nil, fmt.Errorf("read proxy header: %w", err)
+	}
+
+	// The health checks of the balancer itself carry no address.
+	if hdr[12]&0x0F == proxyV2CommandLocal {
+		return nil, nil
+	}
+
+	switch hdr[13] {
+	case proxyV2FamilyTCP4:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short v2 addresses", errInvalidProxyHeader)
+		}
+		return &net.TCPAddr{
+			IP:   append(net.IP(nil), body[0:4]...),
+			Port: int(binary.BigEndian.Uint16(body[8:])),
+		}, nil
+	case proxyV2FamilyTCP6:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short v2 addresses", errInvalidProxyHeader)
+		}
+		return &net.TCPAddr{
+			IP:   append(net.IP(nil), body[0:16]...),
+			Port: int(binary.BigEndian.Uint16(body[32:])),
+		}, nil
+	}
+
+	// Other families, such as Unix sockets, have no address worth keeping.
+	return nil, nil
+}
@@ -0,0 +1,198 @@
+package conn
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(command, family byte, addrs []byte) []byte {
+	hdr := append([]byte(nil), proxyV2Signature...)
+	hdr = append(hdr, 0x20|command, family)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tcp4 := []byte{
+		192, 168, 0, 1, // source address
+		192, 168, 0, 11, // destination address
+		0xdc, 0x04, // source port 56324
+		0x19, 0x20, // destination port 6432
+	}
+	tcp6 := make([]byte, 36)
+	copy(tcp6, net.ParseIP("2001:db8::1"))
+	copy(tcp6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(tcp6[32:], 56324)
+	binary.BigEndian.PutUint16(tcp6[34:], 6432)
+
+	tests := []struct {
+		name   string
+		header []byte
+		// addr is the expected client address, empty to keep the balancer's.
+		addr    string
+		invalid bool
+	}{
+		{
+			name:   "v1 tcp4",
+			header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 6432\r\n"),
+			addr:   "192.168.0.1:56324",
+		},
+		{
+			name:   "v1 tcp6",
+			header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 6432\r\n"),
+			addr:   "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v1 unknown",
+			header: []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			name:    "v1 missing fields",
+			header:  []byte("PROXY TCP4 192.168.0.1\r\n"),
+			invalid: true,
+		},
+		{
+			name:    "v1 bad address",
+			header:  []byte("PROXY TCP4 192.168.0 192.168.0.11 56324 6432\r\n"),
+			invalid: true,
+		},
+		{
+			name:    "v1 bad port",
+			header:  []byte("PROXY TCP4 192.168.0.1 192.168.0.11 65536 6432\r\n"),
+			invalid: true,
+		},
+		{
+			name:    "v1 unknown protocol",
+			header:  []byte("PROXY UDP4 192.168.0.1 192.168.0.11 56324 6432\r\n"),
+			invalid: true,
+		},
+		{
+			name:   "v2 tcp4",
+			header: proxyV2Header(0x1, proxyV2FamilyTCP4, tcp4),
+			addr:   "192.168.0.1:56324",
+		},
+		{
+			name:   "v2 tcp6",
+			header: proxyV2Header(0x1, proxyV2FamilyTCP6, tcp6),
+			addr:   "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v2 tcp4 with tlvs",
+			header: proxyV2Header(0x1, proxyV2FamilyTCP4, append(tcp4, 0x04, 0x00, 0x01, 0x00)),
+			addr:   "192.168.0.1:56324",
+		},
+		{
+			name:   "v2 local",
+			header: proxyV2Header(proxyV2CommandLocal, 0x00, nil),
+		},
+		{
+			name:   "v2 unix",
+			header: proxyV2Header(0x1, 0x31, make([]byte, 216)),
+		},
+		{
+			name:    "v2 short addresses",
+			header:  proxyV2Header(0x1, proxyV2FamilyTCP4, tcp4[:8]),
+			invalid: true,
+		},
+		{
+			name: "v2 bad version",
+			header: func() []byte {
+				hdr := proxyV2Header(0x1, proxyV2FamilyTCP4, tcp4)
+				hdr[12] = 0x11
+				return hdr
+			}(),
+			invalid: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lconn, rconn := net.Pipe()
+			defer lconn.Close()
+			defer rconn.Close()
+
+			// The startup packet follows the header.
+			next := []byte{0, 0, 0, 8}
+			go rconn.Write(append(append([]byte(nil), tt.header...), next...))
+
+			c := NewClient(lconn, 1, nil)
+			err := c.ReadProxyHeader()
+			if tt.invalid {
+				if !errors.Is(err, errInvalidProxyHeader) {
+					t.Fatalf("ReadProxyHeader() = %v, want %v", err, errInvalidProxyHeader)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadProxyHeader() = %v", err)
+			}
+
+			want := lconn.RemoteAddr().String()
+			if tt.addr != "" {
+				want = tt.addr
+			}
+			if got := c.remoteAddr.String(); got != want {
+				t.Errorf("remote address = %s, want %s", got, want)
+			}
+
+			// Exactly the header is read.
+			got := make([]byte, len(next))
+			if _, err := io.ReadFull(lconn, got); err != nil {
+				t.Fatalf("read after header: %v", err)
+			}
+			if string(got) != string(next) {
+				t.Errorf("read after header = %v, want %v", got, next)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderMissing(t *testing.T) {
+	lconn, rconn := net.Pipe()
+	defer lconn.Close()
+	defer rconn.Close()
+
+	go rconn.Write([]byte{0, 0, 0, 8})
+
+	if err := NewClient(lconn, 1, nil).ReadProxyHeader(); err == nil {
+		t.Fatal("ReadProxyHeader() = nil, want an error")
+	}
+}
+
+func TestReadProxyHeaderTimeout(t *testing.T) {
+	defer func(d time.Duration) { proxyHeaderTimeout = d }(proxyHeaderTimeout)
+	proxyHeaderTimeout = 50 * time.Millisecond
+
+	// A connection sending nothing is given up.
+	lconn, rconn := net.Pipe()
+	defer lconn.Close()
+	defer rconn.Close()
+
+	if err := NewClient(lconn, 1, nil).ReadProxyHeader(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("ReadProxyHeader() = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	// The deadline is cleared once the header is read.
+	lconn, rconn = net.Pipe()
+	defer lconn.Close()
+	defer rconn.Close()
+
+	go rconn.Write([]byte("PROXY UNKNOWN\r\n"))
+	if err := NewClient(lconn, 1, nil).ReadProxyHeader(); err != nil {
+		t.Fatalf("ReadProxyHeader() = %v", err)
+	}
+
+	go func() {
+		time.Sleep(2 * proxyHeaderTimeout)
+		rconn.Write([]byte{0, 0, 0, 8})
+	}()
+	var next [4]byte
+	if _, err := io.ReadFull(lconn, next[:]); err != nil {
+		t.Fatalf("read after header: %v", err)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"strings"
 
 	"github.com/jackc/pgx/v5/pgproto3"
 )
@@ -20,21 +22,43 @@ var startupMessage = &pgproto3.StartupMessage{
 type Server struct {
 	conn     net.Conn
 	frontend *pgproto3.Frontend
+	// reader is the reader of the frontend, which keeps the bytes of the
+	// message being received for the handoff.
+	reader   *messageReader
 	ch       chan pgproto3.BackendMessage
 	done     chan struct{}
+	closed   chan struct{}
 	prepared map[string]struct{}
+	// params maps the parameters to their current values on the server.
+	params map[string]string
+	// processID and secretKey are the BackendKeyData of the server.
+	processID uint32
+	secretKey uint32
+	// defaults maps the parameters reported by the server on startup to their
+	// initial values.
+	defaults map[string]string
 }
 
 func NewServer(conn net.Conn) *Server {
+	reader := newMessageReader(conn)
 	return &Server{
 		conn:     conn,
-		frontend: pgproto3.NewFrontend(conn, conn),
+		frontend: pgproto3.NewFrontend(reader, conn),
+		reader:   reader,
 		ch:       make(chan pgproto3.BackendMessage),
 		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
 		prepared: make(map[string]struct{}),
+		params:   make(map[string]string),
+		defaults: make(map[string]string),
 	}
 }
 
+// Conn returns the connection to the server.
+func (s *Server) Conn() net.Conn {
+	return s.conn
+}
+
 func (s *Server) Setup() error {
 	s.frontend.Send(startupMessage)
 	if err := s.frontend.Flush(); err != nil {
@@ -50,7 +74,24 @@ func (s *Server) Setup() error {
 		if err != nil {
 			return fmt.Errorf("receive message: %w", err)
 		}
+		s.reader.decoded()
+
+		switch m := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			return fmt.Errorf("server error: %s (SQLSTATE %s)", m.Message, m.Code)
+		case *pgproto3.AuthenticationOk:
+		case pgproto3.AuthenticationResponseMessage:
+			return fmt.Errorf("unsupported authentication request %T, the server must trust the pool", m)
+		}
 
+		if m, ok := msg.(*pgproto3.BackendKeyData); ok {
+			s.processID = m.ProcessID
+			s.secretKey = m.SecretKey
+		}
+		if m, ok := msg.(*pgproto3.ParameterStatus); ok {
+			s.params[strings.ToLower(m.Name)] = m.Value
+			s.defaults[strings.ToLower(m.Name)] = m.Value
+		}
 		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
 			break
 		}
@@ -70,18 +111,34 @@ func (s *Server) LoopReceive() {
 	for {
 		msg, err := s.frontend.Receive()
 		if err != nil {
-			if !errors.Is(err, net.ErrClosed) {
+			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
 				log.Println("Failed to receive message from the server:", err)
 			}
 			return
 		}
-		s.ch <- msg
+		s.reader.decoded()
+
+		// Nobody may be reading anymore once the server is closed.
+		select {
+		case s.ch <- msg:
+		case <-s.closed:
+			return
+		}
 	}
 }
 
 func (s *Server) Close() error {
 	log.Println("Closing server connection:",
 		s.conn.LocalAddr(), "->", s.conn.RemoteAddr())
+
+	// End the session cleanly, rather than having the server log an
+	// unexpected EOF.
+	s.frontend.Send(&pgproto3.Terminate{})
+	if err := s.frontend.Flush(); err != nil {
+		log.Println("Failed to send terminate to the server:", err)
+	}
+
+	close(s.closed)
 	if err := s.conn.Close(); err != nil {
 		return fmt.Errorf("close connection: %w", err)
 	}
@@ -0,0 +1,35 @@
+package conn
+
+import "errors"
+
+var ErrAdminShutdown = errors.New("admin shutdown")
+
+// Drain asks the client to give up its server once it is idle, for reason.
+// With ErrAdminShutdown the client is disconnected, with ErrHandoff it is
+// handed off to another process along with its server if it keeps one.
+func (c *Client) Drain(reason error) {
+	c.drainOnce.Do(func() {
+		c.drainErr = reason
+		close(c.drain)
+	})
+}
+
+// Draining is closed once the client is asked to give up its server.
+func (c *Client) Draining() <-chan struct{} {
+	return c.drain
+}
+
+// DrainReason returns the reason the client is drained for.
+func (c *Client) DrainReason() error {
+	<-c.drain
+	return c.drainErr
+}
+
+// leave ends the proxy of a drained client, which keeps the server when it is
+// handed off.
+func (p *Proxy) leave() error {
+	if err := p.c.DrainReason(); !errors.Is(err, ErrHandoff) {
+		return p.abort(err)
+	}
+	return ErrHandoff
+}
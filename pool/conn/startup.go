@@ -0,0 +1,218 @@
+package conn
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+const (
+	// latestProtocolMinor is the newest minor version of protocol 3 supported.
+	// Minor version 1 was never released, clients asking for it get 3.0.
+	latestProtocolMinor = 2
+
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+	cancelRequestCode = 80877102
+
+	maxStartupPacketLength = 10000
+	// secretKeyLength is the length of the cancel key handed out to clients
+	// using protocol 3.2, the longest allowed is 256.
+	secretKeyLength = 32
+)
+
+// ErrCancelRequest is returned by Startup when the client sent a
+// CancelRequest, whose key CancelKey returns.
+var ErrCancelRequest = errors.New("cancel request")
+
+// Startup reads the startup packets of the client until the StartupMessage,
+// declining encryption requests and negotiating the protocol version.
+func (c *Client) Startup() error {
+	for {
+		buf, err := c.receiveStartupPacket()
+		if err != nil {
+			return fmt.Errorf("receive startup packet: %w", err)
+		}
+
+		switch code := binary.BigEndian.Uint32(buf); code {
+		case sslRequestCode, gssEncRequestCode:
+			// Neither SSL nor GSSAPI encryption is supported, the client may
+			// retry unencrypted on the same connection.
+			if _, err := c.conn.Write([]byte{'N'}); err != nil {
+				return fmt.Errorf("decline encryption request: %w", err)
+			}
+		case cancelRequestCode:
+			if len(buf) < 12 {
+				return errors.New("invalid cancel request")
+			}
+			// The secret key is longer than 4 bytes with protocol 3.2.
+			c.cancelProcessID = binary.BigEndian.Uint32(buf[4:])
+			c.cancelSecretKey = buf[8:]
+			return ErrCancelRequest
+		default:
+			return c.startup(code, buf[4:])
+		}
+	}
+}
+
+func (c *Client) receiveStartupPacket() ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n < 8 || n > maxStartupPacketLength {
+		return nil, fmt.Errorf("invalid length of startup packet: %d", n)
+	}
+
+	buf := make([]byte, n-4)
+	if _, err := io.ReadFull(c.conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (c *Client) startup(version uint32, body []byte) error {
+	major, minor := version>>16, version&0xFFFF
+	if major != 3 {
+		c.backend.Send(&pgproto3.ErrorResponse{
+			Severity: "FATAL",
+			Code:     "0A000",
+			Message: fmt.Sprintf("unsupported frontend protocol %d.%d: server supports 3.0 to 3.%d",
+				major, minor, latestProtocolMinor),
+		})
+		if err := c.backend.Flush(); err != nil {
+			return fmt.Errorf("send error response: %w", err)
+		}
+		return fmt.Errorf("unsupported protocol version %d.%d", major, minor)
+	}
+
+	params := make(map[string]string)
+	for len(body) > 0 && body[0] != 0 {
+		fields := strings.SplitN(string(body), "\x00", 3)
+		if len(fields) < 3 {
+			return errors.New("invalid startup message parameters")
+		}
+		params[fields[0]] = fields[1]
+		body = body[len(fields[0])+len(fields[1])+2:]
+	}
+
+	// No protocol extension is supported yet, every _pq_ option is declined.
+	var unrecognized []string
+	for name := range params {
+		if strings.HasPrefix(name, "_pq_.") {
+			unrecognized = append(unrecognized, name)
+			delete(params, name)
+		}
+	}
+
+	c.protocolMinor = latestProtocolMinor
+	if minor < latestProtocolMinor {
+		c.protocolMinor = 0
+	}
+	if c.protocolMinor != minor || len(unrecognized) > 0 {
+		c.backend.Send(&negotiateProtocolVersion{
+			NewestMinorProtocol: c.protocolMinor,
+			UnrecognizedOptions: unrecognized,
+		})
+	}
+
+	// Protocol 3.2 allows longer cancel keys, which are much harder to guess.
+	c.secretKey = make([]byte, 4)
+	if c.protocolMinor >= 2 {
+		c.secretKey = make([]byte, secretKeyLength)
+	}
+	if _, err := rand.Read(c.secretKey); err != nil {
+		return fmt.Errorf("generate secret key: %w", err)
+	}
+
+	log.Printf("Received startup message: protocol 3.%d (negotiated 3.%d), parameters %v",
+		minor, c.protocolMinor, params)
+	c.user = params["user"]
+	c.setStartupParameters(params)
+	return nil
+}
+
+// CancelKey returns the process ID and the secret key of the CancelRequest
+// the client sent instead of a StartupMessage.
+func (c *Client) CancelKey() (uint32, []byte) {
+	return c.cancelProcessID, c.cancelSecretKey
+}
+
+// MatchesSecretKey reports whether key is the cancel key handed out to the
+// client.
+func (c *Client) MatchesSecretKey(key []byte) bool {
+	return len(c.secretKey) > 0 && subtle.ConstantTimeCompare(c.secretKey, key) == 1
+}
+
+// backendKeyData returns the BackendKeyData message for the client, with the
+// client ID as the process ID.
+func (c *Client) backendKeyData() pgproto3.BackendMessage {
+	if len(c.secretKey) == 4 {
+		return &pgproto3.BackendKeyData{
+			ProcessID: c.id,
+			SecretKey: binary.BigEndian.Uint32(c.secretKey),
+		}
+	}
+	return &extendedBackendKeyData{ProcessID: c.id, SecretKey: c.secretKey}
+}
+
+// negotiateProtocolVersion is the NegotiateProtocolVersion message, which
+// pgproto3 does not implement on the backend side.
+type negotiateProtocolVersion struct {
+	NewestMinorProtocol uint32
+	UnrecognizedOptions []string
+}
+
+func (*negotiateProtocolVersion) Backend() {}
+
+func (dst *negotiateProtocolVersion) Decode(src []byte) error {
+	return errors.New("decoding NegotiateProtocolVersion is not supported")
+}
+
+func (src *negotiateProtocolVersion) Encode(dst []byte) ([]byte, error) {
+	body := binary.BigEndian.AppendUint32(nil, src.NewestMinorProtocol)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(src.UnrecognizedOptions)))
+	for _, opt := range src.UnrecognizedOptions {
+		body = append(body, opt...)
+		body = append(body, 0)
+	}
+	return appendMessage(dst, 'v', body), nil
+}
+
+// extendedBackendKeyData is the BackendKeyData message of protocol 3.2, whose
+// secret key is longer than the 4 bytes pgproto3 supports.
+type extendedBackendKeyData struct {
+	ProcessID uint32
+	SecretKey []byte
+}
+
+func (*extendedBackendKeyData) Backend() {}
+
+func (dst *extendedBackendKeyData) Decode(src []byte) error {
+	if len(src) < 8 {
+		return errors.New("invalid BackendKeyData length")
+	}
+	dst.ProcessID = binary.BigEndian.Uint32(src)
+	dst.SecretKey = src[4:]
+	return nil
+}
+
+func (src *extendedBackendKeyData) Encode(dst []byte) ([]byte, error) {
+	body := binary.BigEndian.AppendUint32(nil, src.ProcessID)
+	return appendMessage(dst, 'K', append(body, src.SecretKey...)), nil
+}
+
+func appendMessage(dst []byte, code byte, body []byte) []byte {
+	dst = append(dst, code)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(body)+4))
+	return append(dst, body...)
+}
@@ -0,0 +1,272 @@
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+)
+
+var (
+	ErrClientIdleTimeout      = errors.New("client idle timeout")
+	ErrIdleTransactionTimeout = errors.New("idle transaction timeout")
+	ErrQueryTimeout           = errors.New("query timeout")
+	ErrQueryWaitTimeout       = errors.New("query wait timeout")
+	ErrServerUnresponsive     = errors.New("server did not answer the query cancellation")
+)
+
+const (
+	// serverResetTimeout bounds the time a server takes to become idle again
+	// after its client has been disconnected.
+	serverResetTimeout = 5 * time.Second
+	// CancelTimeout bounds the time a server takes to answer the cancellation
+	// of a query, before it is closed.
+	CancelTimeout = 5 * time.Second
+)
+
+// Timeouts are the client timeouts enforced by the pool, zero disables one.
+type Timeouts struct {
+	// ClientIdle is the longest time a client may stay idle outside of a
+	// transaction.
+	ClientIdle time.Duration
+	// IdleTransaction is the longest time a client may stay idle inside a
+	// transaction, while holding a server.
+	IdleTransaction time.Duration
+	// Query is the longest time a query may run on the server, before it is
+	// cancelled.
+	Query time.Duration
+	// QueryWait is the longest time a client may wait for a server to free up.
+	QueryWait time.Duration
+}
+
+// fatalResponse returns the FATAL ErrorResponse reported to a client
+// disconnected because of err.
+func fatalResponse(err error) *pgproto3.ErrorResponse {
+	resp := &pgproto3.ErrorResponse{Severity: "FATAL"}
+	switch {
+	case errors.Is(err, ErrClientIdleTimeout):
+		resp.Code = "57P05"
+		resp.Message = "terminating connection due to client idle timeout"
+	case errors.Is(err, ErrIdleTransactionTimeout):
+		resp.Code = "25P03"
+		resp.Message = "terminating connection due to idle-in-transaction timeout"
+	case errors.Is(err, ErrQueryWaitTimeout):
+		resp.Code = "08P01"
+		resp.Message = "terminating connection due to query wait timeout"
+	case errors.Is(err, ErrAdminShutdown):
+		resp.Code = "57P01"
+		resp.Message = "terminating connection due to administrator command"
+	case errors.Is(err, ErrServerUnresponsive):
+		resp.Code = "57014"
+		resp.Message = "terminating connection due to query timeout"
+	default:
+		resp.Code = "08006"
+		resp.Message = err.Error()
+	}
+	return resp
+}
+
+// Fatal reports err to the client as a FATAL ErrorResponse, before the client
+// is disconnected.
+func (c *Client) Fatal(err error) error {
+	log.Println("Disconnecting client", c.remoteAddr, "->", c.conn.LocalAddr(), "due to", err)
+
+	c.backend.Send(fatalResponse(err))
+	if err := c.backend.Flush(); err != nil {
+		return fmt.Errorf("send fatal error: %w", err)
+	}
+	return nil
+}
+
+// Cancel asks the server to cancel its running query, by sending a
+// CancelRequest with its BackendKeyData over a new connection.
+func (s *Server) Cancel() error {
+	addr := s.conn.RemoteAddr()
+	conn, err := net.DialTimeout(addr.Network(), addr.String(), serverResetTimeout)
+	if err != nil {
+		return fmt.Errorf("dial server: %w", err)
+	}
+	defer conn.Close()
+
+	buf, err := (&pgproto3.CancelRequest{
+		ProcessID: s.processID,
+		SecretKey: s.secretKey,
+	}).Encode(nil)
+	if err != nil {
+		return fmt.Errorf("encode cancel request: %w", err)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return fmt.Errorf("send cancel request: %w", err)
+	}
+
+	log.Println("Cancelled query on server", s.conn.LocalAddr(), "->", s.conn.RemoteAddr())
+	return nil
+}
+
+// Reset brings the server back to idle after its client is gone: the running
+// query is cancelled, the unfinished extended query is ended and the open
+// transaction is rolled back. The messages of the server are discarded.
+func (s *Server) Reset(running bool) error {
+	// Every query sent by the client, and the Sync sent below, are answered
+	// by a ReadyForQuery, the last one reporting the transaction status.
+	pending := 1
+	if running {
+		if err := s.Cancel(); err != nil {
+			return fmt.Errorf("cancel query: %w", err)
+		}
+		pending++
+	}
+
+	s.frontend.Send(&pgproto3.Sync{})
+	if err := s.frontend.Flush(); err != nil {
+		return fmt.Errorf("send sync: %w", err)
+	}
+
+	var txStatus byte
+	for ; pending > 0; pending-- {
+		status, err := s.waitReadyForQuery()
+		if err != nil {
+			return err
+		}
+		txStatus = status
+	}
+
+	if txStatus != 'I' {
+		s.frontend.Send(&pgproto3.Query{String: "ROLLBACK"})
+		if err := s.frontend.Flush(); err != nil {
+			return fmt.Errorf("send rollback: %w", err)
+		}
+
+		if _, err := s.waitReadyForQuery(); err != nil {
+			return err
+		}
+	}
+
+	log.Println("Reset server", s.conn.LocalAddr(), "->", s.conn.RemoteAddr())
+	return nil
+}
+
+// ResetSession runs query on the idle server, to drop the session state its
+// client left: the prepared statements, the parameters, the temporary tables
+// and alike, as DISCARD ALL does. The server is then taken for a new session.
+func (s *Server) ResetSession(query string) error {
+	s.frontend.Send(&pgproto3.Query{String: query})
+	if err := s.frontend.Flush(); err != nil {
+		return fmt.Errorf("send reset query: %w", err)
+	}
+
+	timer := time.NewTimer(serverResetTimeout)
+	defer timer.Stop()
+
+	var errResp *pgproto3.ErrorResponse
+	for {
+		select {
+		case msg, ok := <-s.ch:
+			if !ok {
+				return ErrServerClosed
+			}
+
+			switch m := msg.(type) {
+			case *pgproto3.ErrorResponse:
+				errResp = m
+			case *pgproto3.ReadyForQuery:
+				if errResp != nil {
+					return fmt.Errorf("reset query: %s", errResp.Message)
+				}
+
+				s.prepared = make(map[string]struct{})
+				s.params = make(map[string]string, len(s.defaults))
+				for name, value := range s.defaults {
+					s.params[name] = value
+				}
+
+				log.Println("Reset session of server", s.conn.LocalAddr(), "->", s.conn.RemoteAddr())
+				return nil
+			}
+		case <-timer.C:
+			return errors.New("server not ready for query in time")
+		}
+	}
+}
+
+// waitReadyForQuery discards the messages of the server until ReadyForQuery,
+// and returns the transaction status.
+func (s *Server) waitReadyForQuery() (byte, error) {
+	timer := time.NewTimer(serverResetTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg, ok := <-s.ch:
+			if !ok {
+				return 0, ErrServerClosed
+			}
+			if m, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				return m.TxStatus, nil
+			}
+		case <-timer.C:
+			return 0, errors.New("server not ready for query in time")
+		}
+	}
+}
+
+// timeout returns the timeout that applies to the current state of the proxy,
+// and the time left before it fires. It returns a nil error if none applies.
+func (p *Proxy) timeout() (time.Duration, error) {
+	var (
+		d     time.Duration
+		since = p.since
+		err   error
+	)
+	switch {
+	case p.running && !p.cancelled.IsZero():
+		d, since, err = CancelTimeout, p.cancelled, ErrServerUnresponsive
+	case p.running:
+		d, err = p.timeouts.Query, ErrQueryTimeout
+	case p.txStatus != 'I':
+		d, err = p.timeouts.IdleTransaction, ErrIdleTransactionTimeout
+	default:
+		d, err = p.timeouts.ClientIdle, ErrClientIdleTimeout
+	}
+	if d <= 0 {
+		return 0, nil
+	}
+
+	return time.Until(since.Add(d)), err
+}
+
+// cancel cancels the query running past the query timeout. The client stays
+// connected, and gets the ErrorResponse of the server.
+func (p *Proxy) cancel() error {
+	log.Println("Query timeout for client",
+		p.c.remoteAddr, "->", p.c.conn.LocalAddr())
+
+	if err := p.s.Cancel(); err != nil {
+		return fmt.Errorf("cancel query: %w", err)
+	}
+	p.cancelled = time.Now()
+	return nil
+}
+
+// abort resets the server after the client is disconnected because of err. It
+// returns err if the server can be reused.
+func (p *Proxy) abort(err error) error {
+	if !errors.Is(err, ErrClientClosed) {
+		if ferr := p.c.Fatal(err); ferr != nil {
+			log.Println("Failed to report disconnection to the client:", ferr)
+		}
+	}
+
+	// The server is stuck in the query, it is replaced rather than reset.
+	if errors.Is(err, ErrServerUnresponsive) {
+		return err
+	}
+
+	if rerr := p.s.Reset(p.running); rerr != nil {
+		return fmt.Errorf("reset server after %v: %w", err, rerr)
+	}
+	return err
+}
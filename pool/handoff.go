@@ -0,0 +1,412 @@
+package pool
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/justin0u0/kpgpool/pool/conn"
+	"golang.org/x/sys/unix"
+)
+
+// maxFilesPerMessage is the number of files passed per message over the
+// handoff socket, below the SCM_MAX_FD limit of Linux.
+const maxFilesPerMessage = 250
+
+// handoffState is the state of the pool passed to the process taking over,
+// along with the files of the listeners, the servers and the clients, in this
+// order.
+type handoffState struct {
+	Listeners    int
+	NextClientID uint32
+	Servers      []*conn.ServerState
+	Clients      []handoffClient
+}
+
+type handoffClient struct {
+	*conn.ClientState
+	// Server is the index of the server kept by the client, or -1.
+	Server int
+}
+
+// filer is implemented by the TCP and Unix connections and listeners.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// handedOffClient is a client stopped for the handoff.
+type handedOffClient struct {
+	state  *conn.ClientState
+	file   *os.File
+	server *conn.Server
+}
+
+// restoredClient is a client taken over from the previous process.
+type restoredClient struct {
+	client *conn.Client
+	id     uint32
+	server *conn.Server
+}
+
+// HandedOff is closed once the pool is handed off to another process, or
+// stopped by a failed handoff.
+func (p *Pool) HandedOff() <-chan struct{} {
+	return p.handedOffC
+}
+
+// takeover takes over the pool of the process serving handoffs on the handoff
+// socket, if any, and reports whether it did.
+func (p *Pool) takeover() (bool, error) {
+	uconn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: p.opts.HandoffSocket, Net: "unix"})
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return false, nil
+		}
+		return false, fmt.Errorf("dial handoff socket: %w", err)
+	}
+	defer uconn.Close()
+
+	state, files, err := receiveHandoff(uconn)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, f := range files[:state.Listeners] {
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return false, fmt.Errorf("restore listener: %w", err)
+		}
+		p.lns = append(p.lns, ln)
+	}
+	files = files[state.Listeners:]
+
+	servers := make([]*conn.Server, len(state.Servers))
+	for i, st := range state.Servers {
+		rconn, err := net.FileConn(files[i])
+		if err != nil {
+			return false, fmt.Errorf("restore server connection: %w", err)
+		}
+
+		s := conn.RestoreServer(rconn, st)
+		p.serversMu.Lock()
+		p.servers[s] = struct{}{}
+		p.serversMu.Unlock()
+		go s.LoopReceive()
+		servers[i] = s
+	}
+
+	kept := make(map[int]bool)
+	for i, st := range state.Clients {
+		lconn, err := net.FileConn(files[len(servers)+i])
+		if err != nil {
+			return false, fmt.Errorf("restore client connection: %w", err)
+		}
+
+		rc := restoredClient{
+			client: conn.RestoreClient(lconn, p.opts.TrackedParameters, st.ClientState),
+			id:     st.ID,
+		}
+		if st.Server >= 0 {
+			rc.server = servers[st.Server]
+			kept[st.Server] = true
+		}
+		p.restored = append(p.restored, rc)
+	}
+
+	for i, s := range servers {
+		// In BPF mode, the servers are still queued in the pinned maps.
+		if kept[i] || p.bpf {
+			continue
+		}
+		select {
+		case p.serverCh <- s:
+		default:
+			// The previous process had a larger pool.
+			go p.removeServer(s)
+		}
+	}
+	p.cid.Store(state.NextClientID)
+
+	// Let the previous process exit.
+	if _, err := uconn.Write([]byte{0}); err != nil {
+		return false, fmt.Errorf("acknowledge handoff: %w", err)
+	}
+
+	log.Println("Took over", len(servers), "servers and", len(p.restored), "clients")
+	return true, nil
+}
+
+// removeServer closes a server in excess.
+func (p *Pool) removeServer(s *conn.Server) {
+	p.serversMu.Lock()
+	delete(p.servers, s)
+	p.serversMu.Unlock()
+
+	if err := s.Close(); err != nil {
+		log.Println("Failed to close server:", err)
+	}
+}
+
+// listenHandoff waits for a new process to connect to the handoff socket, and
+// hands the pool off to it.
+func (p *Pool) listenHandoff(ctx context.Context) error {
+	// The socket of the previous process is replaced.
+	if err := os.Remove(p.opts.HandoffSocket); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove handoff socket: %w", err)
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: p.opts.HandoffSocket, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("listen handoff socket: %w", err)
+	}
+	// The next process owns the socket path once it takes over.
+	ln.SetUnlinkOnClose(false)
+	defer ln.Close()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-p.shutdown:
+		}
+		ln.Close()
+	}()
+
+	uconn, err := ln.AcceptUnix()
+	if err != nil {
+		if ctx.Err() != nil || p.isShutdown() {
+			return nil
+		}
+		return fmt.Errorf("accept handoff: %w", err)
+	}
+	defer uconn.Close()
+	defer close(p.handedOffC)
+
+	log.Println("Handing off the pool to a new process")
+	return p.handoff(uconn)
+}
+
+// handoff stops the pool and passes its state to the process connected to
+// uconn. The clients are handed off once idle, or disconnected once the
+// shutdown timeout expires. In BPF mode, they are handed off right away, along
+// with their bindings kept in the pinned maps.
+func (p *Pool) handoff(uconn *net.UnixConn) error {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, ln := range p.lns {
+		f, err := ln.(filer).File()
+		if err != nil {
+			return fmt.Errorf("get listener file: %w", err)
+		}
+		files = append(files, f)
+
+		// The Unix socket is kept for the new process.
+		if uln, ok := ln.(*net.UnixListener); ok {
+			uln.SetUnlinkOnClose(false)
+		}
+	}
+
+	p.stop(conn.ErrHandoff)
+	p.closeListeners()
+	p.drainClients(conn.ErrHandoff)
+
+	state := &handoffState{Listeners: len(files), NextClientID: p.cid.Load()}
+
+	// The servers are removed from the pool, so that closing it leaves them
+	// open.
+	index := make(map[*conn.Server]int)
+	var handedOff []*conn.Server
+	p.serversMu.Lock()
+	for s := range p.servers {
+		delete(p.servers, s)
+
+		st, err := s.Handoff()
+		if err != nil {
+			log.Println("Failed to hand off server:", err)
+			s.Close()
+			continue
+		}
+		f, err := s.Conn().(filer).File()
+		if err != nil {
+			log.Println("Failed to get server file:", err)
+			s.Close()
+			continue
+		}
+
+		index[s] = len(state.Servers)
+		state.Servers = append(state.Servers, st)
+		files = append(files, f)
+		handedOff = append(handedOff, s)
+	}
+	p.serversMu.Unlock()
+
+	p.handedOffMu.Lock()
+	for _, hc := range p.handedOff {
+		server := -1
+		if hc.server != nil {
+			i, ok := index[hc.server]
+			if !ok {
+				log.Println("Dropping client", hc.state.ID, "whose server could not be handed off")
+				hc.file.Close()
+				continue
+			}
+			server = i
+		}
+
+		state.Clients = append(state.Clients, handoffClient{ClientState: hc.state, Server: server})
+		files = append(files, hc.file)
+	}
+	p.handedOff = nil
+	p.handedOffMu.Unlock()
+
+	if err := sendHandoff(uconn, state, files); err != nil {
+		return err
+	}
+
+	var ack [1]byte
+	if _, err := uconn.Read(ack[:]); err != nil {
+		return fmt.Errorf("wait for handoff acknowledgement: %w", err)
+	}
+
+	// The new process holds its own copies of the connections.
+	for _, s := range handedOff {
+		s.Conn().Close()
+	}
+
+	log.Println("Handed off", len(state.Servers), "servers and", len(state.Clients), "clients")
+	return nil
+}
+
+// handOff stops the drained client, keeping server if it is not nil, to hand
+// it off once every client is stopped. The pending messages were received from
+// the client but not handled yet.
+func (p *Pool) handOff(client *conn.Client, server *conn.Server, pending ...pgproto3.FrontendMessage) error {
+	st, err := client.Handoff(pending...)
+	if err == nil {
+		var f *os.File
+		if f, err = client.Conn().(filer).File(); err == nil {
+			p.handedOffMu.Lock()
+			p.handedOff = append(p.handedOff, &handedOffClient{state: st, file: f, server: server})
+			p.handedOffMu.Unlock()
+			return conn.ErrHandoff
+		}
+	}
+
+	if server != nil {
+		p.serverCh <- server
+	}
+	return fmt.Errorf("hand off client: %w", err)
+}
+
+// handleRestoredConn serves a client taken over from the previous process.
+func (p *Pool) handleRestoredConn(rc restoredClient) error {
+	defer rc.client.Close()
+	defer p.removeClient(rc.id)
+
+	// The BPF program kept serving the client, from the state taken over along
+	// with the pinned maps.
+	if p.bpf {
+		if err := p.serveBPFClient(rc.client, rc.id, true); err != nil && !errors.Is(err, conn.ErrHandoff) {
+			return err
+		}
+		return nil
+	}
+
+	go rc.client.LoopReceive()
+	p.addClient(rc.id, rc.client)
+
+	if err := p.loopProxy(rc.client, rc.server); err != nil && !errors.Is(err, conn.ErrHandoff) {
+		return fmt.Errorf("setup proxy: %w", err)
+	}
+	return nil
+}
+
+// sendHandoff writes the state prefixed by its length, then passes the files.
+func sendHandoff(uconn *net.UnixConn, state *handoffState, files []*os.File) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("encode handoff state: %w", err)
+	}
+	hdr := binary.BigEndian.AppendUint32(nil, uint32(len(buf)))
+	if _, err := uconn.Write(append(hdr, buf...)); err != nil {
+		return fmt.Errorf("send handoff state: %w", err)
+	}
+
+	for i := 0; i < len(files); i += maxFilesPerMessage {
+		end := i + maxFilesPerMessage
+		if end > len(files) {
+			end = len(files)
+		}
+		fds := make([]int, 0, end-i)
+		for _, f := range files[i:end] {
+			fds = append(fds, int(f.Fd()))
+		}
+
+		if _, _, err := uconn.WriteMsgUnix([]byte{0}, unix.UnixRights(fds...), nil); err != nil {
+			return fmt.Errorf("send files: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// receiveHandoff reads the state and the files passed by sendHandoff.
+func receiveHandoff(uconn *net.UnixConn) (*handoffState, []*os.File, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(uconn, hdr[:]); err != nil {
+		return nil, nil, fmt.Errorf("receive handoff state length: %w", err)
+	}
+	// Exactly the state is read, the files follow in their own messages.
+	buf := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	if _, err := io.ReadFull(uconn, buf); err != nil {
+		return nil, nil, fmt.Errorf("receive handoff state: %w", err)
+	}
+
+	var state handoffState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return nil, nil, fmt.Errorf("decode handoff state: %w", err)
+	}
+
+	n := state.Listeners + len(state.Servers) + len(state.Clients)
+	files := make([]*os.File, 0, n)
+	oob := make([]byte, unix.CmsgSpace(maxFilesPerMessage*4))
+	for len(files) < n {
+		var b [1]byte
+		_, oobn, _, _, err := uconn.ReadMsgUnix(b[:], oob)
+		if err != nil {
+			return nil, nil, fmt.Errorf("receive files: %w", err)
+		}
+
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, nil, fmt.Errorf("parse control message: %w", err)
+		}
+		for _, msg := range msgs {
+			fds, err := unix.ParseUnixRights(&msg)
+			if err != nil {
+				return nil, nil, fmt.Errorf("parse unix rights: %w", err)
+			}
+			for _, fd := range fds {
+				files = append(files, os.NewFile(uintptr(fd), "handoff"))
+			}
+		}
+	}
+
+	return &state, files, nil
+}
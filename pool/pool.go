@@ -4,14 +4,21 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net"
+	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/cilium/ebpf"
+	"github.com/jackc/pgx/v5/pgproto3"
 	"github.com/justin0u0/kpgpool/bpf"
 	"github.com/justin0u0/kpgpool/pool/conn"
+	"golang.org/x/sys/unix"
 )
 
 type Mode string
@@ -23,150 +30,663 @@ const (
 
 const maxClients = 1024
 
+// Options holds the optional settings of a pool.
+type Options struct {
+	// PinPolicy decides what transaction mode does with statements that change
+	// session state.
+	PinPolicy conn.PinPolicy
+	// TrackedParameters are the parameters tracked per client and applied to
+	// the server the client is bound to.
+	TrackedParameters []string
+	// LocalQueries are the health check queries answered without a server.
+	LocalQueries []string
+	// ServerResetQuery is run on the servers left with session state, in
+	// session mode or by a pinned client, before they serve another client.
+	// It must bring the session back to its initial state, as DISCARD ALL
+	// does. Empty disables it.
+	ServerResetQuery string
+	// Timeouts are the client timeouts.
+	Timeouts conn.Timeouts
+	// UserQueryTimeouts overrides the query timeout per user.
+	UserQueryTimeouts map[string]time.Duration
+	// ShutdownTimeout is the longest time Close, or a handoff, waits for the
+	// transactions in progress to complete, zero waits until they do.
+	ShutdownTimeout time.Duration
+	// HandoffSocket is the path of the Unix socket the pool is handed off
+	// through, from the previous process and to the next one.
+	HandoffSocket string
+	// ReusePort sets SO_REUSEPORT on the listener, so that several processes
+	// serve the same port.
+	ReusePort bool
+	// UnixSocket is the path of a Unix socket to listen on, besides the local
+	// address.
+	UnixSocket string
+	// ProxyProtocol requires clients to send a PROXY protocol header, carrying
+	// their address behind a load balancer.
+	ProxyProtocol bool
+	// StatsPeriod is the period the counters of the BPF program are logged
+	// over, zero disables it.
+	StatsPeriod time.Duration
+	// MetricsAddr is the address the counters of the BPF program are served on
+	// for scraping, at /metrics. Empty disables it.
+	MetricsAddr string
+	// BPFMaxMessageSize is the size of the largest message of a client the BPF
+	// program handles, up to bpf.MaxMessageSize. The kernel disconnects the
+	// clients sending larger ones. Zero keeps the receive buffer of the
+	// clients, which the kernel tunes.
+	BPFMaxMessageSize int
+	// BPFPinned tells the BPF maps are pinned, so that they outlive the
+	// process and are reused by the next one, which the pool is handed off to.
+	BPFPinned bool
+}
+
+// bpfWatchInterval is the interval at which the timeouts of the clients served
+// by the BPF program are checked.
+const bpfWatchInterval = time.Second
+
 type Pool struct {
-	remoteAddr string
-	localAddr  string
-	serverCh   chan *conn.Server
-	servers    map[int]*conn.Server // maps proxy local port to server
-	wg         sync.WaitGroup
-	size       int
-	mode       Mode
-	mapDAO     *bpf.MapDAO
-	bpf        bool
-	ln         net.Listener
-	cid        atomic.Uint32
-}
-
-func NewPool(remoteAddr, localAddr string, size int, mode Mode, mapDAO *bpf.MapDAO, bpf bool) *Pool {
+	remoteAddr   string
+	localAddr    string
+	serverCh     chan *conn.Server
+	servers      map[*conn.Server]struct{}
+	serversMu    sync.RWMutex
+	wg           sync.WaitGroup
+	size         int
+	mode         Mode
+	mapDAO       *bpf.MapDAO
+	bpf          bool
+	lns          []net.Listener
+	cid          atomic.Uint32
+	opts         Options
+	localQueries conn.LocalQueries
+	clients      map[uint32]*conn.Client // maps client ID to client
+	clientsMu    sync.Mutex
+	shutdown     chan struct{}
+	stopOnce     sync.Once
+	drainErr     error // the reason the clients are drained for on shutdown
+	restored     []restoredClient
+	handedOff    []*handedOffClient
+	handedOffMu  sync.Mutex
+	handedOffC   chan struct{}
+	bpfWaiters   []chan *conn.Server // clients waiting for a server in BPF mode
+	bpfWaitersMu sync.Mutex
+}
+
+func NewPool(remoteAddr, localAddr string, size int, mode Mode, mapDAO *bpf.MapDAO, bpf bool, opts Options) *Pool {
+	if opts.PinPolicy == "" {
+		opts.PinPolicy = conn.PinPolicyPin
+	}
+	if opts.TrackedParameters == nil {
+		opts.TrackedParameters = conn.DefaultTrackedParameters
+	}
+	if opts.LocalQueries == nil {
+		opts.LocalQueries = conn.DefaultLocalQueries
+	}
+
 	return &Pool{
 		remoteAddr: remoteAddr,
 		localAddr:  localAddr,
-		servers:    make(map[int]*conn.Server, size),
+		servers:    make(map[*conn.Server]struct{}, size),
 		serverCh:   make(chan *conn.Server, size),
 		size:       size,
 		mode:       mode,
 		mapDAO:     mapDAO,
 		bpf:        bpf,
+		opts:       opts,
+		clients:    make(map[uint32]*conn.Client),
+		shutdown:   make(chan struct{}),
+		handedOffC: make(chan struct{}),
 	}
 }
 
 func (p *Pool) Serve(ctx context.Context) error {
-	if p.ln != nil {
-		return nil
+	localQueries, err := conn.ParseLocalQueries(p.opts.LocalQueries)
+	if err != nil {
+		return fmt.Errorf("parse local queries: %w", err)
 	}
+	p.localQueries = localQueries
 
-	for i := 0; i < p.size; i++ {
-		rconn, err := net.Dial("tcp4", p.remoteAddr)
-		if err != nil {
-			return fmt.Errorf("dial remote server: %w", err)
+	// The BPF program redirects between TCP sockets only.
+	if p.bpf && (IsUnixAddr(p.localAddr) || IsUnixAddr(p.remoteAddr) || p.opts.UnixSocket != "") {
+		return errors.New("BPF mode supports TCP clients and servers only")
+	}
+
+	if p.bpf {
+		if err := p.mapDAO.SetLocalQueries(p.opts.LocalQueries); err != nil {
+			return fmt.Errorf("set local queries: %w", err)
 		}
+		if p.opts.MetricsAddr != "" {
+			if err := p.serveMetrics(ctx); err != nil {
+				return err
+			}
+		}
+	}
 
-		s := conn.NewServer(rconn)
-		p.servers[rconn.LocalAddr().(*net.TCPAddr).Port] = s
+	takenOver := false
+	if p.opts.HandoffSocket != "" {
+		// The bindings of the handed off sockets are kept in the BPF maps, which
+		// outlive the previous process once pinned.
+		if p.bpf && !p.opts.BPFPinned {
+			return errors.New("handoff in BPF mode requires the BPF maps to be pinned")
+		}
+		if takenOver, err = p.takeover(); err != nil {
+			return fmt.Errorf("take over: %w", err)
+		}
+	}
 
-		if err := s.Setup(); err != nil {
-			return fmt.Errorf("setup server connection: %w", err)
+	if !takenOver {
+		for i := 0; i < p.size; i++ {
+			if err := p.addServer(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if p.bpf && p.opts.BPFPinned {
+		if err := p.reconcileBPFMaps(); err != nil {
+			return fmt.Errorf("reconcile bpf maps: %w", err)
 		}
+	}
 
-		if p.bpf {
-			if err := p.setupBPFServerConn(rconn); err != nil {
-				return fmt.Errorf("setup server bpf conn: %w", err)
+	if !takenOver {
+		addrs := []string{p.localAddr}
+		if p.opts.UnixSocket != "" {
+			addrs = append(addrs, unixAddrPrefix+p.opts.UnixSocket)
+		}
+		for _, addr := range addrs {
+			ln, err := p.listen(ctx, addr)
+			if err != nil {
+				p.closeListeners()
+				return err
 			}
+			p.lns = append(p.lns, ln)
+		}
+	}
 
-		} else {
-			p.serverCh <- s
-			go s.LoopReceive()
+	for _, rc := range p.restored {
+		rc := rc
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+
+			if err := p.handleRestoredConn(rc); err != nil {
+				log.Println("Failed to handle connection:", err)
+			}
+		}()
+	}
+	p.restored = nil
+
+	if p.opts.HandoffSocket != "" {
+		go func() {
+			if err := p.listenHandoff(ctx); err != nil {
+				log.Println("Failed to hand off:", err)
+			}
+		}()
+	}
+
+	if p.bpf {
+		// The servers are handed off once these are stopped, as they reset
+		// and hand out servers.
+		p.wg.Add(2)
+		go func() {
+			defer p.wg.Done()
+			p.reclaimBPFServers(ctx)
+		}()
+		go func() {
+			defer p.wg.Done()
+			p.dispatchBPFServers(ctx)
+		}()
+		if p.opts.StatsPeriod > 0 {
+			go p.logBPFStats(ctx)
 		}
+	}
 
-		log.Println("Connected from", rconn.LocalAddr(), "to", rconn.RemoteAddr())
+	// Accept does not watch the context, closing the listeners unblocks it.
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-p.shutdown:
+		}
+		p.closeListeners()
+	}()
+
+	errCh := make(chan error, len(p.lns))
+	for _, ln := range p.lns {
+		ln := ln
+		go func() {
+			errCh <- p.accept(ctx, ln)
+		}()
 	}
 
-	ln, err := net.Listen("tcp4", p.localAddr)
-	if err != nil {
-		return fmt.Errorf("listen: %w", err)
+	var serveErr error
+	for range p.lns {
+		if err := <-errCh; err != nil && serveErr == nil {
+			serveErr = err
+			p.closeListeners()
+		}
 	}
+	return serveErr
+}
 
-	p.ln = ln
+// accept handles the clients connecting to ln, until it is closed.
+func (p *Pool) accept(ctx context.Context, ln net.Listener) error {
 	log.Println("Listening on", ln.Addr())
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if ctx.Err() != nil || p.isShutdown() {
+				return nil
+			}
 			return fmt.Errorf("accept: %w", err)
 		}
 
 		log.Println("Handling connection from", conn.RemoteAddr())
 
+		p.wg.Add(1)
 		go func() {
-			p.wg.Add(1)
 			defer p.wg.Done()
 
-			if err := p.handleConn(ctx, conn); err != nil {
+			if err := p.handleConn(conn); err != nil {
 				log.Println("Failed to handle connection:", err)
 			}
 		}()
 	}
 }
 
+// Close shuts the pool down: new clients are refused, idle clients are
+// disconnected with an admin_shutdown error, and the other clients once their
+// transaction completes, or once the shutdown timeout expires.
 func (p *Pool) Close() error {
 	log.Println("Closing pool")
 
-	if p.ln == nil {
+	if len(p.lns) == 0 {
 		return nil
 	}
 
-	if err := p.ln.Close(); err != nil {
-		return fmt.Errorf("close listener: %w", err)
-	}
+	p.stop(conn.ErrAdminShutdown)
+	p.closeListeners()
+	p.drainClients(conn.ErrAdminShutdown)
 
 	log.Println("Closing server connections")
-	for _, s := range p.servers {
+	p.serversMu.RLock()
+	defer p.serversMu.RUnlock()
+	for s := range p.servers {
 		if err := s.Close(); err != nil {
 			return fmt.Errorf("close server connection: %w", err)
 		}
 	}
 	log.Println("All server connections are closed")
 
-	log.Println("Closing client connections")
-	p.wg.Wait()
-	log.Println("All client connections are closed")
+	// The pinned maps are left for the next process to reconcile.
+	if p.bpf && !p.opts.BPFPinned {
+		if err := p.mapDAO.Clear(); err != nil {
+			return fmt.Errorf("clear bpf maps: %w", err)
+		}
+		log.Println("Cleared BPF maps")
+	}
+
+	return nil
+}
+
+// unixAddrPrefix is the prefix of the addresses of Unix sockets.
+const unixAddrPrefix = "unix://"
 
+// IsUnixAddr reports whether addr is the path of a Unix socket, prefixed by
+// unix://.
+func IsUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, unixAddrPrefix)
+}
+
+// splitAddr returns the network and the address of addr, either a TCP address
+// or the path of a Unix socket prefixed by unix://.
+func splitAddr(addr string) (string, string) {
+	if IsUnixAddr(addr) {
+		return "unix", strings.TrimPrefix(addr, unixAddrPrefix)
+	}
+	return "tcp", addr
+}
+
+// removeStaleSocket removes the Unix socket left by a previous process, like
+// Postgres does. A socket another process still accepts connections on is
+// kept.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("stat unix socket: %w", err)
+	}
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+
+	c, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		c.Close()
+		return fmt.Errorf("unix socket %s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("check unix socket: %w", err)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove unix socket: %w", err)
+	}
 	return nil
 }
 
-func (p *Pool) handleConn(ctx context.Context, lconn net.Conn) error {
+// listen listens on addr, either a TCP address or a Unix socket.
+func (p *Pool) listen(ctx context.Context, addr string) (net.Listener, error) {
+	network, address := splitAddr(addr)
+
+	var lc net.ListenConfig
+	switch {
+	case network == "unix":
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	case p.opts.ReusePort:
+		lc.Control = reusePort
+	}
+
+	ln, err := lc.Listen(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	return ln, nil
+}
+
+func (p *Pool) closeListeners() {
+	for _, ln := range p.lns {
+		if err := ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Println("Failed to close listener:", err)
+		}
+	}
+}
+
+// reusePort sets SO_REUSEPORT on the socket. The kernel then spreads the new
+// connections over the processes listening on the port, but the connections
+// queued on a listener are reset when it is closed.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var serr error
+	if err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// setReceiveBuffer sets the receive buffer of the connection to size, which
+// the kernel doubles. SO_RCVBUFFORCE goes past net.core.rmem_max, given
+// CAP_NET_ADMIN.
+func setReceiveBuffer(conn *net.TCPConn, size int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, size)
+		if errors.Is(serr, unix.EPERM) {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, size)
+		}
+	}); err != nil {
+		return err
+	}
+	return serr
+}
+
+// setSockhash adds the socket of the connection to the sockhash, and returns
+// its descriptor. The descriptor is used in place, as os.File.Fd would put the
+// socket in blocking mode, and closing the connection would then wait for a
+// pending read.
+func (p *Pool) setSockhash(conn *net.TCPConn) (uint32, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		fd   uint32
+		serr error
+	)
+	if err := raw.Control(func(s uintptr) {
+		fd = uint32(s)
+		serr = p.mapDAO.SetSockhash(conn, fd)
+	}); err != nil {
+		return 0, err
+	}
+	return fd, serr
+}
+
+// stop stops accepting clients, the clients accepted from now on are drained
+// for reason.
+func (p *Pool) stop(reason error) {
+	p.stopOnce.Do(func() {
+		p.drainErr = reason
+		close(p.shutdown)
+	})
+}
+
+// drainClients drains the clients for reason and waits for them to be gone.
+// The clients left once the shutdown timeout expires are disconnected.
+func (p *Pool) drainClients(reason error) {
+	log.Println("Draining client connections")
+	p.clientsMu.Lock()
+	for _, c := range p.clients {
+		c.Drain(reason)
+	}
+	p.clientsMu.Unlock()
+
+	if !p.waitClients(p.opts.ShutdownTimeout) {
+		log.Println("Shutdown timeout expired, closing the remaining client connections")
+		p.clientsMu.Lock()
+		for _, c := range p.clients {
+			if err := c.Close(); err != nil {
+				log.Println("Failed to close client connection:", err)
+			}
+		}
+		p.clientsMu.Unlock()
+		p.wg.Wait()
+	}
+	log.Println("All client connections are drained")
+}
+
+func (p *Pool) isShutdown() bool {
+	select {
+	case <-p.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitClients waits for the client connections to be closed, for at most
+// timeout unless it is zero. It reports whether they are.
+func (p *Pool) waitClients(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	var timeoutC <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-timeoutC:
+		return false
+	}
+}
+
+// addClient registers the client to be drained on shutdown. The client must
+// be receiving messages, so that it can be closed.
+func (p *Pool) addClient(id uint32, client *conn.Client) {
+	p.clientsMu.Lock()
+	defer p.clientsMu.Unlock()
+
+	p.clients[id] = client
+	// The client was accepted while the pool was shutting down.
+	if p.isShutdown() {
+		client.Drain(p.drainErr)
+	}
+}
+
+func (p *Pool) removeClient(id uint32) {
+	p.clientsMu.Lock()
+	defer p.clientsMu.Unlock()
+
+	delete(p.clients, id)
+}
+
+// addServer connects a new server and adds it to the pool.
+func (p *Pool) addServer() error {
+	rconn, err := net.Dial(splitAddr(p.remoteAddr))
+	if err != nil {
+		return fmt.Errorf("dial remote server: %w", err)
+	}
+
+	s := conn.NewServer(rconn)
+	if err := s.Setup(); err != nil {
+		rconn.Close()
+		return fmt.Errorf("setup server connection: %w", err)
+	}
+
+	p.serversMu.Lock()
+	p.servers[s] = struct{}{}
+	p.serversMu.Unlock()
+
+	// In BPF mode, the server only receives in user space the messages the
+	// BPF program passes, which happens once it is unbound to be reset.
+	go s.LoopReceive()
+
+	if p.bpf {
+		if err := p.setupBPFServerConn(s); err != nil {
+			// The server is closed rather than kept half set up, along with the
+			// state it has in the maps.
+			p.serversMu.Lock()
+			delete(p.servers, s)
+			p.serversMu.Unlock()
+
+			if rerr := p.mapDAO.RemoveServer(s.Conn()); rerr != nil {
+				log.Println("Failed to remove server state:", rerr)
+			}
+			if cerr := s.Close(); cerr != nil {
+				log.Println("Failed to close server:", cerr)
+			}
+			return fmt.Errorf("setup server bpf conn: %w", err)
+		}
+	} else {
+		p.serverCh <- s
+	}
+
+	log.Println("Connected from", rconn.LocalAddr(), "to", rconn.RemoteAddr())
+	return nil
+}
+
+// replaceServer closes a server that cannot be reused, and connects a new one
+// in its place to keep the pool size.
+func (p *Pool) replaceServer(s *conn.Server) {
+	p.serversMu.Lock()
+	delete(p.servers, s)
+	p.serversMu.Unlock()
+
+	if p.bpf {
+		if err := p.mapDAO.RemoveServer(s.Conn()); err != nil {
+			log.Println("Failed to remove server state:", err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		log.Println("Failed to close server:", err)
+	}
+	if err := p.addServer(); err != nil {
+		log.Println("Failed to replace server:", err)
+	}
+}
+
+// server returns the server by its local port.
+func (p *Pool) server(port int) (*conn.Server, bool) {
+	p.serversMu.RLock()
+	defer p.serversMu.RUnlock()
+
+	for s := range p.servers {
+		if addr, ok := s.Conn().LocalAddr().(*net.TCPAddr); ok && addr.Port == port {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// paramsID returns the ID of the parameters of the client, the same as the
+// servers have once they are applied to them.
+func (p *Pool) paramsID(client *conn.Client) uint32 {
+	p.serversMu.RLock()
+	defer p.serversMu.RUnlock()
+
+	// The servers report the same defaults.
+	for s := range p.servers {
+		return client.ParamsID(s)
+	}
+	return 0
+}
+
+// timeouts returns the timeouts of the client, with the query timeout of its
+// user if set.
+func (p *Pool) timeouts(client *conn.Client) conn.Timeouts {
+	timeouts := p.opts.Timeouts
+	if d, ok := p.opts.UserQueryTimeouts[client.User()]; ok {
+		timeouts.Query = d
+	}
+	return timeouts
+}
+
+func (p *Pool) handleConn(lconn net.Conn) error {
 	cid := p.cid.Add(1)
 
-	client := conn.NewClient(lconn, cid)
+	client := conn.NewClient(lconn, cid, p.opts.TrackedParameters)
 	defer client.Close()
+	defer p.removeClient(cid)
+
+	// The BPF program keeps keying the client on the socket tuple, the client
+	// address only matters to user space.
+	if p.opts.ProxyProtocol {
+		if err := client.ReadProxyHeader(); err != nil {
+			return fmt.Errorf("read proxy header: %w", err)
+		}
+	}
 
 	if err := client.Startup(); err != nil {
+		if errors.Is(err, conn.ErrCancelRequest) {
+			return p.cancel(client)
+		}
 		return fmt.Errorf("start up client connection: %w", err)
 	}
 
 	if p.bpf {
-		if err := p.setupBPFClientConn(lconn, cid); err != nil {
+		if err := p.setupBPFClientConn(lconn, cid, p.paramsID(client)); err != nil {
 			return fmt.Errorf("setup client bpf conn: %w", err)
 		}
-
-		time.Sleep(100 * time.Millisecond)
-		go p.startBPFProxy(client)
-		time.Sleep(100 * time.Millisecond)
-		go client.LoopReceive()
-		time.Sleep(100 * time.Millisecond)
-
-		if err := client.NotifyReady(); err != nil {
-			return fmt.Errorf("notify ready: %w", err)
+		if err := p.serveBPFClient(client, cid, false); err != nil && !errors.Is(err, conn.ErrHandoff) {
+			return err
 		}
-
-		<-ctx.Done()
 	} else {
 		go client.LoopReceive()
+		p.addClient(cid, client)
 		if err := client.NotifyReady(); err != nil {
 			return fmt.Errorf("notify ready: %w", err)
 		}
 
-		if err := p.loopProxy(client); err != nil {
+		if err := p.loopProxy(client, nil); err != nil && !errors.Is(err, conn.ErrHandoff) {
 			return fmt.Errorf("setup proxy: %w", err)
 		}
 	}
@@ -174,22 +694,16 @@ func (p *Pool) handleConn(ctx context.Context, lconn net.Conn) error {
 	return nil
 }
 
-func (p *Pool) setupBPFServerConn(conn net.Conn) error {
-	f, err := conn.(*net.TCPConn).File()
-	if err != nil {
-		return fmt.Errorf("get fd: %w", err)
-	}
-	defer f.Close()
-
-	fd := uint32(f.Fd())
-
+func (p *Pool) setupBPFServerConn(s *conn.Server) error {
+	conn := s.Conn()
 	if err := p.mapDAO.SetupServerState(conn); err != nil {
 		return fmt.Errorf("setup server state: %w", err)
 	}
-	if err := p.mapDAO.RegisterServer(conn); err != nil {
+	if err := p.mapDAO.RegisterServer(conn, s.ParamsID()); err != nil {
 		return fmt.Errorf("register server: %w", err)
 	}
-	if err := p.mapDAO.SetSockhash(conn, fd); err != nil {
+	fd, err := p.setSockhash(conn.(*net.TCPConn))
+	if err != nil {
 		return fmt.Errorf("set sockhash: %w", err)
 	}
 
@@ -198,19 +712,55 @@ func (p *Pool) setupBPFServerConn(conn net.Conn) error {
 	return nil
 }
 
-func (p *Pool) setupBPFClientConn(conn net.Conn, id uint32) error {
-	f, err := conn.(*net.TCPConn).File()
+// reconcileBPFMaps rebuilds the pinned maps, left by a previous process, from
+// the servers and the clients of the pool, the ones taken over from that
+// process included: the states of the sockets the pool does not own are
+// removed, and the servers without a state are set up again. The states of
+// the sockets taken over are kept, so that the BPF program goes on redirecting
+// between them.
+func (p *Pool) reconcileBPFMaps() error {
+	p.serversMu.RLock()
+	conns := make([]net.Conn, 0, len(p.servers))
+	servers := make(map[net.Conn]*conn.Server, len(p.servers))
+	for s := range p.servers {
+		conns = append(conns, s.Conn())
+		servers[s.Conn()] = s
+	}
+	p.serversMu.RUnlock()
+
+	clients := make([]net.Conn, 0, len(p.restored))
+	for _, rc := range p.restored {
+		clients = append(clients, rc.client.Conn())
+	}
+
+	missing, err := p.mapDAO.Reconcile(conns, clients)
 	if err != nil {
-		return fmt.Errorf("get fd: %w", err)
+		return err
+	}
+	for _, conn := range missing {
+		if err := p.setupBPFServerConn(servers[conn]); err != nil {
+			return fmt.Errorf("setup server bpf conn: %w", err)
+		}
 	}
-	defer f.Close()
 
-	fd := uint32(f.Fd())
+	log.Println("Reconciled BPF maps with", len(conns), "servers and", len(clients), "clients,",
+		len(missing), "servers of which were set up again")
+	return nil
+}
 
-	if err := p.mapDAO.SetupClientState(conn, id); err != nil {
+// setupBPFClientConn sets up the client for the BPF program, which binds it
+// the servers with the parameters params identifies.
+func (p *Pool) setupBPFClientConn(conn net.Conn, id uint32, params uint32) error {
+	if p.opts.BPFMaxMessageSize > 0 {
+		if err := setReceiveBuffer(conn.(*net.TCPConn), p.opts.BPFMaxMessageSize); err != nil {
+			return fmt.Errorf("set receive buffer: %w", err)
+		}
+	}
+	if err := p.mapDAO.SetupClientState(conn, id, params); err != nil {
 		return fmt.Errorf("setup client state: %w", err)
 	}
-	if err := p.mapDAO.SetSockhash(conn, fd); err != nil {
+	fd, err := p.setSockhash(conn.(*net.TCPConn))
+	if err != nil {
 		return fmt.Errorf("set sockhash: %w", err)
 	}
 
@@ -219,19 +769,90 @@ func (p *Pool) setupBPFClientConn(conn net.Conn, id uint32) error {
 	return nil
 }
 
-func (p *Pool) loopProxy(client *conn.Client) error {
-	for {
-		server := <-p.serverCh
+// loopProxy proxies the client to the servers of the pool, beginning with
+// server if the client already keeps one.
+func (p *Pool) loopProxy(client *conn.Client, server *conn.Server) error {
+	timeouts := p.timeouts(client)
+
+	for ; ; server = nil {
+		var msg pgproto3.FrontendMessage
+		if server == nil {
+			// Wait for the client before taking a server, so that idle clients
+			// and queries answered locally do not hold one.
+			var err error
+			msg, err = client.Receive(timeouts.ClientIdle)
+			if err != nil {
+				if errors.Is(err, conn.ErrHandoff) {
+					return p.handOff(client, nil)
+				}
+				if errors.Is(err, conn.ErrClientIdleTimeout) || errors.Is(err, conn.ErrAdminShutdown) {
+					if ferr := client.Fatal(err); ferr != nil {
+						log.Println("Failed to report disconnection to the client:", ferr)
+					}
+				}
+				return err
+			}
+			if _, ok := msg.(*pgproto3.Terminate); ok {
+				return nil
+			}
+
+			answered, err := p.localQueries.Answer(client, msg)
+			if err != nil {
+				return err
+			}
+			if answered {
+				continue
+			}
 
-		proxy := conn.NewProxy(server, client, p.mode == ModeTx)
-		if err := proxy.Start(); err != nil {
+			if server, err = p.waitServer(client, timeouts.QueryWait); err != nil {
+				if errors.Is(err, conn.ErrHandoff) {
+					return p.handOff(client, nil, msg)
+				}
+				if ferr := client.Fatal(err); ferr != nil {
+					log.Println("Failed to report disconnection to the client:", ferr)
+				}
+				return err
+			}
+		}
+
+		proxy := conn.NewProxy(
+			server,
+			client,
+			p.mode == ModeTx,
+			p.opts.PinPolicy,
+			timeouts,
+		)
+		if err := proxy.Start(msg); err != nil {
 			// When client terminates expectedly, we release the server and stop the
 			// proxy loop.
 			if errors.Is(err, conn.ErrClientTerminated) {
-				p.serverCh <- server
+				p.releaseServer(server, client.Pinned())
 				return nil
 			}
 
+			// When the client is disconnected, the proxy has reset the server, so
+			// we release the server and stop the proxy loop.
+			if errors.Is(err, conn.ErrClientClosed) ||
+				errors.Is(err, conn.ErrClientIdleTimeout) ||
+				errors.Is(err, conn.ErrIdleTransactionTimeout) ||
+				errors.Is(err, conn.ErrAdminShutdown) {
+				p.releaseServer(server, client.Pinned())
+				return err
+			}
+
+			// When the client is handed off along with the server, we stop the
+			// proxy loop.
+			if errors.Is(err, conn.ErrHandoff) {
+				return p.handOff(client, server)
+			}
+
+			// When the server ignores the cancellation of a timed out query, we
+			// replace the server and stop the proxy loop.
+			if errors.Is(err, conn.ErrServerUnresponsive) {
+				go p.replaceServer(server)
+				return err
+			}
+
 			// When the server transaction completes, we release the server and
 			// otherwise, we stop the proxy loop.
 			if !errors.Is(err, conn.ErrServerTxComplete) {
@@ -243,9 +864,356 @@ func (p *Pool) loopProxy(client *conn.Client) error {
 	}
 }
 
-func (p *Pool) startBPFProxy(client *conn.Client) {
-	proxy := conn.NewBPFProxy(client, p.servers, p.mapDAO, p.mode == ModeTx)
-	if err := proxy.Start(); err != nil {
+// releaseServer returns the server its client left to the pool, once the
+// session state the client left is reset. A server failing to is replaced.
+func (p *Pool) releaseServer(s *conn.Server, pinned bool) {
+	if err := p.resetSession(s, pinned); err != nil {
+		log.Println("Failed to reset server session:", err)
+		go p.replaceServer(s)
+		return
+	}
+	p.serverCh <- s
+}
+
+// resetSession runs the server reset query on the idle server its client
+// left, in session mode or once the client is pinned. Otherwise the client
+// left no session state, as it could have moved to another server.
+func (p *Pool) resetSession(s *conn.Server, pinned bool) error {
+	if p.opts.ServerResetQuery == "" || (p.mode == ModeTx && !pinned) {
+		return nil
+	}
+
+	if err := s.ResetSession(p.opts.ServerResetQuery); err != nil {
+		return err
+	}
+	if p.bpf {
+		if err := p.mapDAO.RemovePrepared(s.Conn()); err != nil {
+			return fmt.Errorf("remove prepared statements: %w", err)
+		}
+	}
+	return nil
+}
+
+// waitServer waits for a server to free up, until the timeout expires unless
+// it is zero, or the client is drained.
+func (p *Pool) waitServer(client *conn.Client, timeout time.Duration) (*conn.Server, error) {
+	var timeoutC <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+
+	select {
+	case server := <-p.serverCh:
+		return server, nil
+	case <-timeoutC:
+		return nil, conn.ErrQueryWaitTimeout
+	case <-client.Draining():
+		return nil, client.DrainReason()
+	}
+}
+
+// serveBPFClient serves the client set up for the BPF program, until it is
+// gone or handed off. The client taken over from the previous process is ready
+// already.
+func (p *Pool) serveBPFClient(client *conn.Client, id uint32, restored bool) error {
+	lconn := client.Conn()
+	handedOff := false
+	defer func() {
+		// The next process takes the state of the client over.
+		if handedOff {
+			return
+		}
+		if err := p.mapDAO.RemoveClient(lconn); err != nil {
+			log.Println("Failed to remove client state:", err)
+		}
+	}()
+
+	proxy := conn.NewBPFProxy(
+		client,
+		p.server,
+		p.waitBPFServer,
+		p.mapDAO,
+		p.mode == ModeTx,
+		p.opts.PinPolicy,
+		p.localQueries,
+	)
+	proxyErr := make(chan error, 1)
+
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		proxyErr <- p.startBPFProxy(client, proxy)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go client.LoopReceive()
+	p.addClient(id, client)
+	time.Sleep(100 * time.Millisecond)
+
+	if !restored {
+		if err := client.NotifyReady(); err != nil {
+			return fmt.Errorf("notify ready: %w", err)
+		}
+	}
+
+	watchErr := p.watchBPFClient(client, lconn)
+	// The BPF program goes on serving the client while it is handed off, once
+	// user space stops handling its messages.
+	if errors.Is(watchErr, conn.ErrHandoff) && errors.Is(<-proxyErr, conn.ErrHandoff) {
+		err := p.handOff(client, nil, proxy.Pending()...)
+		handedOff = errors.Is(err, conn.ErrHandoff)
+		return err
+	}
+
+	if err := p.releaseBPFClient(client); err != nil {
+		return fmt.Errorf("release client: %w", err)
+	}
+	if watchErr != nil && !errors.Is(watchErr, conn.ErrHandoff) {
+		return fmt.Errorf("watch client: %w", watchErr)
+	}
+	return nil
+}
+
+// startBPFProxy runs the BPF proxy of the client, which is closed once the
+// proxy fails. It returns ErrHandoff once the client is handed off.
+func (p *Pool) startBPFProxy(client *conn.Client, proxy *conn.BPFProxy) error {
+	err := proxy.Start()
+	switch {
+	case err == nil, errors.Is(err, conn.ErrHandoff):
+		return err
+	case errors.Is(err, conn.ErrClientTerminated):
+		// The BPF program orphaned the server of the terminated client, the
+		// client is closed right away rather than once it disconnects.
+	case errors.Is(err, conn.ErrQueryWaitTimeout):
+		if ferr := client.Fatal(err); ferr != nil {
+			log.Println("Failed to report disconnection to the client:", ferr)
+		}
+	default:
 		log.Println("Failed to run BPF proxy:", err)
 	}
+	client.Conn().Close()
+	return err
+}
+
+// releaseBPFClient returns the server still bound to the gone client to the
+// pool, once reset. The BPF program keeps the server bound in session mode,
+// and when the client leaves in the middle of a transaction.
+func (p *Pool) releaseBPFClient(client *conn.Client) error {
+	lconn := client.Conn()
+	act, err := p.mapDAO.GetClientActivity(lconn)
+	if err != nil {
+		// The BPF program already orphaned the server of the closed client.
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			return nil
+		}
+		return fmt.Errorf("get client activity: %w", err)
+	}
+	if !act.Bound {
+		return nil
+	}
+
+	port, bound, err := p.mapDAO.UnbindClient(lconn)
+	if err != nil {
+		return fmt.Errorf("unbind client: %w", err)
+	}
+	if !bound {
+		return nil
+	}
+	s, ok := p.server(port)
+	if !ok {
+		return fmt.Errorf("server not found for port %d", port)
+	}
+
+	// A query is running unless the server answered last.
+	if err := p.recycleBPFServer(s, act.ServerIdle > act.ClientIdle, act.Pinned); err != nil {
+		return err
+	}
+
+	log.Println("Released server", s.Conn().LocalAddr(), "of client", client.RemoteAddr())
+	return nil
+}
+
+// recycleBPFServer resets the server unbound from its client, and puts it back
+// to the queue of the BPF program. A server failing to is replaced, so that the
+// pool keeps its size.
+func (p *Pool) recycleBPFServer(s *conn.Server, running, pinned bool) error {
+	if err := s.Reset(running); err != nil {
+		go p.replaceServer(s)
+		return fmt.Errorf("reset server: %w", err)
+	}
+	if err := p.resetSession(s, pinned); err != nil {
+		go p.replaceServer(s)
+		return fmt.Errorf("reset server session: %w", err)
+	}
+	if err := p.mapDAO.RegisterServer(s.Conn(), s.ParamsID()); err != nil {
+		go p.replaceServer(s)
+		return fmt.Errorf("register server: %w", err)
+	}
+	return nil
+}
+
+// reclaimBPFServers resets the servers the BPF program unbound from closed
+// clients, and returns them to the pool, until the pool is shut down.
+func (p *Pool) reclaimBPFServers(ctx context.Context) {
+	ticker := time.NewTicker(bpfWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			orphan, err := p.mapDAO.PopOrphanedServer()
+			if err != nil {
+				log.Println("Failed to pop orphaned server:", err)
+				break
+			}
+			if orphan == nil {
+				break
+			}
+
+			s, ok := p.server(orphan.Port)
+			if !ok {
+				log.Println("Orphaned server not found for port", orphan.Port)
+				continue
+			}
+
+			if err := p.recycleBPFServer(s, orphan.Running, orphan.Pinned); err != nil {
+				log.Println("Failed to recycle orphaned server:", err)
+				continue
+			}
+
+			log.Println("Reclaimed orphaned server", s.Conn().LocalAddr())
+		}
+	}
+}
+
+// watchBPFClient enforces the timeouts of a client served by the BPF program,
+// based on the activity recorded in the BPF maps, and disconnects it once it
+// is between transactions when drained, releasing the server it keeps. It
+// returns once the client is gone, or ErrHandoff once it is handed off.
+func (p *Pool) watchBPFClient(client *conn.Client, lconn net.Conn) error {
+	timeouts := p.timeouts(client)
+	drainC := client.Draining()
+	draining := false
+
+	ticker := time.NewTicker(bpfWatchInterval)
+	defer ticker.Stop()
+
+	// cancelled is the time the running query was cancelled for running past
+	// the query timeout.
+	var cancelled time.Time
+
+	for {
+		select {
+		case <-client.Done():
+			return nil
+		case <-drainC:
+			// The client handed off keeps its server, whatever it is doing.
+			if errors.Is(client.DrainReason(), conn.ErrHandoff) {
+				return conn.ErrHandoff
+			}
+			draining, drainC = true, nil
+		case <-ticker.C:
+		}
+
+		act, err := p.mapDAO.GetClientActivity(lconn)
+		if err != nil {
+			// The BPF program removes the state of the closed client.
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				return nil
+			}
+			return fmt.Errorf("get client activity: %w", err)
+		}
+
+		var (
+			timeout    time.Duration
+			idle       time.Duration
+			running    bool
+			timeoutErr error
+		)
+		switch {
+		case !act.Bound:
+			timeout, idle, timeoutErr = timeouts.ClientIdle, act.ClientIdle, conn.ErrClientIdleTimeout
+		case act.ServerIdle <= act.ClientIdle && (act.Pinned || p.mode == ModeSession):
+			// The transaction status is unknown, a pinned client, or any client in
+			// session mode, keeps the server between transactions.
+			timeout, idle, timeoutErr = timeouts.ClientIdle, act.ServerIdle, conn.ErrClientIdleTimeout
+		case act.ServerIdle <= act.ClientIdle:
+			// The server answered last, the client is idle in the transaction.
+			timeout, idle, timeoutErr = timeouts.IdleTransaction, act.ServerIdle, conn.ErrIdleTransactionTimeout
+		default:
+			timeout, idle, timeoutErr = timeouts.Query, act.ClientIdle, conn.ErrQueryTimeout
+			running = true
+		}
+
+		// The cancelled query is over once the client sends again.
+		if !running || act.ClientIdle < time.Since(cancelled) {
+			cancelled = time.Time{}
+		}
+
+		switch {
+		case draining && !act.Bound:
+			timeoutErr = conn.ErrAdminShutdown
+		case draining && !running && act.TxIdle && act.Pending == 0:
+			// The client is between transactions, its server is released.
+			timeoutErr = conn.ErrAdminShutdown
+		case running && !cancelled.IsZero():
+			// The server answers the CancelRequest with an ErrorResponse, which the
+			// BPF program redirects to the client.
+			if time.Since(cancelled) < conn.CancelTimeout {
+				continue
+			}
+			timeoutErr = conn.ErrServerUnresponsive
+		case timeout <= 0 || idle < timeout:
+			continue
+		case running:
+			s, ok := p.server(act.ServerPort)
+			if !ok {
+				return fmt.Errorf("server not found for port %d", act.ServerPort)
+			}
+			if err := s.Cancel(); err != nil {
+				return fmt.Errorf("cancel query: %w", err)
+			}
+			cancelled = time.Now()
+			continue
+		}
+
+		if err := client.Fatal(timeoutErr); err != nil {
+			log.Println("Failed to report disconnection to the client:", err)
+		}
+
+		port, bound, err := p.mapDAO.UnbindClient(lconn)
+		if err != nil {
+			return fmt.Errorf("unbind client: %w", err)
+		}
+		if bound {
+			s, ok := p.server(port)
+			if !ok {
+				return fmt.Errorf("server not found for port %d", port)
+			}
+
+			if errors.Is(timeoutErr, conn.ErrServerUnresponsive) {
+				go p.replaceServer(s)
+				return timeoutErr
+			}
+
+			// The client may have sent a query since its activity was read, which
+			// the BPF program redirected to the server.
+			if after, err := p.mapDAO.GetClientActivity(lconn); err == nil && after.ClientIdle < act.ClientIdle {
+				running = true
+			}
+
+			if err := p.recycleBPFServer(s, running, act.Pinned); err != nil {
+				return err
+			}
+		}
+
+		return timeoutErr
+	}
 }
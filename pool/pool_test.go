@@ -0,0 +1,912 @@
+package pool
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/justin0u0/kpgpool/pool/conn"
+)
+
+// reportedParameters are the parameters the fake backend reports through
+// ParameterStatus, with their defaults. Like Postgres before 18, search_path
+// is not reported.
+var reportedParameters = map[string]string{
+	"application_name":            "",
+	"client_encoding":             "UTF8",
+	"datestyle":                   "ISO, MDY",
+	"intervalstyle":               "postgres",
+	"standard_conforming_strings": "on",
+	"timezone":                    "UTC",
+}
+
+var (
+	setConfigRe      = regexp.MustCompile(`(?i)^select pg_catalog\.set_config\('((?:[^']|'')*)', '((?:[^']|'')*)', false\)$`)
+	setRe            = regexp.MustCompile(`(?i)^set\s+(\w+)\s*(?:=|\s+to\s+)\s*'?((?:[^']|'')*?)'?$`)
+	resetRe          = regexp.MustCompile(`(?i)^reset\s+"?(\w+)"?$`)
+	currentSettingRe = regexp.MustCompile(`(?i)pg_catalog\.current_setting\('((?:[^']|'')*)'\)`)
+	sleepRe          = regexp.MustCompile(`(?i)^select pg_sleep\(([0-9.]+)\)$`)
+)
+
+// fakeQuery is a query received by the fake backend.
+type fakeQuery struct {
+	pid   uint32
+	query string
+}
+
+// fakeBackend is a Postgres server the pool connects to. It follows the
+// parameters set by SET, set_config and RESET, answers current_setting and
+// pg_backend_pid, and records the queries it receives.
+type fakeBackend struct {
+	t  *testing.T
+	ln net.Listener
+
+	mu      sync.Mutex
+	pid     uint32
+	queries []fakeQuery
+	// fail makes the backends fail the queries holding it.
+	fail string
+}
+
+func newFakeBackend(t *testing.T) *fakeBackend {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	b := &fakeBackend{t: t, ln: ln}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBackend) addr() string {
+	return b.ln.Addr().String()
+}
+
+// failQueries makes the backends fail the queries holding query.
+func (b *fakeBackend) failQueries(query string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.fail = query
+}
+
+// backends returns the number of backends started.
+func (b *fakeBackend) backends() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int(b.pid)
+}
+
+// received returns the queries received by the backend pid, or by every
+// backend if pid is zero.
+func (b *fakeBackend) received(pid uint32) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var queries []string
+	for _, q := range b.queries {
+		if pid == 0 || q.pid == pid {
+			queries = append(queries, q.query)
+		}
+	}
+	return queries
+}
+
+func (b *fakeBackend) serve(c net.Conn) {
+	defer c.Close()
+
+	be := pgproto3.NewBackend(c, c)
+	startup, err := be.ReceiveStartupMessage()
+	if err != nil {
+		return
+	}
+	if _, ok := startup.(*pgproto3.StartupMessage); !ok {
+		// The cancel requests are recorded as queries of their backend.
+		if m, ok := startup.(*pgproto3.CancelRequest); ok {
+			b.mu.Lock()
+			b.queries = append(b.queries, fakeQuery{m.ProcessID, "<cancel>"})
+			b.mu.Unlock()
+		}
+		return
+	}
+
+	b.mu.Lock()
+	b.pid++
+	pid := b.pid
+	b.mu.Unlock()
+
+	params := make(map[string]string)
+	reset := func() {
+		for name := range params {
+			delete(params, name)
+		}
+		for name, value := range reportedParameters {
+			params[name] = value
+		}
+		params["search_path"] = `"$user", public`
+	}
+	reset()
+
+	be.Send(&pgproto3.AuthenticationOk{})
+	for name, value := range reportedParameters {
+		be.Send(&pgproto3.ParameterStatus{Name: name, Value: value})
+	}
+	be.Send(&pgproto3.BackendKeyData{ProcessID: pid, SecretKey: pid})
+	be.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if err := be.Flush(); err != nil {
+		return
+	}
+
+	txStatus := byte('I')
+	set := func(name, value string) {
+		name = strings.ToLower(name)
+		params[name] = value
+		if _, ok := reportedParameters[name]; ok {
+			be.Send(&pgproto3.ParameterStatus{Name: name, Value: value})
+		}
+	}
+
+	for {
+		msg, err := be.Receive()
+		if err != nil {
+			return
+		}
+
+		switch m := msg.(type) {
+		case *pgproto3.Terminate:
+			return
+		case *pgproto3.Parse:
+			be.Send(&pgproto3.ParseComplete{})
+		case *pgproto3.Bind:
+			be.Send(&pgproto3.BindComplete{})
+		case *pgproto3.Execute:
+			be.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+		case *pgproto3.Sync:
+			be.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+		case *pgproto3.Query:
+			b.mu.Lock()
+			b.queries = append(b.queries, fakeQuery{pid, m.String})
+			fail := b.fail != "" && strings.Contains(m.String, b.fail)
+			b.mu.Unlock()
+
+			if fail {
+				be.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "XX000", Message: "failed"})
+				be.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+				break
+			}
+
+			for _, stmt := range strings.Split(m.String, ";") {
+				stmt = strings.TrimSpace(stmt)
+				if stmt == "" {
+					continue
+				}
+
+				switch lower := strings.ToLower(stmt); {
+				case lower == "begin":
+					txStatus = 'T'
+				case lower == "commit" || lower == "rollback":
+					txStatus = 'I'
+				case lower == "discard all" || lower == "reset all":
+					reset()
+				case setConfigRe.MatchString(stmt):
+					sm := setConfigRe.FindStringSubmatch(stmt)
+					set(unquote(sm[1]), unquote(sm[2]))
+				case setRe.MatchString(stmt):
+					sm := setRe.FindStringSubmatch(stmt)
+					set(sm[1], unquote(sm[2]))
+				case resetRe.MatchString(stmt):
+					name := strings.ToLower(resetRe.FindStringSubmatch(stmt)[1])
+					value, ok := reportedParameters[name]
+					if name == "search_path" {
+						value, ok = `"$user", public`, true
+					}
+					if ok {
+						set(name, value)
+					}
+				case currentSettingRe.MatchString(stmt):
+					var values [][]byte
+					for _, sm := range currentSettingRe.FindAllStringSubmatch(stmt, -1) {
+						values = append(values, []byte(params[strings.ToLower(unquote(sm[1]))]))
+					}
+					be.Send(&pgproto3.DataRow{Values: values})
+				case lower == "select pg_backend_pid()":
+					be.Send(&pgproto3.DataRow{Values: [][]byte{[]byte(strconv.Itoa(int(pid)))}})
+				case sleepRe.MatchString(stmt):
+					d, _ := strconv.ParseFloat(sleepRe.FindStringSubmatch(stmt)[1], 64)
+					time.Sleep(time.Duration(d * float64(time.Second)))
+				}
+				be.Send(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+			}
+			be.Send(&pgproto3.ReadyForQuery{TxStatus: txStatus})
+		}
+		if err := be.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func unquote(s string) string {
+	return strings.ReplaceAll(s, "''", "'")
+}
+
+// testPool is a pool served for a test.
+type testPool struct {
+	*Pool
+	closeOnce sync.Once
+}
+
+// close closes the pool, which the test may do before its cleanup.
+func (p *testPool) close() {
+	p.closeOnce.Do(func() {
+		if err := p.Close(); err != nil {
+			log.Println("Failed to close pool:", err)
+		}
+	})
+}
+
+// startPool serves a userspace pool of size servers of the backend on a Unix
+// socket, and returns the address of the socket.
+func startPool(t *testing.T, b *fakeBackend, size int, mode Mode, opts Options) (*testPool, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "kpgpool.sock")
+	p := &testPool{Pool: NewPool(b.addr(), unixAddrPrefix+path, size, mode, nil, false, opts)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.Serve(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		p.close()
+		if err := <-errCh; err != nil {
+			t.Errorf("Serve() = %v", err)
+		}
+	})
+
+	waitFor(t, func() bool {
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			return false
+		}
+		// The connection is only accepted once the listener is ready.
+		c.Close()
+		return true
+	})
+	return p, path
+}
+
+// waitFor waits for cond to hold, for at most a few seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testClient is a client of the pool.
+type testClient struct {
+	t        *testing.T
+	conn     net.Conn
+	frontend *pgproto3.Frontend
+	// params are the parameters reported by the pool.
+	params map[string]string
+	// processID and secretKey are the BackendKeyData of the pool.
+	processID uint32
+	secretKey uint32
+}
+
+// result is the answer to a query, copied out of the reused messages of the
+// frontend.
+type result struct {
+	rows     [][]string
+	err      *pgproto3.ErrorResponse
+	txStatus byte
+}
+
+func connectPool(t *testing.T, path string, params map[string]string) *testClient {
+	t.Helper()
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial pool: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return startClient(t, c, params)
+}
+
+// startClient starts up a client of the pool on the connection c.
+func startClient(t *testing.T, c net.Conn, params map[string]string) *testClient {
+	t.Helper()
+
+	startup := map[string]string{"user": "postgres", "database": "postgres"}
+	for name, value := range params {
+		startup[name] = value
+	}
+
+	tc := &testClient{t: t, conn: c, frontend: pgproto3.NewFrontend(c, c), params: make(map[string]string)}
+	tc.frontend.Send(&pgproto3.StartupMessage{ProtocolVersion: pgproto3.ProtocolVersionNumber, Parameters: startup})
+	if err := tc.frontend.Flush(); err != nil {
+		t.Fatalf("send startup message: %v", err)
+	}
+	if res := tc.receive(); res.err != nil {
+		t.Fatalf("startup: %s", res.err.Message)
+	}
+	return tc
+}
+
+// query runs the simple query and returns its result.
+func (c *testClient) query(sql string) result {
+	c.t.Helper()
+
+	c.frontend.Send(&pgproto3.Query{String: sql})
+	if err := c.frontend.Flush(); err != nil {
+		c.t.Fatalf("send query: %v", err)
+	}
+	return c.receive()
+}
+
+// receive receives the messages of the pool until ReadyForQuery, or until the
+// pool closes the connection after an error.
+func (c *testClient) receive() result {
+	c.t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	var res result
+	for {
+		msg, err := c.frontend.Receive()
+		if err != nil {
+			if res.err != nil {
+				return res
+			}
+			c.t.Fatalf("receive: %v", err)
+		}
+
+		switch m := msg.(type) {
+		case *pgproto3.ParameterStatus:
+			c.params[strings.ToLower(m.Name)] = m.Value
+		case *pgproto3.BackendKeyData:
+			c.processID, c.secretKey = m.ProcessID, m.SecretKey
+		case *pgproto3.DataRow:
+			row := make([]string, len(m.Values))
+			for i, v := range m.Values {
+				row[i] = string(v)
+			}
+			res.rows = append(res.rows, row)
+		case *pgproto3.ErrorResponse:
+			e := *m
+			res.err = &e
+		case *pgproto3.ReadyForQuery:
+			res.txStatus = m.TxStatus
+			return res
+		}
+	}
+}
+
+// pid returns the process ID of the backend serving the client.
+func (c *testClient) pid() uint32 {
+	c.t.Helper()
+
+	res := c.query("SELECT pg_backend_pid()")
+	if res.err != nil || len(res.rows) != 1 {
+		c.t.Fatalf("pg_backend_pid() = %+v", res)
+	}
+	pid, err := strconv.Atoi(res.rows[0][0])
+	if err != nil {
+		c.t.Fatalf("parse pid: %v", err)
+	}
+	return uint32(pid)
+}
+
+func TestPoolPinsSessionStatements(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		// pinned indicates whether the query pins the client.
+		pinned bool
+	}{
+		{"set", "SET statement_timeout = 0", true},
+		{"leading comment", "/* app */ SET statement_timeout = 0", true},
+		{"second statement", "SELECT 1; LISTEN events", true},
+		{"advisory lock", "SELECT pg_catalog.pg_advisory_lock(1)", true},
+		{"replayed parameter", "SET application_name = 'app'", false},
+		{"set local", "SET LOCAL statement_timeout = 0", false},
+		{"literal", "SELECT 'SET statement_timeout = 0'", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newFakeBackend(t)
+			_, path := startPool(t, b, 1, ModeTx, Options{
+				Timeouts: conn.Timeouts{QueryWait: 200 * time.Millisecond},
+			})
+
+			a := connectPool(t, path, nil)
+			if res := a.query(tt.query); res.err != nil {
+				t.Fatalf("query: %s", res.err.Message)
+			}
+
+			// The only server is held by the pinned client.
+			other := connectPool(t, path, nil)
+			res := other.query("SELECT 2")
+			if pinned := res.err != nil && res.err.Code == "08P01"; pinned != tt.pinned {
+				t.Errorf("pinned = %v, want %v (other client got %+v)", pinned, tt.pinned, res.err)
+			}
+		})
+	}
+}
+
+func TestPoolRejectsSessionStatements(t *testing.T) {
+	b := newFakeBackend(t)
+	_, path := startPool(t, b, 1, ModeTx, Options{
+		PinPolicy: conn.PinPolicyReject,
+		Timeouts:  conn.Timeouts{QueryWait: 200 * time.Millisecond},
+	})
+
+	a := connectPool(t, path, nil)
+	a.query("/* app */ SET statement_timeout = 0")
+
+	queries := b.received(0)
+	if len(queries) == 0 || !strings.Contains(queries[len(queries)-1], "RAISE EXCEPTION") {
+		t.Errorf("backend received %q, want the rejected statement query", queries)
+	}
+
+	other := connectPool(t, path, nil)
+	if res := other.query("SELECT 2"); res.err != nil {
+		t.Errorf("other client got %s, want the server of the rejected client", res.err.Message)
+	}
+}
+
+// setting returns the value of the parameter on the server of the client.
+func (c *testClient) setting(name string) string {
+	c.t.Helper()
+
+	res := c.query("SELECT pg_catalog.current_setting('" + name + "')")
+	if res.err != nil || len(res.rows) != 1 {
+		c.t.Fatalf("current_setting(%q) = %+v", name, res)
+	}
+	return res.rows[0][0]
+}
+
+func TestPoolReplaysParameters(t *testing.T) {
+	b := newFakeBackend(t)
+	_, path := startPool(t, b, 1, ModeTx, Options{
+		Timeouts: conn.Timeouts{QueryWait: 200 * time.Millisecond},
+	})
+
+	a := connectPool(t, path, map[string]string{"options": "-c search_path=app"})
+	other := connectPool(t, path, nil)
+
+	if res := a.query("SET application_name = 'a'"); res.err != nil {
+		t.Fatalf("set: %s", res.err.Message)
+	}
+
+	// Both clients share the only server, which gets the parameters of the
+	// client it serves.
+	for i := 0; i < 2; i++ {
+		if got := other.setting("application_name"); got != "" {
+			t.Errorf("application_name of the other client = %q, want the default", got)
+		}
+		if got := other.setting("search_path"); got != `"$user", public` {
+			t.Errorf("search_path of the other client = %q, want the default", got)
+		}
+		if got := a.setting("application_name"); got != "a" {
+			t.Errorf("application_name = %q, want the value set", got)
+		}
+		if got := a.setting("search_path"); got != "app" {
+			t.Errorf("search_path = %q, want the startup one", got)
+		}
+	}
+}
+
+func TestPoolPinsUnreportedParameters(t *testing.T) {
+	b := newFakeBackend(t)
+	_, path := startPool(t, b, 1, ModeTx, Options{
+		Timeouts: conn.Timeouts{QueryWait: 200 * time.Millisecond},
+	})
+
+	// The server does not report search_path, which cannot be replayed.
+	a := connectPool(t, path, nil)
+	if res := a.query("SET search_path = app"); res.err != nil {
+		t.Fatalf("set: %s", res.err.Message)
+	}
+
+	other := connectPool(t, path, nil)
+	if res := other.query("SELECT 2"); res.err == nil || res.err.Code != "08P01" {
+		t.Errorf("other client got %+v, want a query wait timeout", res.err)
+	}
+	if got := a.setting("search_path"); got != "app" {
+		t.Errorf("search_path = %q, want the value set", got)
+	}
+}
+
+func TestPoolAnswersLocalQueries(t *testing.T) {
+	b := newFakeBackend(t)
+	_, path := startPool(t, b, 1, ModeTx, Options{
+		LocalQueries: []string{"SELECT 42", "-- ping"},
+	})
+
+	c := connectPool(t, path, nil)
+	for _, tt := range []struct {
+		query string
+		rows  [][]string
+	}{
+		{"SELECT 42", [][]string{{"42"}}},
+		{"select  42;", [][]string{{"42"}}},
+		{"-- ping", nil},
+		{"", nil},
+	} {
+		res := c.query(tt.query)
+		if res.err != nil || !reflect.DeepEqual(res.rows, tt.rows) {
+			t.Errorf("query %q = %+v, want rows %v", tt.query, res, tt.rows)
+		}
+	}
+	if queries := b.received(0); len(queries) != 0 {
+		t.Errorf("backend received %q, want the local queries answered by the pool", queries)
+	}
+
+	c.query("SELECT 2")
+	if queries := b.received(0); !reflect.DeepEqual(queries, []string{"SELECT 2"}) {
+		t.Errorf("backend received %q, want the other queries", queries)
+	}
+}
+
+// startupPacket encodes the startup packet of code, the protocol version or
+// a request code, with the parameters.
+func startupPacket(code uint32, params ...string) []byte {
+	buf := binary.BigEndian.AppendUint32(make([]byte, 4), code)
+	for _, p := range params {
+		buf = append(append(buf, p...), 0)
+	}
+	if len(params) > 0 {
+		buf = append(buf, 0)
+	}
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)))
+	return buf
+}
+
+func TestPoolDeclinesEncryption(t *testing.T) {
+	b := newFakeBackend(t)
+	_, path := startPool(t, b, 1, ModeTx, Options{})
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial pool: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// A client asks for GSSAPI encryption first, then for SSL.
+	for _, code := range []uint32{80877104, 80877103} {
+		if _, err := c.Write(startupPacket(code)); err != nil {
+			t.Fatalf("send request %d: %v", code, err)
+		}
+		answer := make([]byte, 1)
+		if _, err := io.ReadFull(c, answer); err != nil || answer[0] != 'N' {
+			t.Fatalf("answer to request %d = %q, %v, want N", code, answer, err)
+		}
+	}
+
+	if _, err := c.Write(startupPacket(pgproto3.ProtocolVersionNumber, "user", "postgres")); err != nil {
+		t.Fatalf("send startup message: %v", err)
+	}
+	tc := &testClient{t: t, conn: c, frontend: pgproto3.NewFrontend(c, c), params: make(map[string]string)}
+	if res := tc.receive(); res.err != nil {
+		t.Fatalf("startup: %s", res.err.Message)
+	}
+	if res := tc.query("SELECT 2"); res.err != nil {
+		t.Errorf("query: %s", res.err.Message)
+	}
+}
+
+func TestPoolNegotiatesProtocol(t *testing.T) {
+	b := newFakeBackend(t)
+	_, path := startPool(t, b, 1, ModeTx, Options{})
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial pool: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Protocol 3.1 does not exist, the pool falls back to 3.0.
+	if _, err := c.Write(startupPacket(3<<16|1, "user", "postgres", "_pq_.extension", "on")); err != nil {
+		t.Fatalf("send startup message: %v", err)
+	}
+
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if hdr[0] != 'v' {
+		t.Fatalf("received message %q, want NegotiateProtocolVersion", hdr[0])
+	}
+	body := make([]byte, binary.BigEndian.Uint32(hdr[1:])-4)
+	if _, err := io.ReadFull(c, body); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if minor, n := binary.BigEndian.Uint32(body), binary.BigEndian.Uint32(body[4:]); minor != 0 || n != 1 ||
+		string(body[8:]) != "_pq_.extension\x00" {
+		t.Errorf("NegotiateProtocolVersion = %q, want minor 0 and the unrecognized option", body)
+	}
+
+	tc := &testClient{t: t, conn: c, frontend: pgproto3.NewFrontend(c, c), params: make(map[string]string)}
+	if res := tc.receive(); res.err != nil {
+		t.Fatalf("startup: %s", res.err.Message)
+	}
+	if res := tc.query("SELECT 2"); res.err != nil {
+		t.Errorf("query: %s", res.err.Message)
+	}
+}
+
+func TestPoolForwardsCancelRequests(t *testing.T) {
+	b := newFakeBackend(t)
+	_, path := startPool(t, b, 1, ModeTx, Options{})
+
+	a := connectPool(t, path, nil)
+	a.frontend.Send(&pgproto3.Query{String: "SELECT pg_sleep(1)"})
+	if err := a.frontend.Flush(); err != nil {
+		t.Fatalf("send query: %v", err)
+	}
+	waitFor(t, func() bool { return len(b.received(0)) > 0 })
+
+	cancel := func(secretKey uint32) {
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("dial pool: %v", err)
+		}
+		defer c.Close()
+
+		buf, err := (&pgproto3.CancelRequest{ProcessID: a.processID, SecretKey: secretKey}).Encode(nil)
+		if err != nil {
+			t.Fatalf("encode cancel request: %v", err)
+		}
+		if _, err := c.Write(buf); err != nil {
+			t.Fatalf("send cancel request: %v", err)
+		}
+		// The pool closes the connection once the request is handled.
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		io.Copy(io.Discard, c)
+	}
+
+	cancel(a.secretKey + 1)
+	cancel(a.secretKey)
+
+	// The server bound to the client gets the request, with its own key.
+	want := []string{"SELECT pg_sleep(1)", "<cancel>"}
+	waitFor(t, func() bool { return len(b.received(1)) >= len(want) })
+	if queries := b.received(1); !reflect.DeepEqual(queries, want) {
+		t.Errorf("backend received %q, want %q", queries, want)
+	}
+	if res := a.receive(); res.err != nil {
+		t.Errorf("query: %s", res.err.Message)
+	}
+	// The request with a wrong key is ignored.
+	if queries := b.received(1); !reflect.DeepEqual(queries, want) {
+		t.Errorf("backend received %q once the query is over, want %q", queries, want)
+	}
+}
+
+func TestPoolReplacesServerFailingReset(t *testing.T) {
+	b := newFakeBackend(t)
+	b.failQueries("DISCARD ALL")
+	_, path := startPool(t, b, 1, ModeTx, Options{ServerResetQuery: "DISCARD ALL"})
+
+	// The pinned client leaves session state on the server, which fails to
+	// reset it.
+	a := connectPool(t, path, nil)
+	if res := a.query("SET statement_timeout = 0"); res.err != nil {
+		t.Fatalf("set: %s", res.err.Message)
+	}
+	a.frontend.Send(&pgproto3.Terminate{})
+	if err := a.frontend.Flush(); err != nil {
+		t.Fatalf("send terminate: %v", err)
+	}
+
+	waitFor(t, func() bool { return b.backends() == 2 })
+	other := connectPool(t, path, nil)
+	if pid := other.pid(); pid != 2 {
+		t.Errorf("other client served by backend %d, want the replacing one", pid)
+	}
+}
+
+func TestPoolDrainsClients(t *testing.T) {
+	b := newFakeBackend(t)
+	p, path := startPool(t, b, 2, ModeTx, Options{ShutdownTimeout: 5 * time.Second})
+
+	idle := connectPool(t, path, nil)
+	pinned := connectPool(t, path, nil)
+	if res := pinned.query("SET statement_timeout = 0"); res.err != nil {
+		t.Fatalf("set: %s", res.err.Message)
+	}
+	inTx := connectPool(t, path, nil)
+	if res := inTx.query("BEGIN"); res.err != nil {
+		t.Fatalf("begin: %s", res.err.Message)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		p.close()
+		close(closed)
+	}()
+
+	// The clients between transactions are disconnected right away, even the
+	// pinned one keeping its server.
+	for name, c := range map[string]*testClient{"idle": idle, "pinned": pinned} {
+		if res := c.receive(); res.err == nil || res.err.Code != "57P01" {
+			t.Errorf("%s client got %+v, want an admin shutdown", name, res.err)
+		}
+	}
+
+	// The client in a transaction completes it first.
+	select {
+	case <-closed:
+		t.Fatal("pool closed before the transaction completed")
+	default:
+	}
+	if res := inTx.query("COMMIT"); res.err != nil {
+		t.Fatalf("commit: %s", res.err.Message)
+	}
+	if res := inTx.receive(); res.err == nil || res.err.Code != "57P01" {
+		t.Errorf("client in a transaction got %+v, want an admin shutdown", res.err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pool not closed once the clients are drained")
+	}
+}
+
+func TestPoolRejectsBPFWithUnixSockets(t *testing.T) {
+	b := newFakeBackend(t)
+	path := filepath.Join(t.TempDir(), "pool.sock")
+	p := NewPool(b.addr(), unixAddrPrefix+path, 1, ModeTx, nil, true, Options{})
+	if err := p.Serve(context.Background()); err == nil {
+		t.Fatal("BPF mode served a unix socket")
+	}
+}
+
+func TestPoolHandsOffClients(t *testing.T) {
+	b := newFakeBackend(t)
+	opts := Options{
+		HandoffSocket:   filepath.Join(t.TempDir(), "handoff.sock"),
+		ShutdownTimeout: 5 * time.Second,
+	}
+	old, path := startPool(t, b, 1, ModeTx, opts)
+
+	idle := connectPool(t, path, nil)
+	if res := idle.query("SET application_name = 'idle'"); res.err != nil {
+		t.Fatalf("set: %s", res.err.Message)
+	}
+	inTx := connectPool(t, path, nil)
+	if res := inTx.query("BEGIN"); res.err != nil {
+		t.Fatalf("begin: %s", res.err.Message)
+	}
+
+	// The new process takes the listener over from the old one.
+	p := NewPool(b.addr(), unixAddrPrefix+path, 1, ModeTx, nil, false, opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.Serve(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := p.Close(); err != nil {
+			t.Errorf("Close() = %v", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Errorf("Serve() = %v", err)
+		}
+	})
+
+	// The client in a transaction is handed off along with its server once it
+	// completes it.
+	waitFor(t, old.isShutdown)
+	if res := inTx.query("SELECT 2"); res.err != nil {
+		t.Fatalf("query in the transaction: %s", res.err.Message)
+	}
+	if res := inTx.query("COMMIT"); res.err != nil {
+		t.Fatalf("commit: %s", res.err.Message)
+	}
+
+	select {
+	case <-old.HandedOff():
+	case <-time.After(5 * time.Second):
+		t.Fatal("pool not handed off once the transaction completed")
+	}
+
+	// The clients and the server carry on with the new process, along with the
+	// parameters of the clients.
+	if got := idle.setting("application_name"); got != "idle" {
+		t.Errorf("application_name = %q, want the one set before the handoff", got)
+	}
+	if res := inTx.query("SELECT 2"); res.err != nil {
+		t.Errorf("query after the handoff: %s", res.err.Message)
+	}
+	if res := connectPool(t, path, nil).query("SELECT 2"); res.err != nil {
+		t.Errorf("query of a new client: %s", res.err.Message)
+	}
+	if n := b.backends(); n != 1 {
+		t.Errorf("%d backends started, want the server handed off only", n)
+	}
+}
+
+func TestPoolReadsProxyHeaders(t *testing.T) {
+	b := newFakeBackend(t)
+	p, path := startPool(t, b, 1, ModeTx, Options{ProxyProtocol: true})
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial pool: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if _, err := c.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 6432\r\n")); err != nil {
+		t.Fatalf("send proxy header: %v", err)
+	}
+
+	// The client is served as usual, under the address of the header.
+	tc := startClient(t, c, nil)
+	if res := tc.query("SELECT 2"); res.err != nil {
+		t.Fatalf("query: %s", res.err.Message)
+	}
+	p.clientsMu.Lock()
+	var addrs []string
+	for _, client := range p.clients {
+		addrs = append(addrs, client.RemoteAddr().String())
+	}
+	p.clientsMu.Unlock()
+	if want := []string{"192.168.0.1:56324"}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("client addresses = %v, want %v", addrs, want)
+	}
+
+	// A client without the header is refused.
+	c, err = net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("dial pool: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	frontend := pgproto3.NewFrontend(c, c)
+	frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres", "database": "postgres"},
+	})
+	if err := frontend.Flush(); err != nil {
+		t.Fatalf("send startup message: %v", err)
+	}
+	if _, err := frontend.Receive(); err == nil {
+		t.Error("client without a proxy header was served")
+	}
+}
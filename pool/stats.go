@@ -0,0 +1,163 @@
+package pool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/justin0u0/kpgpool/bpf"
+)
+
+// BPFStats returns the counters of the BPF program, in BPF mode.
+func (p *Pool) BPFStats() (*bpf.Stats, error) {
+	if !p.bpf {
+		return nil, errors.New("BPF mode is disabled")
+	}
+	return p.mapDAO.Stats()
+}
+
+// logBPFStats logs the counters of the BPF program over each stats period,
+// until the pool is shut down.
+func (p *Pool) logBPFStats(ctx context.Context) {
+	ticker := time.NewTicker(p.opts.StatsPeriod)
+	defer ticker.Stop()
+
+	last := &bpf.Stats{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.shutdown:
+			return
+		case <-ticker.C:
+		}
+
+		stats, err := p.mapDAO.Stats()
+		if err != nil {
+			log.Println("Failed to get BPF stats:", err)
+			continue
+		}
+
+		log.Printf("BPF stats: %d xacts, %d/%d client msgs/bytes, %d/%d server msgs/bytes redirected, %d pops, %d pushes",
+			stats.Transactions-last.Transactions,
+			stats.ClientRedirects-last.ClientRedirects,
+			stats.ClientRedirectBytes-last.ClientRedirectBytes,
+			stats.ServerRedirects-last.ServerRedirects,
+			stats.ServerRedirectBytes-last.ServerRedirectBytes,
+			stats.ServerPops-last.ServerPops,
+			stats.ServerPushes-last.ServerPushes,
+		)
+		log.Printf("BPF passes: %d no client state, %d no server, %d pending, %d large, %d unprepared, %d session, %d local, %d terminate, %d unbound server, %d non-targeted, %d parameters",
+			stats.Passes.NoClientState-last.Passes.NoClientState,
+			stats.Passes.NoServer-last.Passes.NoServer,
+			stats.Passes.Pending-last.Passes.Pending,
+			stats.Passes.LargeMessage-last.Passes.LargeMessage,
+			stats.Passes.UnpreparedStatement-last.Passes.UnpreparedStatement,
+			stats.Passes.SessionStatement-last.Passes.SessionStatement,
+			stats.Passes.LocalQuery-last.Passes.LocalQuery,
+			stats.Passes.Terminate-last.Passes.Terminate,
+			stats.Passes.UnboundServer-last.Passes.UnboundServer,
+			stats.Passes.NonTargeted-last.Passes.NonTargeted,
+			stats.Passes.Parameters-last.Passes.Parameters,
+		)
+		last = stats
+	}
+}
+
+// serveMetrics serves the counters of the BPF program on the metrics address
+// until the pool is shut down. The address is shared with SO_REUSEPORT, as the
+// process taking the pool over binds it before the previous one exits.
+func (p *Pool) serveMetrics(ctx context.Context) error {
+	lc := net.ListenConfig{Control: reusePort}
+	ln, err := lc.Listen(ctx, "tcp", p.opts.MetricsAddr)
+	if err != nil {
+		return fmt.Errorf("listen metrics: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p.MetricsHandler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-p.shutdown:
+		}
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("Failed to serve metrics:", err)
+		}
+	}()
+
+	log.Println("Serving metrics on", ln.Addr())
+	return nil
+}
+
+// MetricsHandler serves the counters of the BPF program in the Prometheus
+// text format.
+func (p *Pool) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats, err := p.BPFStats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		var buf bytes.Buffer
+		writeBPFMetrics(&buf, stats)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if _, err := buf.WriteTo(w); err != nil {
+			log.Println("Failed to write metrics:", err)
+		}
+	})
+}
+
+// writeBPFMetrics writes the counters of the BPF program as Prometheus
+// counters, the passes labelled by reason.
+func writeBPFMetrics(w io.Writer, stats *bpf.Stats) {
+	for _, m := range []struct {
+		name, help string
+		value      uint64
+	}{
+		{"transactions", "Transactions completed.", stats.Transactions},
+		{"client_redirected_messages", "Client messages redirected to servers.", stats.ClientRedirects},
+		{"client_redirected_bytes", "Bytes of the client messages redirected to servers.", stats.ClientRedirectBytes},
+		{"server_redirected_messages", "Server messages redirected to clients.", stats.ServerRedirects},
+		{"server_redirected_bytes", "Bytes of the server messages redirected to clients.", stats.ServerRedirectBytes},
+		{"server_pops", "Servers taken out of the queue.", stats.ServerPops},
+		{"server_pushes", "Servers put back to the queue.", stats.ServerPushes},
+	} {
+		fmt.Fprintf(w, "# HELP kpgpool_bpf_%s_total %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE kpgpool_bpf_%s_total counter\n", m.name)
+		fmt.Fprintf(w, "kpgpool_bpf_%s_total %d\n", m.name, m.value)
+	}
+
+	fmt.Fprintln(w, "# HELP kpgpool_bpf_passed_messages_total Messages passed to user space, by reason.")
+	fmt.Fprintln(w, "# TYPE kpgpool_bpf_passed_messages_total counter")
+	for _, pass := range []struct {
+		reason string
+		value  uint64
+	}{
+		{"no_client_state", stats.Passes.NoClientState},
+		{"no_server", stats.Passes.NoServer},
+		{"pending", stats.Passes.Pending},
+		{"large_message", stats.Passes.LargeMessage},
+		{"unprepared_statement", stats.Passes.UnpreparedStatement},
+		{"session_statement", stats.Passes.SessionStatement},
+		{"local_query", stats.Passes.LocalQuery},
+		{"terminate", stats.Passes.Terminate},
+		{"unbound_server", stats.Passes.UnboundServer},
+		{"non_targeted", stats.Passes.NonTargeted},
+		{"parameters", stats.Passes.Parameters},
+	} {
+		fmt.Fprintf(w, "kpgpool_bpf_passed_messages_total{reason=%q} %d\n", pass.reason, pass.value)
+	}
+}
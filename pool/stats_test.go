@@ -0,0 +1,73 @@
+package pool
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/justin0u0/kpgpool/bpf"
+)
+
+func TestWriteBPFMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	writeBPFMetrics(&buf, &bpf.Stats{
+		Transactions:        3,
+		ClientRedirects:     5,
+		ClientRedirectBytes: 120,
+		Passes:              bpf.PassStats{NoServer: 2, Parameters: 1},
+	})
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	for _, want := range []string{
+		"# TYPE kpgpool_bpf_transactions_total counter",
+		"kpgpool_bpf_transactions_total 3",
+		"kpgpool_bpf_client_redirected_messages_total 5",
+		"kpgpool_bpf_client_redirected_bytes_total 120",
+		"kpgpool_bpf_server_pops_total 0",
+		"# TYPE kpgpool_bpf_passed_messages_total counter",
+		`kpgpool_bpf_passed_messages_total{reason="no_server"} 2`,
+		`kpgpool_bpf_passed_messages_total{reason="parameters"} 1`,
+		`kpgpool_bpf_passed_messages_total{reason="pending"} 0`,
+	} {
+		found := false
+		for _, l := range lines {
+			if l == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("metrics miss %q:\n%s", want, buf.String())
+		}
+	}
+
+	// Every sample is declared as a counter beforehand.
+	declared := make(map[string]bool)
+	for _, l := range lines {
+		if strings.HasPrefix(l, "# TYPE ") {
+			name := strings.TrimSuffix(strings.TrimPrefix(l, "# TYPE "), " counter")
+			declared[name] = true
+			continue
+		}
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+		name, _, _ := strings.Cut(l, " ")
+		name, _, _ = strings.Cut(name, "{")
+		if !declared[name] {
+			t.Errorf("sample %q of an undeclared metric", l)
+		}
+	}
+}
+
+func TestMetricsHandlerWithoutBPF(t *testing.T) {
+	p := NewPool("", "", 1, ModeTx, nil, false, Options{})
+
+	rec := httptest.NewRecorder()
+	p.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}